@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//AggregateFunction is a function computing a value over a group of documents
+type AggregateFunction string
+
+//List of supported aggregate functions
+const (
+	Count AggregateFunction = "count"
+	Sum   AggregateFunction = "sum"
+	Min   AggregateFunction = "min"
+	Max   AggregateFunction = "max"
+	Avg   AggregateFunction = "avg"
+)
+
+//Aggregation describes a value computed over a group of documents.
+//Count without field counts the documents, count with a field counts the non null values.
+//Other functions only consider the numeric values of the field.
+type Aggregation struct {
+	Function AggregateFunction
+	Field    FieldPath
+}
+
+//ParseAggregation parses an aggregation such as "count" or "sum(properties.amount)"
+func ParseAggregation(s string) (Aggregation, error) {
+
+	s = strings.TrimSpace(s)
+
+	name, arg := s, ""
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return Aggregation{}, errors.New("invalid aggregation '" + s + "'")
+		}
+		name, arg = s[:i], s[i+1:len(s)-1]
+	}
+
+	a := Aggregation{Function: AggregateFunction(name)}
+	switch a.Function {
+	case Count:
+		if len(arg) == 0 {
+			return a, nil
+		}
+	case Sum, Min, Max, Avg:
+		if len(arg) == 0 {
+			return Aggregation{}, errors.New("missing field in aggregation '" + s + "'")
+		}
+	default:
+		return Aggregation{}, errors.New("unknown aggregate function '" + name + "'")
+	}
+
+	f, err := ParseFieldPath(arg)
+	if err != nil {
+		return Aggregation{}, err
+	}
+	if !f.IsProperty() {
+		return Aggregation{}, errors.New("only properties can be aggregated, got '" + arg + "'")
+	}
+	a.Field = f
+
+	return a, nil
+}
+
+func (a Aggregation) String() string {
+	if len(a.Field) == 0 {
+		return string(a.Function)
+	}
+	return string(a.Function) + "(" + a.Field.String() + ")"
+}
+
+//AggregateResult contains the values of the aggregations computed over a group of documents
+type AggregateResult struct {
+	Group  interface{}            `json:"group"`
+	Values map[string]interface{} `json:"values"`
+}
+
+//Aggregates represents the aggregations computed over a collection
+type Aggregates struct {
+	ID      string            `json:"id"`
+	GroupBy string            `json:"groupBy,omitempty"`
+	Results []AggregateResult `json:"results"`
+}
+
+//CollectionCount represents the number of documents of a collection
+type CollectionCount struct {
+	ID    string `json:"id"`
+	Count int64  `json:"count"`
+}
+
+type accumulator struct {
+	count    int64
+	numbers  int64
+	sum      float64
+	min, max float64
+}
+
+func (acc *accumulator) add(a Aggregation, d Document) {
+
+	if len(a.Field) == 0 {
+		acc.count++
+		return
+	}
+
+	v := a.Field.Value(d)
+	if v == nil {
+		return
+	}
+	acc.count++
+
+	if kindOf(v) != kindNumber {
+		return
+	}
+	f := toFloat(v)
+	if acc.numbers == 0 || f < acc.min {
+		acc.min = f
+	}
+	if acc.numbers == 0 || f > acc.max {
+		acc.max = f
+	}
+	acc.sum += f
+	acc.numbers++
+}
+
+func (acc *accumulator) value(a Aggregation) interface{} {
+
+	if a.Function == Count {
+		return acc.count
+	}
+	if acc.numbers == 0 {
+		return nil
+	}
+
+	switch a.Function {
+	case Sum:
+		return acc.sum
+	case Min:
+		return acc.min
+	case Max:
+		return acc.max
+	case Avg:
+		return acc.sum / float64(acc.numbers)
+	}
+	return nil
+}
+
+type aggregateGroup struct {
+	key          interface{}
+	accumulators []accumulator
+}
+
+//Aggregator computes aggregations document by document, for datastores unable to compute them natively
+type Aggregator struct {
+	groupBy      FieldPath
+	aggregations []Aggregation
+	groups       map[string]*aggregateGroup
+}
+
+//NewAggregator returns an aggregator computing the given aggregations, grouped by the value of a field if any
+func NewAggregator(groupBy FieldPath, aggregations []Aggregation) *Aggregator {
+	return &Aggregator{
+		groupBy:      groupBy,
+		aggregations: aggregations,
+		groups:       make(map[string]*aggregateGroup),
+	}
+}
+
+func (agg *Aggregator) group(key interface{}) *aggregateGroup {
+
+	// Values of the same group have the same JSON encoding
+	b, _ := json.Marshal(key)
+
+	g, found := agg.groups[string(b)]
+	if !found {
+		g = &aggregateGroup{
+			key:          key,
+			accumulators: make([]accumulator, len(agg.aggregations)),
+		}
+		agg.groups[string(b)] = g
+	}
+	return g
+}
+
+//Add adds a document to the aggregations
+func (agg *Aggregator) Add(d Document) {
+
+	var key interface{}
+	if len(agg.groupBy) > 0 {
+		key = agg.groupBy.Value(d)
+	}
+
+	g := agg.group(key)
+	for i, a := range agg.aggregations {
+		g.accumulators[i].add(a, d)
+	}
+}
+
+//Results returns the aggregated values of each group, sorted by group
+func (agg *Aggregator) Results() []AggregateResult {
+
+	if len(agg.groupBy) == 0 {
+		// Without grouping, there is always a single result, even for an empty collection
+		agg.group(nil)
+	}
+
+	results := make([]AggregateResult, 0, len(agg.groups))
+	for _, g := range agg.groups {
+		values := make(map[string]interface{})
+		for i, a := range agg.aggregations {
+			values[a.String()] = g.accumulators[i].value(a)
+		}
+		results = append(results, AggregateResult{
+			Group:  g.key,
+			Values: values,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return Compare(results[i].Group, results[j].Group) < 0
+	})
+
+	return results
+}
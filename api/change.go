@@ -0,0 +1,20 @@
+package api
+
+//ChangeType is the kind of write applied to a document
+type ChangeType string
+
+//List of change types
+const (
+	Added   ChangeType = "add"
+	Put     ChangeType = "put"
+	Patched ChangeType = "patch"
+	Deleted ChangeType = "delete"
+)
+
+//Change describes a write committed on a document.
+//For deletions, Document contains the content of the document before its deletion.
+type Change struct {
+	Type     ChangeType `json:"type"`
+	Target   ObjectRef  `json:"path"`
+	Document Document   `json:"document"`
+}
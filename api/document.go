@@ -6,11 +6,13 @@ import (
 	"github.com/rs/xid"
 )
 
-//Document represents a document in a collection
+//Document represents a document in a collection.
+//The revision is increased by the datastore each time the document is written, 0 if the datastore does not support it.
 type Document struct {
 	ID                   string                 `json:"id"`
 	CreationDate         time.Time              `json:"creationDate,omitempty"`
 	LastModificationDate time.Time              `json:"lastModificationDate,omitempty"`
+	Revision             int64                  `json:"revision,omitempty"`
 	Properties           map[string]interface{} `json:"properties"`
 }
 
@@ -28,6 +30,7 @@ func NextID() string {
 
 //Collection represents a list of documents
 type Collection struct {
-	ID       string     `json:"id"`
-	Features []Document `json:"features"`
+	ID            string     `json:"id"`
+	Features      []Document `json:"features"`
+	NextPageToken string     `json:"nextPageToken,omitempty"`
 }
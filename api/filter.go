@@ -0,0 +1,313 @@
+package api
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//FieldPath identifies a field of a document, e.g. "id", "creationDate" or "properties.status"
+type FieldPath []string
+
+//ParseFieldPath parses a dot separated field path
+func ParseFieldPath(s string) (FieldPath, error) {
+
+	items := strings.Split(s, ".")
+	for _, item := range items {
+		if len(item) == 0 {
+			return nil, errors.New("empty item in field path '" + s + "'")
+		}
+	}
+
+	switch items[0] {
+	case "id", "creationDate", "lastModificationDate":
+		if len(items) > 1 {
+			return nil, errors.New("invalid field path '" + s + "'")
+		}
+	case "properties":
+		if len(items) == 1 {
+			return nil, errors.New("missing property name in field path '" + s + "'")
+		}
+	default:
+		return nil, errors.New("unknown field '" + items[0] + "' in field path '" + s + "'")
+	}
+
+	return FieldPath(items), nil
+}
+
+func (p FieldPath) String() string {
+	return strings.Join(p, ".")
+}
+
+//IsProperty returns whether the path targets an item of the document properties
+func (p FieldPath) IsProperty() bool {
+	return len(p) > 1 && p[0] == "properties"
+}
+
+//IsDate returns whether the path targets one of the dates of the document
+func (p FieldPath) IsDate() bool {
+	return len(p) == 1 && (p[0] == "creationDate" || p[0] == "lastModificationDate")
+}
+
+//Value returns the value of the field in the document, nil if it does not exist
+func (p FieldPath) Value(d Document) interface{} {
+
+	if len(p) == 0 {
+		return nil
+	}
+
+	switch p[0] {
+	case "id":
+		return d.ID
+	case "creationDate":
+		return d.CreationDate
+	case "lastModificationDate":
+		return d.LastModificationDate
+	}
+
+	var v interface{} = d.Properties
+	for _, k := range p[1:] {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v = m[k]
+		case DocumentProperties:
+			v = m[k]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+//Operator is a comparison operator used in filter conditions
+type Operator string
+
+//List of supported operators
+const (
+	Equal          Operator = "=="
+	NotEqual       Operator = "!="
+	Less           Operator = "<"
+	LessOrEqual    Operator = "<="
+	Greater        Operator = ">"
+	GreaterOrEqual Operator = ">="
+)
+
+//Condition compares a field of the document to a value
+type Condition struct {
+	Field    FieldPath
+	Operator Operator
+	Value    interface{}
+}
+
+//Match returns whether the document satisfies the condition.
+//Values of different kinds are never equal, and cannot be compared with range operators
+func (c Condition) Match(d Document) bool {
+
+	v := c.Field.Value(d)
+
+	switch c.Operator {
+	case Equal:
+		return Compare(v, c.Value) == 0
+	case NotEqual:
+		return Compare(v, c.Value) != 0
+	}
+
+	if kindOf(v) != kindOf(c.Value) {
+		return false
+	}
+
+	r := Compare(v, c.Value)
+	switch c.Operator {
+	case Less:
+		return r < 0
+	case LessOrEqual:
+		return r <= 0
+	case Greater:
+		return r > 0
+	case GreaterOrEqual:
+		return r >= 0
+	}
+	return false
+}
+
+//Filter is a list of conditions that a document must all satisfy
+type Filter []Condition
+
+//Match returns whether the document satisfies all the conditions of the filter
+func (f Filter) Match(d Document) bool {
+	for _, c := range f {
+		if !c.Match(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// Kinds of values, in the order used to compare values of different kinds (same as PostgreSQL jsonb)
+const (
+	kindNull = iota
+	kindString
+	kindNumber
+	kindBoolean
+	kindArray
+	kindObject
+	kindDate
+)
+
+func kindOf(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return kindNull
+	case string:
+		return kindString
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		return kindNumber
+	case bool:
+		return kindBoolean
+	case []interface{}:
+		return kindArray
+	case map[string]interface{}, DocumentProperties:
+		return kindObject
+	case time.Time:
+		return kindDate
+	}
+	return kindNull
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	}
+	return 0
+}
+
+func toMap(v interface{}) map[string]interface{} {
+	if m, ok := v.(DocumentProperties); ok {
+		return m
+	}
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+//Compare returns an integer comparing two JSON-like values.
+//The result is 0 if a==b, -1 if a < b, and +1 if a > b.
+//Values of different kinds are ordered as null < string < number < boolean < array < object.
+func Compare(a, b interface{}) int {
+
+	ka, kb := kindOf(a), kindOf(b)
+	if ka != kb {
+		return compareInts(ka, kb)
+	}
+
+	switch ka {
+	case kindString:
+		return strings.Compare(a.(string), b.(string))
+	case kindNumber:
+		fa, fb := toFloat(a), toFloat(b)
+		if fa < fb {
+			return -1
+		}
+		if fa > fb {
+			return 1
+		}
+		return 0
+	case kindBoolean:
+		ba, bb := a.(bool), b.(bool)
+		if ba == bb {
+			return 0
+		}
+		if bb {
+			return -1
+		}
+		return 1
+	case kindDate:
+		ta, tb := a.(time.Time), b.(time.Time)
+		if ta.Before(tb) {
+			return -1
+		}
+		if ta.After(tb) {
+			return 1
+		}
+		return 0
+	case kindArray:
+		aa, ab := a.([]interface{}), b.([]interface{})
+		if r := compareInts(len(aa), len(ab)); r != 0 {
+			return r
+		}
+		for i := range aa {
+			if r := Compare(aa[i], ab[i]); r != 0 {
+				return r
+			}
+		}
+		return 0
+	case kindObject:
+		ma, mb := toMap(a), toMap(b)
+		if r := compareInts(len(ma), len(mb)); r != 0 {
+			return r
+		}
+		keys := make([]string, 0, len(ma)+len(mb))
+		for k := range ma {
+			keys = append(keys, k)
+		}
+		for k := range mb {
+			if _, found := ma[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			va, foundA := ma[k]
+			vb, foundB := mb[k]
+			if !foundA {
+				return 1
+			}
+			if !foundB {
+				return -1
+			}
+			if r := Compare(va, vb); r != 0 {
+				return r
+			}
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package api
+
+import "time"
+
+//Version is a version of a document, as written at its last modification date.
+//The version of a deleted document contains its content before the deletion, and is dated of the deletion.
+type Version struct {
+	Document
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+//History represents the versions of a document, the most recent first
+type History struct {
+	ID       string    `json:"id"`
+	Versions []Version `json:"versions"`
+}
+
+//Historian is the interface that the transactions of a datastore keeping the previous versions of the documents implement
+type Historian interface {
+	//History returns the versions of the document, the most recent first
+	History(document ObjectRef) ([]Version, error)
+	//GetAsOf returns the document as it was at the given date, or an error satisfying the NotFound interface if it did not exist
+	GetAsOf(document ObjectRef, t time.Time) (Document, error)
+}
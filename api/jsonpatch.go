@@ -0,0 +1,308 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//MergePatch returns the properties resulting from a JSON Merge Patch, as defined by RFC 7396:
+//objects are merged recursively, null values remove the fields, and other values replace them
+func MergePatch(properties map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	return toMap(mergePatch(properties, patch))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+
+	p := toMap(patch)
+	if p == nil {
+		return patch
+	}
+
+	current := toMap(target)
+	res := make(map[string]interface{}, len(current)+len(p))
+	for k, v := range current {
+		res[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = mergePatch(res[k], v)
+		}
+	}
+	return res
+}
+
+//JSONPatchOperation is an operation of a JSON Patch, as defined by RFC 6902.
+//Paths are JSON Pointers relative to the properties of the document.
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+//JSONPatchTestError is returned by ApplyJSONPatch when a test operation fails.
+//It is a conflict, as the document is not in the state expected by the client.
+type JSONPatchTestError struct {
+	Path string
+}
+
+func (err JSONPatchTestError) Error() string {
+	return "test failed on '" + err.Path + "'"
+}
+
+//IsConflict returns true
+func (err JSONPatchTestError) IsConflict() bool {
+	return true
+}
+
+//ApplyJSONPatch returns the properties resulting from the operations, which are applied in order.
+//The properties are left untouched.
+func ApplyJSONPatch(properties map[string]interface{}, operations []JSONPatchOperation) (map[string]interface{}, error) {
+
+	var doc interface{} = deepCopy(map[string]interface{}(properties))
+
+	for i, op := range operations {
+		var err error
+		doc, err = applyJSONPatchOperation(doc, op)
+		if err != nil {
+			if _, ok := err.(JSONPatchTestError); ok {
+				return nil, err
+			}
+			return nil, errors.Wrapf(err, "invalid operation %d", i)
+		}
+	}
+
+	res := toMap(doc)
+	if res == nil {
+		return nil, errors.New("the properties of a document must be an object")
+	}
+	return res, nil
+}
+
+func applyJSONPatchOperation(doc interface{}, op JSONPatchOperation) (interface{}, error) {
+
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, op.Value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		return replaceValue(doc, path, op.Value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return addValue(doc, path, deepCopy(value))
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("cannot move '" + op.From + "' into itself")
+		}
+		doc, err = removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "test":
+		value, err := getValue(doc, path)
+		if err != nil || Compare(value, op.Value) != 0 {
+			return nil, JSONPatchTestError{op.Path}
+		}
+		return doc, nil
+	}
+
+	return nil, errors.New("unknown operation '" + op.Op + "'")
+}
+
+//parsePointer returns the reference tokens of a JSON Pointer, as defined by RFC 6901
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.New("invalid path '" + pointer + "'")
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+//arrayIndex returns the index referenced by a token in an array of the given length.
+//When end is true, the index after the last element may be referenced by "-".
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || strconv.Itoa(i) != token || i < 0 {
+		return 0, errors.New("invalid array index '" + token + "'")
+	}
+	if i > length || (!end && i == length) {
+		return 0, errors.New("array index '" + token + "' out of bounds")
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			v, found := container[token]
+			if !found {
+				return nil, errors.New("missing field '" + token + "'")
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, errors.New("cannot get '" + token + "' of a value that is neither an object nor an array")
+		}
+	}
+	return doc, nil
+}
+
+//updateValue replaces the container of the last token of the path by the result of update, and returns the updated document
+func updateValue(doc interface{}, path []string, update func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+
+	token := path[0]
+	child, err := getValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateValue(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[token] = child
+	case []interface{}:
+		i, _ := arrayIndex(token, len(container), false)
+		container[i] = child
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateValue(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch container := c.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			res := make([]interface{}, 0, len(container)+1)
+			res = append(res, container[:i]...)
+			res = append(res, value)
+			return append(res, container[i:]...), nil
+		}
+		return nil, errors.New("cannot add '" + token + "' to a value that is neither an object nor an array")
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, error) {
+
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+
+	return updateValue(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch container := c.(type) {
+		case map[string]interface{}:
+			if _, found := container[token]; !found {
+				return nil, errors.New("missing field '" + token + "'")
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			res := make([]interface{}, 0, len(container)-1)
+			res = append(res, container[:i]...)
+			return append(res, container[i+1:]...), nil
+		}
+		return nil, errors.New("cannot remove '" + token + "' from a value that is neither an object nor an array")
+	})
+}
+
+func replaceValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateValue(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch container := c.(type) {
+		case map[string]interface{}:
+			if _, found := container[token]; !found {
+				return nil, errors.New("missing field '" + token + "'")
+			}
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			container[i] = value
+			return container, nil
+		}
+		return nil, errors.New("cannot replace '" + token + "' of a value that is neither an object nor an array")
+	})
+}
+
+//deepCopy copies the objects and arrays of a JSON value, so that it can be modified in place
+func deepCopy(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			res[k] = deepCopy(e)
+		}
+		return res
+	case DocumentProperties:
+		return deepCopy(map[string]interface{}(value))
+	case []interface{}:
+		res := make([]interface{}, len(value))
+		for i, e := range value {
+			res[i] = deepCopy(e)
+		}
+		return res
+	}
+	return v
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"strings"
 )
 
@@ -21,3 +22,22 @@ func (o ObjectRef) ID() string {
 func (d ObjectRef) Collection() ObjectRef {
 	return ObjectRef(d[:len(d)-1])
 }
+
+//MarshalJSON encodes the reference as a slash separated path
+func (o ObjectRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
+
+//UnmarshalJSON decodes a slash separated path
+func (o *ObjectRef) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if len(s) == 0 {
+		*o = nil
+		return nil
+	}
+	*o = ObjectRef(strings.Split(s, "/"))
+	return nil
+}
@@ -0,0 +1,56 @@
+package api
+
+import "strings"
+
+//Order describes a sort criterion used when listing a collection
+type Order struct {
+	Field      FieldPath
+	Descending bool
+}
+
+//ParseOrder parses a sort criterion: a field path optionally prefixed by '+' (ascending, the default) or '-' (descending)
+func ParseOrder(s string) (Order, error) {
+
+	s = strings.TrimSpace(s)
+
+	descending := false
+	if strings.HasPrefix(s, "-") {
+		descending = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	f, err := ParseFieldPath(s)
+	if err != nil {
+		return Order{}, err
+	}
+
+	return Order{
+		Field:      f,
+		Descending: descending,
+	}, nil
+}
+
+func (o Order) String() string {
+	if o.Descending {
+		return "-" + o.Field.String()
+	}
+	return o.Field.String()
+}
+
+//CompareDocuments compares two documents according to the sort criteria, ties being broken by ID
+func CompareDocuments(a, b Document, orderBy []Order) int {
+
+	for _, o := range orderBy {
+		r := Compare(o.Field.Value(a), o.Field.Value(b))
+		if o.Descending {
+			r = -r
+		}
+		if r != 0 {
+			return r
+		}
+	}
+
+	return strings.Compare(a.ID, b.ID)
+}
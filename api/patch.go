@@ -0,0 +1,147 @@
+package api
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//PatchOperator is a transform applied to a field of a document by a patch, instead of replacing its value,
+//e.g. {"views": {"$inc": 1}}
+type PatchOperator string
+
+//List of supported patch operators
+const (
+	Increment       PatchOperator = "$inc"
+	ArrayUnion      PatchOperator = "$arrayUnion"
+	ArrayRemove     PatchOperator = "$arrayRemove"
+	ServerTimestamp PatchOperator = "$serverTimestamp"
+	DeleteField     PatchOperator = "$delete"
+)
+
+//TimestampFormat is the format of the server timestamps set by patches
+const TimestampFormat = "2006-01-02T15:04:05.000000Z"
+
+//patchOperator returns the operator and its argument if the value of a patch is an operator
+func patchOperator(v interface{}) (PatchOperator, interface{}, bool) {
+
+	m := toMap(v)
+	if len(m) != 1 {
+		return "", nil, false
+	}
+
+	for k, arg := range m {
+		switch op := PatchOperator(k); op {
+		case Increment, ArrayUnion, ArrayRemove, ServerTimestamp, DeleteField:
+			return op, arg, true
+		}
+	}
+	return "", nil, false
+}
+
+//ApplyPatch returns the properties resulting from the patch.
+//Objects of the patch are merged recursively into the properties, operators transform the current values,
+//and other values replace them:
+//  $inc adds a number to the current value, considered as 0 if it is not a number
+//  $arrayUnion adds the elements that are not already in the current array
+//  $arrayRemove removes all the occurrences of the elements from the current array
+//  $serverTimestamp sets the current date of the server, formatted with TimestampFormat
+//  $delete removes the field
+func ApplyPatch(properties map[string]interface{}, patch map[string]interface{}, now time.Time) (map[string]interface{}, error) {
+
+	res := make(map[string]interface{}, len(properties)+len(patch))
+	for k, v := range properties {
+		res[k] = v
+	}
+
+	for k, v := range patch {
+
+		if op, arg, ok := patchOperator(v); ok {
+			value, keep, err := applyOperator(op, arg, res[k], now)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid operator on '"+k+"'")
+			}
+			if keep {
+				res[k] = value
+			} else {
+				delete(res, k)
+			}
+			continue
+		}
+
+		if child := toMap(v); child != nil {
+			patched, err := ApplyPatch(toMap(res[k]), child, now)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid patch of '"+k+"'")
+			}
+			res[k] = patched
+			continue
+		}
+
+		res[k] = v
+	}
+
+	return res, nil
+}
+
+//applyOperator returns the new value of a field, and whether the field is kept
+func applyOperator(op PatchOperator, arg interface{}, current interface{}, now time.Time) (interface{}, bool, error) {
+
+	switch op {
+	case Increment:
+		if kindOf(arg) != kindNumber {
+			return nil, false, errors.New(string(op) + " requires a number")
+		}
+		if kindOf(current) != kindNumber {
+			current = 0
+		}
+		return toFloat(current) + toFloat(arg), true, nil
+
+	case ArrayUnion, ArrayRemove:
+		elements, ok := arg.([]interface{})
+		if !ok {
+			return nil, false, errors.New(string(op) + " requires an array")
+		}
+		array, _ := current.([]interface{})
+
+		res := make([]interface{}, 0, len(array)+len(elements))
+		if op == ArrayUnion {
+			res = append(res, array...)
+			for _, e := range elements {
+				if !contains(res, e) {
+					res = append(res, e)
+				}
+			}
+		} else {
+			for _, e := range array {
+				if !contains(elements, e) {
+					res = append(res, e)
+				}
+			}
+		}
+		return res, true, nil
+
+	case ServerTimestamp:
+		if arg != true {
+			return nil, false, errors.New(string(op) + " requires true")
+		}
+		return now.UTC().Format(TimestampFormat), true, nil
+
+	case DeleteField:
+		if arg != true {
+			return nil, false, errors.New(string(op) + " requires true")
+		}
+		return nil, false, nil
+	}
+
+	return nil, false, errors.New("unknown operator " + string(op))
+}
+
+func contains(array []interface{}, v interface{}) bool {
+	for _, e := range array {
+		if Compare(e, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
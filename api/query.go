@@ -0,0 +1,17 @@
+package api
+
+//Query describes which documents of a collection are listed, and in which order
+type Query struct {
+	Filter  Filter
+	OrderBy []Order
+	//StartAfter restricts the query to the documents sorted after it (keyset pagination)
+	StartAfter *Document
+}
+
+//Match returns whether the document is part of the query result
+func (q Query) Match(d Document) bool {
+	if q.StartAfter != nil && CompareDocuments(d, *q.StartAfter, q.OrderBy) <= 0 {
+		return false
+	}
+	return q.Filter.Match(d)
+}
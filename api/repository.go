@@ -1,22 +1,52 @@
 package api
 
+import "io"
+
 //Repository describes the interface that a datastore should implement
 type Repository interface {
 	Init() error
 
 	Begin() (Transaction, error)
+
+	//Subscribe returns a subscription to the changes committed on the datastore, including by other processes
+	Subscribe() (Subscription, error)
+}
+
+//Migrator is implemented by the repositories whose database schema is versioned.
+//Migrate applies the pending migrations, reporting them to w; with dryRun, it only writes their SQL statements to w.
+type Migrator interface {
+	Migrate(w io.Writer, dryRun bool) error
 }
 
-//Transaction describes the interface that a datastore transaction should implement
+//Transaction describes the interface that a datastore transaction should implement.
+//The writes of a transaction are only visible to other transactions once it is committed.
+//The repotest package checks the expected behaviour of the implementations.
 type Transaction interface {
+	//Get returns an error satisfying the NotFound interface when the document does not exist
 	Get(document ObjectRef) (Document, error)
-	GetAll(collection ObjectRef, orderBy []string) (Cursor, error)
+	GetAll(collection ObjectRef, query Query) (Cursor, error)
+	Aggregate(collection ObjectRef, filter Filter, groupBy FieldPath, aggregations []Aggregation) ([]AggregateResult, error)
 	Add(collection ObjectRef, payload DocumentProperties) (Document, error)
 	Put(document ObjectRef, payload DocumentProperties) error
-	Patch(document ObjectRef, payload DocumentProperties) error
+	//Patch applies the patch to the current properties of the document atomically, as ApplyPatch does.
+	//It does nothing when the document does not exist.
+	Patch(document ObjectRef, patch DocumentProperties) error
+	//Delete does nothing when the document does not exist
 	Delete(document ObjectRef) error
+	//DeleteCollection deletes the documents of the collection, but not those of its sub-collections
 	DeleteCollection(collection ObjectRef) error
 
+	//PutIfRevision, PatchIfRevision and DeleteIfRevision only write the document if its current revision is the given one,
+	//and return an error satisfying the PreconditionFailed interface otherwise.
+	//A revision of 0 means that the document must not exist.
+	PutIfRevision(document ObjectRef, payload DocumentProperties, revision int64) error
+	PatchIfRevision(document ObjectRef, payload DocumentProperties, revision int64) error
+	DeleteIfRevision(document ObjectRef, revision int64) error
+	//CheckRevision fails with an error satisfying the PreconditionFailed interface, at the latest when committing,
+	//unless the revision of the document is the given one until the transaction is committed.
+	//It writes nothing, and other transactions may not modify the document in the meantime.
+	CheckRevision(document ObjectRef, revision int64) error
+
 	Commit() error
 	Rollback() error
 }
@@ -25,3 +55,10 @@ type Cursor interface {
 	Fetch(count int) ([]Document, error)
 	Close() error
 }
+
+//Subscription delivers the changes committed on a datastore.
+//The channel is closed when the subscription is closed, or when the subscriber does not keep up with the changes.
+type Subscription interface {
+	Changes() <-chan Change
+	Close() error
+}
@@ -0,0 +1,30 @@
+package api
+
+import "time"
+
+//TrashedDocument is a deleted document that can still be restored
+type TrashedDocument struct {
+	Document
+	DeletionDate time.Time `json:"deletionDate"`
+}
+
+//Trash represents the deleted documents of a collection that can still be restored
+type Trash struct {
+	ID       string            `json:"id"`
+	Features []TrashedDocument `json:"features"`
+}
+
+//RecycleBin is the interface that the transactions of a datastore keeping the deleted documents for a while implement
+type RecycleBin interface {
+	//GetTrash returns the deleted documents of the collection, the most recently deleted first
+	GetTrash(collection ObjectRef) ([]TrashedDocument, error)
+	//Restore restores a deleted document, or returns an error satisfying the NotFound interface if it is not in the trash,
+	//or the Conflict interface if the document exists again
+	Restore(document ObjectRef) (Document, error)
+}
+
+//Purger is the interface that a datastore keeping the deleted documents for a while implements
+type Purger interface {
+	//Purge definitely removes the deleted documents kept for longer than the retention period, and returns their number
+	Purge() (int64, error)
+}
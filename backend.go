@@ -0,0 +1,72 @@
+package grest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/bolt"
+	"github.com/xdbsoft/grest/memory"
+	"github.com/xdbsoft/grest/postgresql"
+)
+
+// embeddedBackends are the repositories embedded in the process, by prefix of the connection string.
+// They are given the rest of the connection string, such as the path of their file.
+var embeddedBackends = []struct {
+	scheme string
+	name   string
+	new    func(string) (api.Repository, error)
+}{
+	{"bolt://", "bolt", bolt.New},
+	{"bbolt://", "bolt", bolt.New},
+	{"sqlite://", "sqlite", newSQLite},
+	{"sqlite3://", "sqlite", newSQLite},
+	{"memory://", "memory", func(string) (api.Repository, error) { return memory.New(), nil }},
+}
+
+// newRepository returns the repository selected by the scheme of the connection string.
+// PostgreSQL is used by default, with either a connection URL or a list of keyword/value pairs.
+func newRepository(cfg Config) (api.Repository, error) {
+
+	for _, b := range embeddedBackends {
+		if strings.HasPrefix(cfg.DBConnStr, b.scheme) {
+			if cfg.SoftDelete {
+				return nil, errors.New("soft delete is not supported by the " + b.name + " repository")
+			}
+			if cfg.DBSchema != "" || cfg.DBTablePrefix != "" {
+				return nil, errors.New("schema and table prefix are not supported by the " + b.name + " repository")
+			}
+			return b.new(strings.TrimPrefix(cfg.DBConnStr, b.scheme))
+		}
+	}
+
+	return postgresql.NewWithConfig(postgresql.Config{
+		ConnStr:        cfg.DBConnStr,
+		SoftDelete:     cfg.SoftDelete,
+		TrashRetention: time.Duration(cfg.TrashRetentionDays) * 24 * time.Hour,
+		Schema:         cfg.DBSchema,
+		TablePrefix:    cfg.DBTablePrefix,
+		Indexes:        cfg.DBIndexes,
+	})
+}
+
+//Migrate applies the pending migrations of the database schema of the configured repository, and reports them to w.
+//With dryRun, the SQL statements of the pending migrations are only written to w.
+func Migrate(cfg Config, w io.Writer, dryRun bool) error {
+
+	r, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	m, ok := r.(api.Migrator)
+	if !ok {
+		fmt.Fprintln(w, "The repository has no schema migrations")
+		return nil
+	}
+	return m.Migrate(w, dryRun)
+}
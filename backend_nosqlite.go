@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package grest
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// newSQLite fails, as the SQLite driver requires cgo
+func newSQLite(path string) (api.Repository, error) {
+	return nil, errors.New("the sqlite repository requires cgo, which was disabled when building")
+}
@@ -0,0 +1,14 @@
+//go:build cgo
+// +build cgo
+
+package grest
+
+import (
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/sqlite"
+)
+
+// newSQLite returns the SQLite repository, whose driver requires cgo
+func newSQLite(path string) (api.Repository, error) {
+	return sqlite.New(path)
+}
@@ -0,0 +1,192 @@
+package grest
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/schema"
+)
+
+// batchPath is the path of the endpoint performing several writes in a single transaction
+const batchPath = "/_batch"
+
+// maxBatchSize is the maximum number of operations of a batch
+const maxBatchSize = 500
+
+// batchOperation is a write of a batch, on a document or a collection for additions:
+//   {"op":"add","path":"orders","data":{...}}
+//   {"op":"put","path":"orders/o1","data":{...},"ifMatch":"\"12\""}
+//   {"op":"patch","path":"orders/o1","data":{...}}
+//   {"op":"delete","path":"orders/o1"}
+type batchOperation struct {
+	Op      string                 `json:"op"`
+	Path    string                 `json:"path"`
+	Data    api.DocumentProperties `json:"data,omitempty"`
+	IfMatch string                 `json:"ifMatch,omitempty"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchResult is the result of an operation of a batch, with the same status code as the equivalent request
+type batchResult struct {
+	Status   int           `json:"status"`
+	Document *api.Document `json:"document,omitempty"`
+	ETag     string        `json:"etag,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Code     string        `json:"code,omitempty"`
+
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+// batchResponse contains the results of the operations of a batch.
+// When an operation fails, the batch is not committed and the following operations are not performed.
+type batchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []batchResult `json:"results"`
+}
+
+func (s *server) serveBatch(w http.ResponseWriter, r *http.Request, user api.User) {
+
+	if r.Method != "POST" {
+		handleError(w, r, badRequest("unsupported method"))
+		return
+	}
+
+	var req batchRequest
+	if err := getPayload(r, &req); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if len(req.Operations) == 0 {
+		handleError(w, r, badRequest("empty batch"))
+		return
+	}
+	if len(req.Operations) > maxBatchSize {
+		handleError(w, r, badRequest("too many operations in batch, the maximum is "+strconv.Itoa(maxBatchSize)))
+		return
+	}
+
+	resp, err := s.Batch(req.Operations, user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	// The status code of a failed batch is the one of the failed operation
+	statusCode := http.StatusOK
+	if !resp.Committed {
+		statusCode = resp.Results[len(resp.Results)-1].Status
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("Error: ", err)
+	}
+}
+
+// Batch performs the operations in a single transaction, all or nothing
+func (s *server) Batch(operations []batchOperation, user api.User) (batchResponse, error) {
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return batchResponse{}, err
+	}
+
+	resp := batchResponse{
+		Results: make([]batchResult, 0, len(operations)),
+	}
+
+	for _, op := range operations {
+		result, err := s.applyOperation(tx, op, user)
+		if err != nil {
+			log.Println("Error: ", err)
+			result.Status, result.Error = errorStatus(err)
+			result.Code = errorCode(result.Status)
+			if ice, ok := errors.Cause(err).(invalidContentError); ok {
+				result.Violations = ice.Violations
+			}
+			resp.Results = append(resp.Results, result)
+			// The failure of the rollback does not change the outcome of the batch, which is not committed either way
+			if err := tx.Rollback(); err != nil {
+				log.Println("Error: ", err)
+			}
+			return resp, nil
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return batchResponse{}, err
+	}
+	resp.Committed = true
+
+	return resp, nil
+}
+
+func (s *server) applyOperation(tx api.Transaction, op batchOperation, user api.User) (batchResult, error) {
+
+	target, err := getTarget(op.Path)
+	if err != nil {
+		return batchResult{}, err
+	}
+
+	if op.Op == "add" {
+		if target.IsDocument() {
+			return batchResult{}, badRequest("add operations require a collection path")
+		}
+		doc, err := s.addDocument(tx, target, op.Data, user)
+		if err != nil {
+			return batchResult{}, err
+		}
+		return s.documentResult(http.StatusAccepted, doc)
+	}
+
+	if !target.IsDocument() {
+		return batchResult{}, badRequest(op.Op + " operations require a document path")
+	}
+	cond := preconditions{IfMatch: op.IfMatch}
+
+	switch op.Op {
+	case "put":
+		doc, err := s.putDocument(tx, target, api.Document{ID: target.ID(), Properties: op.Data}, cond, user)
+		if err != nil {
+			return batchResult{}, err
+		}
+		return s.documentResult(http.StatusOK, doc)
+	case "patch":
+		doc, err := s.patchDocument(tx, target, patch{properties: op.Data}, cond, user)
+		if err != nil {
+			return batchResult{}, err
+		}
+		return s.documentResult(http.StatusOK, doc)
+	case "delete":
+		if err := s.deleteDocument(tx, target, cond, user); err != nil {
+			return batchResult{}, err
+		}
+		return batchResult{Status: http.StatusNoContent}, nil
+	}
+
+	return batchResult{}, badRequest("unsupported operation '" + op.Op + "'")
+}
+
+func (s *server) documentResult(statusCode int, doc api.Document) (batchResult, error) {
+
+	etag, err := s.computeEtag(doc)
+	if err != nil {
+		return batchResult{}, err
+	}
+
+	return batchResult{
+		Status:   statusCode,
+		Document: &doc,
+		ETag:     etag,
+	}, nil
+}
@@ -0,0 +1,200 @@
+//Package bolt implements a repository embedded in a single file, using bbolt.
+//The file may only be opened by one process at a time.
+package bolt
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/internal/optimistic"
+)
+
+var (
+	// documentsBucket contains a bucket per collection, in which documents are stored by ID
+	documentsBucket = []byte("documents")
+	// metaBucket contains the state of the repository
+	metaBucket  = []byte("meta")
+	revisionKey = []byte("revision")
+)
+
+//New returns a repository stored in the file at the given path, which is created if needed
+func New(path string) (api.Repository, error) {
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open "+path)
+	}
+
+	return &repository{db: db}, nil
+}
+
+type repository struct {
+	db     *bbolt.DB
+	broker optimistic.Broker
+
+	mu       sync.Mutex
+	revision int64
+
+	// commitMu is held from the commit until its changes are published, so that they are published in the order of the commits
+	commitMu sync.Mutex
+}
+
+func (r *repository) Init() error {
+
+	return r.db.Update(func(btx *bbolt.Tx) error {
+
+		if _, err := btx.CreateBucketIfNotExists(documentsBucket); err != nil {
+			return errors.Wrap(err, "unable to create bucket")
+		}
+		meta, err := btx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return errors.Wrap(err, "unable to create bucket")
+		}
+
+		// Revisions are never reused, so that they are assigned when writing, before the transaction is committed
+		if b := meta.Get(revisionKey); b != nil {
+			if err := json.Unmarshal(b, &r.revision); err != nil {
+				return errors.Wrap(err, "invalid revision")
+			}
+		}
+		return nil
+	})
+}
+
+func (r *repository) NextRevision() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revision++
+	return r.revision
+}
+
+func (r *repository) Begin() (api.Transaction, error) {
+	return optimistic.Begin(r), nil
+}
+
+func getDocument(btx *bbolt.Tx, d api.ObjectRef) (*api.Document, error) {
+
+	collection := btx.Bucket(documentsBucket).Bucket([]byte(d.Collection().String()))
+	if collection == nil {
+		return nil, nil
+	}
+	b := collection.Get([]byte(d.ID()))
+	if b == nil {
+		return nil, nil
+	}
+
+	var doc api.Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrap(err, "DB decoding failed")
+	}
+	return &doc, nil
+}
+
+func putDocument(btx *bbolt.Tx, d api.ObjectRef, doc api.Document) error {
+
+	collection, err := btx.Bucket(documentsBucket).CreateBucketIfNotExists([]byte(d.Collection().String()))
+	if err != nil {
+		return errors.Wrap(err, "unable to create collection")
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "DB encoding failed")
+	}
+	return collection.Put([]byte(d.ID()), b)
+}
+
+func deleteDocument(btx *bbolt.Tx, d api.ObjectRef) error {
+
+	collection := btx.Bucket(documentsBucket).Bucket([]byte(d.Collection().String()))
+	if collection == nil {
+		return nil
+	}
+	return collection.Delete([]byte(d.ID()))
+}
+
+func (r *repository) Get(d api.ObjectRef) (*api.Document, error) {
+
+	var doc *api.Document
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		var err error
+		doc, err = getDocument(btx, d)
+		return err
+	})
+	return doc, err
+}
+
+func (r *repository) Documents(c api.ObjectRef) ([]api.Document, error) {
+
+	var docs []api.Document
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		collection := btx.Bucket(documentsBucket).Bucket([]byte(c.String()))
+		if collection == nil {
+			return nil
+		}
+		return collection.ForEach(func(k, v []byte) error {
+			var doc api.Document
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return errors.Wrap(err, "DB decoding failed")
+			}
+			docs = append(docs, doc)
+			return nil
+		})
+	})
+	return docs, err
+}
+
+// batch writes the documents in a bbolt transaction
+type batch struct {
+	btx *bbolt.Tx
+}
+
+func (b batch) Get(d api.ObjectRef) (*api.Document, error) {
+	return getDocument(b.btx, d)
+}
+
+func (b batch) Put(d api.ObjectRef, doc api.Document) error {
+	return putDocument(b.btx, d, doc)
+}
+
+func (b batch) Delete(d api.ObjectRef) error {
+	return deleteDocument(b.btx, d)
+}
+
+//Commit applies the writes in a single bbolt transaction, which also records the last assigned revision
+func (r *repository) Commit(apply func(optimistic.Batch) ([]api.Change, error)) error {
+
+	r.commitMu.Lock()
+	defer r.commitMu.Unlock()
+
+	var changes []api.Change
+	err := r.db.Update(func(btx *bbolt.Tx) error {
+
+		var err error
+		changes, err = apply(batch{btx})
+		if err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		revision := r.revision
+		r.mu.Unlock()
+
+		b, err := json.Marshal(revision)
+		if err != nil {
+			return err
+		}
+		return btx.Bucket(metaBucket).Put(revisionKey, b)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.broker.Publish(changes)
+	return nil
+}
@@ -0,0 +1,11 @@
+package bolt
+
+import (
+	"github.com/xdbsoft/grest/api"
+)
+
+//Subscribe returns a subscription to the changes committed through the repository.
+//As the file is locked by the process, there cannot be changes committed by other processes.
+func (r *repository) Subscribe() (api.Subscription, error) {
+	return r.broker.Subscribe()
+}
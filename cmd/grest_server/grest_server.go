@@ -26,6 +26,9 @@ func loadConfig(path string) (grest.Config, error) {
 var configPath = flag.String("config", "grest_server.toml", "path to the configuration file")
 var listenAddr = flag.String("addr", ":9889", "address and port to listen on")
 
+// writeTimeout is the delay within which the responses must be written, except for the streams of changes
+const writeTimeout = 10 * time.Second
+
 func main() {
 
 	flag.Parse()
@@ -37,6 +40,18 @@ func main() {
 
 	log.Println(cfg)
 
+	// grest_server migrate [-dry-run] only applies the pending schema migrations
+	if flag.Arg(0) == "migrate" {
+		migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dryRun := migrateFlags.Bool("dry-run", false, "print the SQL statements of the pending migrations without applying them")
+		migrateFlags.Parse(flag.Args()[1:])
+
+		if err := grest.Migrate(cfg, os.Stdout, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	grestHandler, err := grest.Server(cfg)
 	if err != nil {
 		panic(err)
@@ -44,17 +59,27 @@ func main() {
 
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"authorization", "content-type"}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"authorization", "content-type", "if-match", "if-none-match"}),
+		handlers.ExposedHeaders([]string{"ETag", "Link", "X-Total-Count"}),
 	)(grestHandler)
 
 	loggedRouter := handlers.LoggingHandler(os.Stdout, corsHandler)
 
+	// The write timeout of the server would cut the streams of changes, so it only applies to the other requests
+	timeoutRouter := http.TimeoutHandler(loggedRouter, writeTimeout, "")
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grest.IsStreaming(r) {
+			loggedRouter.ServeHTTP(w, r)
+			return
+		}
+		timeoutRouter.ServeHTTP(w, r)
+	})
+
 	s := &http.Server{
 		Addr:           *listenAddr,
-		Handler:        loggedRouter,
+		Handler:        router,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 	log.Fatal(s.ListenAndServe())
@@ -1,12 +1,27 @@
 package grest
 
 import (
+	"github.com/xdbsoft/grest/postgresql"
 	"github.com/xdbsoft/grest/rules"
 )
 
 // Config contains all required information for the intialisation of a grest server
 type Config struct {
 	OpenIDConnectIssuer string
-	DBConnStr           string
-	Rules               []rules.Rule
+	// DBConnStr selects the datastore: a file path prefixed by bolt:// or sqlite:// for an embedded datastore, memory://, or PostgreSQL otherwise
+	DBConnStr string
+	// DBSchema and DBTablePrefix place the PostgreSQL tables in a dedicated schema and prefix their names,
+	// so that several servers may share a database
+	DBSchema      string
+	DBTablePrefix string
+	// DBIndexes are created on the properties of the documents of the matching collections, so that the queries filtering
+	// and sorting them remain fast on large collections. They are only used by PostgreSQL.
+	DBIndexes []postgresql.Index
+	Rules     []rules.Rule
+	// SoftDelete keeps the deleted documents in a trash, from which they can be restored during TrashRetentionDays (30 by default)
+	SoftDelete         bool
+	TrashRetentionDays int
+	// HideForbidden replies 404 Not Found instead of 403 Forbidden when a user is not allowed to read a document,
+	// so that its existence is not disclosed
+	HideForbidden bool
 }
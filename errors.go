@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/schema"
 )
 
 //IsNotFound returns whether the error cause is that something was not found
@@ -19,7 +20,7 @@ type NotFound interface {
 	IsNotFound() bool
 }
 
-//IsNotAuthorized returns whether the error cause is that there was an attempt to perform a not authorized action
+//IsNotAuthorized returns whether the error cause is that the user is not authenticated, or its credentials are invalid
 func IsNotAuthorized(err error) bool {
 	nae, ok := errors.Cause(err).(NotAuthorized)
 	return ok && nae.IsNotAuthorized()
@@ -30,6 +31,17 @@ type NotAuthorized interface {
 	IsNotAuthorized() bool
 }
 
+//IsForbidden returns whether the error cause is that an authenticated user attempted to perform an action denied by the rules
+func IsForbidden(err error) bool {
+	fe, ok := errors.Cause(err).(Forbidden)
+	return ok && fe.IsForbidden()
+}
+
+//Forbidden is the interface that wraps the IsForbidden method
+type Forbidden interface {
+	IsForbidden() bool
+}
+
 //IsBadRequest returns whether the error cause is that the provided inputs are incorrect
 func IsBadRequest(err error) bool {
 	nae, ok := errors.Cause(err).(BadRequest)
@@ -41,6 +53,61 @@ type BadRequest interface {
 	IsBadRequest() bool
 }
 
+//IsPreconditionFailed returns whether the error cause is that the target does not satisfy the preconditions of the request
+func IsPreconditionFailed(err error) bool {
+	pfe, ok := errors.Cause(err).(PreconditionFailed)
+	return ok && pfe.IsPreconditionFailed()
+}
+
+//PreconditionFailed is the interface that wraps the IsPreconditionFailed method
+type PreconditionFailed interface {
+	IsPreconditionFailed() bool
+}
+
+//IsConflict returns whether the error cause is that the target was modified concurrently
+func IsConflict(err error) bool {
+	ce, ok := errors.Cause(err).(Conflict)
+	return ok && ce.IsConflict()
+}
+
+//Conflict is the interface that wraps the IsConflict method
+type Conflict interface {
+	IsConflict() bool
+}
+
+//IsInvalidContent returns whether the error cause is that the content of a document does not match its schema
+func IsInvalidContent(err error) bool {
+	ice, ok := errors.Cause(err).(InvalidContent)
+	return ok && ice.IsInvalidContent()
+}
+
+//InvalidContent is the interface that wraps the IsInvalidContent method
+type InvalidContent interface {
+	IsInvalidContent() bool
+}
+
+//IsTooManyRequests returns whether the error cause is that the user exceeded a limit, and should retry later
+func IsTooManyRequests(err error) bool {
+	tme, ok := errors.Cause(err).(TooManyRequests)
+	return ok && tme.IsTooManyRequests()
+}
+
+//TooManyRequests is the interface that wraps the IsTooManyRequests method
+type TooManyRequests interface {
+	IsTooManyRequests() bool
+}
+
+//IsUnavailable returns whether the error cause is that the server cannot serve the request for now, whoever the user is
+func IsUnavailable(err error) bool {
+	ue, ok := errors.Cause(err).(Unavailable)
+	return ok && ue.IsUnavailable()
+}
+
+//Unavailable is the interface that wraps the IsUnavailable method
+type Unavailable interface {
+	IsUnavailable() bool
+}
+
 type badRequest string
 
 func (err badRequest) IsBadRequest() bool {
@@ -50,18 +117,44 @@ func (err badRequest) Error() string {
 	return string(err)
 }
 
+// notAuthorizedError is returned when the credentials of the user are invalid (without target),
+// or when the rules deny an access to an anonymous user, who may be allowed once authenticated
 type notAuthorizedError struct {
 	Target api.ObjectRef
+	Rule   string // Path of the rule that denied the access, if any
 }
 
 func (err notAuthorizedError) Error() string {
-	return fmt.Sprintf("Not authorized to access '%s'", err.Target)
+	if len(err.Target) == 0 {
+		return "Invalid credentials"
+	}
+	return fmt.Sprintf("Authentication required to access '%s'", err.Target)
 }
 
 func (err notAuthorizedError) IsNotAuthorized() bool {
 	return true
 }
 
+// forbiddenError is returned when the rules deny an access to an authenticated user.
+// A hidden error is reported as if the target did not exist, so that its existence is not disclosed.
+type forbiddenError struct {
+	Target api.ObjectRef
+	Rule   string // Path of the rule that denied the access, if any
+	Hidden bool
+}
+
+func (err forbiddenError) Error() string {
+	return fmt.Sprintf("Not allowed to access '%s'", err.Target)
+}
+
+func (err forbiddenError) IsForbidden() bool {
+	return true
+}
+
+func (err forbiddenError) IsNotFound() bool {
+	return err.Hidden
+}
+
 type notFoundError struct {
 	Target api.ObjectRef
 }
@@ -73,3 +166,76 @@ func (err notFoundError) Error() string {
 func (err notFoundError) IsNotFound() bool {
 	return true
 }
+
+type preconditionFailedError struct {
+	Target api.ObjectRef
+}
+
+func (err preconditionFailedError) Error() string {
+	return fmt.Sprintf("Precondition failed on '%s'", err.Target)
+}
+
+func (err preconditionFailedError) IsPreconditionFailed() bool {
+	return true
+}
+
+type conflictError struct {
+	Target api.ObjectRef
+}
+
+func (err conflictError) Error() string {
+	if len(err.Target) == 0 {
+		return "Concurrent modification of the documents of the transaction"
+	}
+	return fmt.Sprintf("Concurrent modification of '%s'", err.Target)
+}
+
+func (err conflictError) IsConflict() bool {
+	return true
+}
+
+type alreadyExistsError struct {
+	Target api.ObjectRef
+}
+
+func (err alreadyExistsError) Error() string {
+	return fmt.Sprintf("Document '%s' already exists", err.Target)
+}
+
+func (err alreadyExistsError) IsConflict() bool {
+	return true
+}
+
+type invalidContentError struct {
+	Target     api.ObjectRef
+	Violations []schema.Violation
+}
+
+func (err invalidContentError) Error() string {
+	return fmt.Sprintf("Invalid content of '%s': %d violation(s) of its schema", err.Target, len(err.Violations))
+}
+
+func (err invalidContentError) IsInvalidContent() bool {
+	return true
+}
+
+// tooManyTransactionsError is returned when a transaction cannot be begun because the user (or, when global,
+// all the users together) already has the maximum number of ongoing transactions
+type tooManyTransactionsError struct {
+	Global bool
+}
+
+func (err tooManyTransactionsError) Error() string {
+	if err.Global {
+		return "Too many ongoing transactions, retry later"
+	}
+	return "Too many ongoing transactions for the user, commit or roll back some of them first"
+}
+
+func (err tooManyTransactionsError) IsTooManyRequests() bool {
+	return !err.Global
+}
+
+func (err tooManyTransactionsError) IsUnavailable() bool {
+	return err.Global
+}
@@ -3,12 +3,15 @@ module github.com/xdbsoft/grest
 require (
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/gorilla/handlers v1.5.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jinzhu/configor v1.2.0
 	github.com/lib/pq v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/pkg/errors v0.9.1
 	github.com/pquerna/cachecontrol v0.0.0-20200819021114-67c6ae64274f // indirect
 	github.com/rs/xid v1.2.1
 	github.com/xdbsoft/gript v0.0.0-20190911151631-1d9693423696
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
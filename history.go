@@ -0,0 +1,105 @@
+package grest
+
+import (
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// historian returns the history of the transaction documents, if the datastore keeps it
+func historian(tx api.Transaction) (api.Historian, error) {
+	h, ok := tx.(api.Historian)
+	if !ok {
+		return nil, badRequest("History is not supported by the datastore")
+	}
+	return h, nil
+}
+
+func (s *server) GetDocumentHistory(target api.ObjectRef, user api.User) (api.History, error) {
+
+	r, err := s.GetRuleAndCheckPath(target, user, false)
+	if err != nil {
+		return api.History{}, err
+	}
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return api.History{}, err
+	}
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	h, err := historian(tx)
+	if err != nil {
+		return api.History{}, err
+	}
+
+	versions, err := h.History(target)
+	if err != nil {
+		return api.History{}, err
+	}
+
+	history := api.History{
+		ID:       target.ID(),
+		Versions: []api.Version{},
+	}
+
+	// Versions that the user would not have been allowed to read are omitted
+	checker := r.PrepareCheckContent(false, s.GetDocument)
+	for _, v := range versions {
+		ok, err := checker.Check(v.Document, api.Document{})
+		if err != nil {
+			return api.History{}, err
+		}
+		if ok {
+			history.Versions = append(history.Versions, v)
+		}
+	}
+
+	return history, nil
+}
+
+func (s *server) GetDocumentAsOf(target api.ObjectRef, asOf time.Time, user api.User) (api.Document, error) {
+
+	r, err := s.GetRuleAndCheckPath(target, user, false)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return api.Document{}, err
+	}
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	h, err := historian(tx)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	data, err := h.GetAsOf(target, asOf)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	ok, err := r.PrepareCheckContent(false, s.GetDocument).Check(data, api.Document{})
+	if err != nil {
+		return api.Document{}, err
+	}
+	if !ok {
+		return api.Document{}, s.denied(target, r, user, false)
+	}
+
+	return data, nil
+}
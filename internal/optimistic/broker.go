@@ -0,0 +1,78 @@
+package optimistic
+
+import (
+	"log"
+	"sync"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// subscriptionBufferSize is the number of changes a subscriber may lag behind before its subscription is closed
+const subscriptionBufferSize = 100
+
+//Broker sends the changes committed in the process to its subscribers.
+//Its zero value is ready to use.
+type Broker struct {
+	mu            sync.Mutex
+	subscriptions map[*subscription]struct{}
+}
+
+type subscription struct {
+	b       *Broker
+	changes chan api.Change
+}
+
+func (s *subscription) Changes() <-chan api.Change {
+	return s.changes
+}
+
+func (s *subscription) Close() error {
+
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	if _, found := s.b.subscriptions[s]; found {
+		delete(s.b.subscriptions, s)
+		close(s.changes)
+	}
+
+	return nil
+}
+
+//Subscribe returns a subscription to the changes published from now on
+func (b *Broker) Subscribe() (api.Subscription, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[*subscription]struct{})
+	}
+
+	s := &subscription{
+		b:       b,
+		changes: make(chan api.Change, subscriptionBufferSize),
+	}
+	b.subscriptions[s] = struct{}{}
+
+	return s, nil
+}
+
+//Publish sends the changes to the subscribers, closing the subscriptions of those lagging behind
+func (b *Broker) Publish(changes []api.Change) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range changes {
+		for s := range b.subscriptions {
+			select {
+			case s.changes <- c:
+			default:
+				log.Println("Subscriber is too slow, closing its subscription")
+				delete(b.subscriptions, s)
+				close(s.changes)
+			}
+		}
+	}
+}
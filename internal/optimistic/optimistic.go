@@ -0,0 +1,530 @@
+//Package optimistic implements the transactions of the embedded repositories.
+//
+//A transaction reads the committed documents and its own writes, which are recorded and applied atomically
+//when it is committed. Writes conditioned by a revision are checked again at that time, so that they fail
+//if the document was modified by a concurrent transaction in the meantime.
+package optimistic
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+//Store gives access to the committed documents of a repository
+type Store interface {
+	//Get returns the committed document, nil if it does not exist
+	Get(d api.ObjectRef) (*api.Document, error)
+	//Documents returns the committed documents of the collection
+	Documents(c api.ObjectRef) ([]api.Document, error)
+	//NextRevision returns a revision that was never assigned
+	NextRevision() int64
+	//Commit calls apply with the committed documents, and commits its writes atomically unless it fails.
+	//The changes returned by apply are then published to the subscribers.
+	Commit(apply func(Batch) ([]api.Change, error)) error
+}
+
+//Batch contains the writes being committed
+type Batch interface {
+	//Get returns the document, as modified by the batch, nil if it does not exist
+	Get(d api.ObjectRef) (*api.Document, error)
+	Put(d api.ObjectRef, doc api.Document) error
+	Delete(d api.ObjectRef) error
+}
+
+type notFound string
+
+func (err notFound) IsNotFound() bool {
+	return true
+}
+func (err notFound) Error() string {
+	return string(err)
+}
+
+type revisionMismatch string
+
+func (err revisionMismatch) IsPreconditionFailed() bool {
+	return true
+}
+func (err revisionMismatch) Error() string {
+	return string(err)
+}
+
+//Begin returns a new transaction on the store
+func Begin(s Store) api.Transaction {
+	return &transaction{
+		s:       s,
+		written: make(map[string]operation),
+	}
+}
+
+// CopyDocument returns a copy of the document sharing no value with it, as it is read after being encoded in JSON
+func CopyDocument(d api.Document) (api.Document, error) {
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "encoding failed")
+	}
+	var res api.Document
+	if err := json.Unmarshal(b, &res); err != nil {
+		return api.Document{}, errors.Wrap(err, "decoding failed")
+	}
+	return res, nil
+}
+
+// operation is a write of a transaction, applied when committing
+type operation struct {
+	changeType api.ChangeType
+	target     api.ObjectRef
+	// document is the written document as seen by the transaction, nil if it is deleted
+	document *api.Document
+	// patch is applied again to the committed document, so that its operators are evaluated atomically
+	patch api.DocumentProperties
+	// revision is the revision required for the write, -1 if none is
+	revision int64
+	// check is set when the operation only checks the revision, without writing the document
+	check bool
+}
+
+type transaction struct {
+	s          Store
+	operations []operation
+	// written contains the last write of the transaction on each document
+	written map[string]operation
+	closed  bool
+}
+
+type cursor struct {
+	documents []api.Document
+}
+
+func (c *cursor) Fetch(count int) ([]api.Document, error) {
+	if count > len(c.documents) {
+		count = len(c.documents)
+	}
+	res := c.documents[:count]
+	c.documents = c.documents[count:]
+	return res, nil
+}
+
+func (c *cursor) Close() error {
+	c.documents = nil
+	return nil
+}
+
+// current returns a copy of the document as seen by the transaction, nil if it does not exist
+func (tx *transaction) current(d api.ObjectRef) (*api.Document, error) {
+
+	if tx.closed {
+		return nil, errors.New("transaction already closed")
+	}
+
+	var doc *api.Document
+	if op, found := tx.written[d.String()]; found {
+		doc = op.document
+	} else {
+		var err error
+		if doc, err = tx.s.Get(d); err != nil {
+			return nil, err
+		}
+	}
+	if doc == nil {
+		return nil, nil
+	}
+
+	res, err := CopyDocument(*doc)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (tx *transaction) Get(d api.ObjectRef) (api.Document, error) {
+
+	doc, err := tx.current(d)
+	if err != nil {
+		return api.Document{}, err
+	}
+	if doc == nil {
+		return api.Document{}, notFound("document not found")
+	}
+	return *doc, nil
+}
+
+// documents returns a copy of the documents of the collection as seen by the transaction
+func (tx *transaction) documents(c api.ObjectRef) ([]api.Document, error) {
+
+	if tx.closed {
+		return nil, errors.New("transaction already closed")
+	}
+
+	committed, err := tx.s.Documents(c)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make(map[string]api.Document, len(committed))
+	for _, doc := range committed {
+		docs[doc.ID] = doc
+	}
+
+	for _, op := range tx.written {
+		if op.target.Collection().String() != c.String() {
+			continue
+		}
+		if op.document == nil {
+			delete(docs, op.target.ID())
+		} else {
+			docs[op.target.ID()] = *op.document
+		}
+	}
+
+	res := make([]api.Document, 0, len(docs))
+	for _, doc := range docs {
+		doc, err := CopyDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, doc)
+	}
+	return res, nil
+}
+
+func (tx *transaction) GetAll(c api.ObjectRef, query api.Query) (api.Cursor, error) {
+
+	docs, err := tx.documents(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []api.Document
+	for _, d := range docs {
+		if query.Match(d) {
+			res = append(res, d)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return api.CompareDocuments(res[i], res[j], query.OrderBy) < 0
+	})
+
+	return &cursor{res}, nil
+}
+
+func (tx *transaction) Aggregate(c api.ObjectRef, filter api.Filter, groupBy api.FieldPath, aggregations []api.Aggregation) ([]api.AggregateResult, error) {
+
+	docs, err := tx.documents(c)
+	if err != nil {
+		return nil, err
+	}
+
+	agg := api.NewAggregator(groupBy, aggregations)
+	for _, d := range docs {
+		if filter.Match(d) {
+			agg.Add(d)
+		}
+	}
+
+	return agg.Results(), nil
+}
+
+// write records the operation, and a copy of the document as seen by the transaction afterwards
+func (tx *transaction) write(op operation) error {
+
+	if op.document != nil {
+		doc, err := CopyDocument(*op.document)
+		if err != nil {
+			return err
+		}
+		op.document = &doc
+	}
+
+	tx.operations = append(tx.operations, op)
+	tx.written[op.target.String()] = op
+	return nil
+}
+
+// checkRevision verifies that the current revision of the document is the given one, 0 meaning that it must not exist
+func checkRevision(doc *api.Document, revision int64) error {
+	if (doc == nil && revision != 0) || (doc != nil && doc.Revision != revision) {
+		return revisionMismatch("document revision mismatch")
+	}
+	return nil
+}
+
+func (tx *transaction) Add(c api.ObjectRef, payload api.DocumentProperties) (api.Document, error) {
+
+	if tx.closed {
+		return api.Document{}, errors.New("transaction already closed")
+	}
+
+	now := time.Now()
+	doc := api.Document{
+		ID:                   api.NextID(),
+		CreationDate:         now,
+		LastModificationDate: now,
+		Revision:             tx.s.NextRevision(),
+		Properties:           payload,
+	}
+
+	err := tx.write(operation{
+		changeType: api.Added,
+		target:     append(c[:len(c):len(c)], doc.ID),
+		document:   &doc,
+		revision:   0,
+	})
+	return doc, err
+}
+
+func (tx *transaction) put(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	current, err := tx.current(d)
+	if err != nil {
+		return err
+	}
+	if revision >= 0 {
+		if err := checkRevision(current, revision); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	doc := api.Document{
+		ID:                   d.ID(),
+		CreationDate:         now,
+		LastModificationDate: now,
+		Revision:             tx.s.NextRevision(),
+		Properties:           payload,
+	}
+	if current != nil {
+		doc.CreationDate = current.CreationDate
+	}
+
+	return tx.write(operation{
+		changeType: api.Put,
+		target:     d,
+		document:   &doc,
+		revision:   revision,
+	})
+}
+
+func (tx *transaction) Put(d api.ObjectRef, payload api.DocumentProperties) error {
+	return tx.put(d, payload, -1)
+}
+
+func (tx *transaction) PutIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	return tx.put(d, payload, revision)
+}
+
+func (tx *transaction) patch(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	current, err := tx.current(d)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		if revision >= 0 {
+			return revisionMismatch("document revision mismatch")
+		}
+		// Nothing to write
+		return nil
+	}
+	if revision >= 0 {
+		if err := checkRevision(current, revision); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	properties, err := api.ApplyPatch(current.Properties, payload, now)
+	if err != nil {
+		return err
+	}
+
+	doc := *current
+	doc.LastModificationDate = now
+	doc.Revision = tx.s.NextRevision()
+	doc.Properties = properties
+
+	return tx.write(operation{
+		changeType: api.Patched,
+		target:     d,
+		document:   &doc,
+		patch:      payload,
+		revision:   revision,
+	})
+}
+
+func (tx *transaction) Patch(d api.ObjectRef, payload api.DocumentProperties) error {
+	return tx.patch(d, payload, -1)
+}
+
+func (tx *transaction) PatchIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	return tx.patch(d, payload, revision)
+}
+
+func (tx *transaction) delete(d api.ObjectRef, revision int64) error {
+
+	current, err := tx.current(d)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		if revision >= 0 {
+			return revisionMismatch("document revision mismatch")
+		}
+		// Nothing to write
+		return nil
+	}
+	if revision >= 0 {
+		if err := checkRevision(current, revision); err != nil {
+			return err
+		}
+	}
+
+	return tx.write(operation{
+		changeType: api.Deleted,
+		target:     d,
+		revision:   revision,
+	})
+}
+
+func (tx *transaction) Delete(d api.ObjectRef) error {
+	return tx.delete(d, -1)
+}
+
+func (tx *transaction) DeleteIfRevision(d api.ObjectRef, revision int64) error {
+	return tx.delete(d, revision)
+}
+
+// CheckRevision is checked again when committing, atomically with the writes
+func (tx *transaction) CheckRevision(d api.ObjectRef, revision int64) error {
+
+	current, err := tx.current(d)
+	if err != nil {
+		return err
+	}
+	if err := checkRevision(current, revision); err != nil {
+		return err
+	}
+
+	// The check does not change the document as seen by the transaction
+	tx.operations = append(tx.operations, operation{
+		target:   d,
+		revision: revision,
+		check:    true,
+	})
+	return nil
+}
+
+func (tx *transaction) DeleteCollection(c api.ObjectRef) error {
+
+	docs, err := tx.documents(c)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if err := tx.delete(append(c[:len(c):len(c)], doc.ID), -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply performs the operation on the committed documents, and returns the resulting change
+func (op operation) apply(b Batch) (api.Change, error) {
+
+	current, err := b.Get(op.target)
+	if err != nil {
+		return api.Change{}, err
+	}
+	if op.revision >= 0 {
+		if err := checkRevision(current, op.revision); err != nil {
+			return api.Change{}, err
+		}
+	}
+
+	change := api.Change{Type: op.changeType, Target: op.target}
+
+	switch {
+	case op.check:
+		return api.Change{}, nil
+
+	case op.document == nil:
+		if current == nil {
+			// Already deleted by a concurrent transaction
+			return api.Change{}, nil
+		}
+		change.Document = *current
+		return change, b.Delete(op.target)
+
+	case op.patch != nil:
+		if current == nil {
+			// Deleted by a concurrent transaction
+			return api.Change{}, nil
+		}
+		properties, err := api.ApplyPatch(current.Properties, op.patch, op.document.LastModificationDate)
+		if err != nil {
+			return api.Change{}, err
+		}
+		change.Document, err = CopyDocument(api.Document{
+			ID:                   current.ID,
+			CreationDate:         current.CreationDate,
+			LastModificationDate: op.document.LastModificationDate,
+			Revision:             op.document.Revision,
+			Properties:           properties,
+		})
+		if err != nil {
+			return api.Change{}, err
+		}
+
+	default:
+		change.Document = *op.document
+		if current != nil {
+			if op.changeType == api.Added {
+				return api.Change{}, errors.New("document already exists")
+			}
+			change.Document.CreationDate = current.CreationDate
+		}
+	}
+
+	return change, b.Put(op.target, change.Document)
+}
+
+func (tx *transaction) Commit() error {
+
+	if tx.closed {
+		return errors.New("transaction already closed")
+	}
+	tx.closed = true
+
+	if len(tx.operations) == 0 {
+		return nil
+	}
+
+	return tx.s.Commit(func(b Batch) ([]api.Change, error) {
+
+		var changes []api.Change
+		for _, op := range tx.operations {
+			c, err := op.apply(b)
+			if err != nil {
+				return nil, err
+			}
+			if len(c.Target) > 0 {
+				changes = append(changes, c)
+			}
+		}
+		return changes, nil
+	})
+}
+
+func (tx *transaction) Rollback() error {
+	tx.closed = true
+	tx.operations = nil
+	return nil
+}
@@ -0,0 +1,10 @@
+package memory
+
+import (
+	"github.com/xdbsoft/grest/api"
+)
+
+//Subscribe returns a subscription to the changes committed on the repository
+func (r *repository) Subscribe() (api.Subscription, error) {
+	return r.broker.Subscribe()
+}
@@ -0,0 +1,128 @@
+//Package memory implements a repository keeping the documents in memory, for tests and demonstrations.
+//The repository may be used concurrently, and its documents are lost when the process stops.
+package memory
+
+import (
+	"sync"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/internal/optimistic"
+)
+
+//New returns an empty repository
+func New() api.Repository {
+	return &repository{
+		collections: make(map[string]map[string]api.Document),
+	}
+}
+
+type repository struct {
+	mu sync.RWMutex
+	// collections contains the committed documents by collection path and ID
+	collections map[string]map[string]api.Document
+	revision    int64
+	broker      optimistic.Broker
+}
+
+func (r *repository) Init() error {
+	return nil
+}
+
+func (r *repository) NextRevision() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revision++
+	return r.revision
+}
+
+func (r *repository) Begin() (api.Transaction, error) {
+	return optimistic.Begin(r), nil
+}
+
+func (r *repository) Get(d api.ObjectRef) (*api.Document, error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	doc, found := r.collections[d.Collection().String()][d.ID()]
+	if !found {
+		return nil, nil
+	}
+	return &doc, nil
+}
+
+func (r *repository) Documents(c api.ObjectRef) ([]api.Document, error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	docs := make([]api.Document, 0, len(r.collections[c.String()]))
+	for _, doc := range r.collections[c.String()] {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// batch keeps the writes in an overlay of the modified collections, until all of them are known to succeed
+type batch struct {
+	r       *repository
+	overlay map[string]map[string]api.Document
+}
+
+// collection returns the overlay of the collection, created from the committed documents
+func (b *batch) collection(c string) map[string]api.Document {
+
+	docs, found := b.overlay[c]
+	if !found {
+		docs = make(map[string]api.Document, len(b.r.collections[c]))
+		for id, doc := range b.r.collections[c] {
+			docs[id] = doc
+		}
+		b.overlay[c] = docs
+	}
+	return docs
+}
+
+func (b *batch) Get(d api.ObjectRef) (*api.Document, error) {
+	doc, found := b.collection(d.Collection().String())[d.ID()]
+	if !found {
+		return nil, nil
+	}
+	return &doc, nil
+}
+
+func (b *batch) Put(d api.ObjectRef, doc api.Document) error {
+	b.collection(d.Collection().String())[d.ID()] = doc
+	return nil
+}
+
+func (b *batch) Delete(d api.ObjectRef) error {
+	delete(b.collection(d.Collection().String()), d.ID())
+	return nil
+}
+
+//Commit applies the writes while the repository is locked, and publishes them before it is unlocked,
+//so that the subscribers receive the changes in the order of the commits
+func (r *repository) Commit(apply func(optimistic.Batch) ([]api.Change, error)) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := &batch{r: r, overlay: make(map[string]map[string]api.Document)}
+	changes, err := apply(b)
+	if err != nil {
+		return err
+	}
+
+	for c, docs := range b.overlay {
+		if len(docs) == 0 {
+			delete(r.collections, c)
+		} else {
+			r.collections[c] = docs
+		}
+	}
+
+	r.broker.Publish(changes)
+	return nil
+}
@@ -0,0 +1,371 @@
+package memory
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/repotest"
+)
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) api.Repository {
+		return New()
+	})
+}
+
+func TestGetAllOrderAndPaging(t *testing.T) {
+
+	c := api.ObjectRef{"test"}
+
+	r := New()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := tx.Put(append(c, id), api.DocumentProperties{"even": id == "b" || id == "d", "id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// Uncommitted writes are part of the results
+	if err := tx.Put(append(c, "f"), api.DocumentProperties{"even": true, "id": "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(append(c, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	orderBy := []api.Order{{Field: api.FieldPath{"properties", "even"}}, {Field: api.FieldPath{"properties", "id"}, Descending: true}}
+	cursor, err := tx.GetAll(c, api.Query{OrderBy: orderBy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for {
+		docs, err := cursor.Fetch(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for _, d := range docs {
+			ids = append(ids, d.ID)
+		}
+	}
+	if err := cursor.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"e", "c", "a", "f", "b"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Invalid order: got %v, expected %v", ids, expected)
+	}
+
+	filter := api.Filter{{Field: api.FieldPath{"properties", "even"}, Operator: api.Equal, Value: true}}
+	results, err := tx.Aggregate(c, filter, nil, []api.Aggregation{{Function: api.Count}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Values["count"] != int64(2) {
+		t.Errorf("Invalid aggregation: got %v", results)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+
+	d := api.ObjectRef{"test_revisions", "doc1"}
+
+	r := New()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.PatchIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err == nil {
+		t.Error("Patching a missing document should fail")
+	}
+	if err := tx.PutIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.PutIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err == nil {
+		t.Error("Creating an existing document should fail")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx1, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := tx1.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Revision == 0 {
+		t.Error("Missing revision")
+	}
+
+	if err := tx1.PatchIfRevision(d, api.DocumentProperties{"k": "v1"}, created.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.PatchIfRevision(d, api.DocumentProperties{"k": "v2"}, created.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncommitted writes are not visible to the other transactions
+	res, err := tx2.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Properties["k"] != "v2" {
+		t.Errorf("Invalid field 'k': got '%v', expected 'v2'", res.Properties["k"])
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Commit()
+	if e, ok := err.(interface{ IsPreconditionFailed() bool }); !ok || !e.IsPreconditionFailed() {
+		t.Errorf("Concurrent write should fail, got %v", err)
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	patched, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Properties["k"] != "v1" {
+		t.Errorf("Invalid field 'k': got '%v', expected 'v1'", patched.Properties["k"])
+	}
+	if patched.Revision <= created.Revision {
+		t.Errorf("Revision should increase, got %d after %d", patched.Revision, created.Revision)
+	}
+	if err := tx.DeleteIfRevision(d, created.Revision); err == nil {
+		t.Error("Deleting with a wrong revision should fail")
+	}
+	if err := tx.DeleteIfRevision(d, patched.Revision); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentPatches(t *testing.T) {
+
+	d := api.ObjectRef{"test", "counter"}
+
+	r := New()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx1, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []api.Transaction{tx1, tx2} {
+		if err := tx.Patch(d, api.DocumentProperties{"n": map[string]interface{}{"$inc": 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Operators are applied again to the committed document
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Properties["n"] != 3.0 {
+		t.Errorf("Invalid field 'n': got '%v', expected 3", res.Properties["n"])
+	}
+}
+
+func TestRollback(t *testing.T) {
+
+	d := api.ObjectRef{"test", "doc1"}
+
+	r := New()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("Committing a rolled back transaction should fail")
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Get(d); err == nil {
+		t.Error("Rolled back document should not be found")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+
+	d := api.ObjectRef{"test", "doc1"}
+
+	r := New()
+
+	s, err := r.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(d); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-s.Changes():
+		t.Fatalf("Change notified before commit: %v", c)
+	default:
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []api.ChangeType{api.Put, api.Deleted} {
+		select {
+		case c := <-s.Changes():
+			if c.Type != expected || c.Target.String() != d.String() {
+				t.Errorf("Invalid change: got %s %s, expected %s %s", c.Type, c.Target, expected, d)
+			}
+			if c.Document.Properties["k"] != "v" {
+				t.Errorf("Invalid document: %v", c.Document)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Change not notified")
+		}
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+
+	d := api.ObjectRef{"test", "counter"}
+
+	r := New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tx, err := r.Begin()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tx.Rollback()
+
+			if err := tx.Put(api.ObjectRef{"test", api.NextID()}, api.DocumentProperties{}); err != nil {
+				t.Error(err)
+			}
+			if _, err := tx.Get(d); err == nil {
+				err = tx.Patch(d, api.DocumentProperties{"n": map[string]interface{}{"$inc": 1}})
+			} else {
+				err = tx.PutIfRevision(d, api.DocumentProperties{"n": 1}, 0)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			if err := tx.Commit(); err != nil {
+				// Only the concurrent creations of the counter may fail
+				if e, ok := err.(interface{ IsPreconditionFailed() bool }); !ok || !e.IsPreconditionFailed() {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	counter, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := tx.Aggregate(d.Collection(), nil, nil, []api.Aggregation{{Function: api.Count}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := results[0].Values["count"].(int64); counter.Properties["n"] != float64(n-1) {
+		t.Errorf("Invalid counter: got %v after %d committed transactions", counter.Properties["n"], n-1)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xdbsoft/grest/api"
@@ -13,7 +14,11 @@ import (
 type mockedAuthenticator struct{}
 
 func (a mockedAuthenticator) Authenticate(r *http.Request) (api.User, error) {
-	formBearer := r.FormValue("auth")
+	// As the OIDC authenticator, the token is read from the Authorization header, or from the auth form parameter
+	formBearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(formBearer) == 0 {
+		formBearer = r.FormValue("auth")
+	}
 	if len(formBearer) == 0 {
 		return api.User{}, nil
 	}
@@ -42,13 +47,45 @@ func (err notFound) Error() string {
 type mockedDataRepository struct {
 	Data map[string]map[string]api.Document
 	Now  time.Time
+
+	mu            sync.Mutex
+	subscriptions []*mockedSubscription
+	revision      int64
+	history       map[string][]api.Version
+	trash         map[string]api.TrashedDocument
+
+	// RollbackErr is returned by the rollbacks of the transactions
+	RollbackErr error
 }
 
 type mockedTransaction struct {
-	Data map[string]map[string]api.Document
-	Now  time.Time
-	r    *mockedDataRepository
+	Data    map[string]map[string]api.Document
+	Now     time.Time
+	r       *mockedDataRepository
+	changes []api.Change
+	written map[string]api.ObjectRef
+}
+
+type revisionMismatch string
+
+func (err revisionMismatch) IsPreconditionFailed() bool {
+	return true
+}
+func (err revisionMismatch) Error() string {
+	return string(err)
+}
+
+type mockedSubscription struct {
+	changes chan api.Change
+}
+
+func (s *mockedSubscription) Changes() <-chan api.Change {
+	return s.changes
 }
+func (s *mockedSubscription) Close() error {
+	return nil
+}
+
 type mockedCursor struct {
 	data []api.Document
 	idx  int
@@ -73,25 +110,203 @@ func (r *mockedDataRepository) Init() error {
 	return nil
 }
 func (r *mockedDataRepository) Begin() (api.Transaction, error) {
+
+	// The transaction works on a copy of the collections, so that its writes are discarded on rollback
+	data := make(map[string]map[string]api.Document, len(r.Data))
+	for c, col := range r.Data {
+		data[c] = make(map[string]api.Document, len(col))
+		for id, d := range col {
+			data[c][id] = d
+		}
+	}
+
 	return &mockedTransaction{
-		Data: r.Data,
-		Now:  r.Now,
-		r:    r,
+		Data:    data,
+		Now:     r.Now,
+		r:       r,
+		written: make(map[string]api.ObjectRef),
 	}, nil
 }
 
+func (r *mockedDataRepository) Subscribe() (api.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &mockedSubscription{changes: make(chan api.Change, 100)}
+	r.subscriptions = append(r.subscriptions, s)
+	return s, nil
+}
+
+func (r *mockedTransaction) nextRevision() int64 {
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+	r.r.revision++
+	return r.r.revision
+}
+
+func (r *mockedTransaction) archive(document api.ObjectRef, d api.Document, deleted bool) {
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+
+	if r.r.history == nil {
+		r.r.history = make(map[string][]api.Version)
+	}
+	if deleted {
+		d.LastModificationDate = r.Now
+	}
+	// Properties are copied, as they may be modified in place by later patches
+	properties := make(map[string]interface{}, len(d.Properties))
+	for k, v := range d.Properties {
+		properties[k] = v
+	}
+	d.Properties = properties
+
+	r.r.history[document.String()] = append(r.r.history[document.String()], api.Version{Document: d, Deleted: deleted})
+}
+
+func (r *mockedTransaction) History(document api.ObjectRef) ([]api.Version, error) {
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+
+	versions := r.r.history[document.String()]
+	if len(versions) == 0 {
+		return nil, notFound("document not found")
+	}
+
+	res := make([]api.Version, len(versions))
+	for i, v := range versions {
+		res[len(versions)-1-i] = v
+	}
+	return res, nil
+}
+
+func (r *mockedTransaction) GetAsOf(document api.ObjectRef, t time.Time) (api.Document, error) {
+	versions, err := r.History(document)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	for _, v := range versions {
+		if !v.LastModificationDate.After(t) {
+			if v.Deleted {
+				break
+			}
+			return v.Document, nil
+		}
+	}
+	return api.Document{}, notFound("document not found")
+}
+
+func (r *mockedTransaction) trashDocument(document api.ObjectRef, d api.Document) {
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+
+	if r.r.trash == nil {
+		r.r.trash = make(map[string]api.TrashedDocument)
+	}
+	r.r.trash[document.String()] = api.TrashedDocument{Document: d, DeletionDate: r.Now}
+}
+
+func (r *mockedTransaction) GetTrash(collection api.ObjectRef) ([]api.TrashedDocument, error) {
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+
+	var res []api.TrashedDocument
+	for ref, d := range r.r.trash {
+		if ref == append(collection[:len(collection):len(collection)], d.ID).String() {
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].DeletionDate.Equal(res[j].DeletionDate) {
+			return res[i].DeletionDate.After(res[j].DeletionDate)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+func (r *mockedTransaction) Restore(document api.ObjectRef) (api.Document, error) {
+	r.r.mu.Lock()
+	t, found := r.r.trash[document.String()]
+	delete(r.r.trash, document.String())
+	r.r.mu.Unlock()
+
+	if !found {
+		return api.Document{}, notFound("document not found in trash")
+	}
+
+	c := document.Collection().String()
+	col, found := r.Data[c]
+	if !found {
+		col = make(map[string]api.Document)
+	}
+
+	d := t.Document
+	d.LastModificationDate = r.Now
+	d.Revision = r.nextRevision()
+	col[document.ID()] = d
+	r.Data[c] = col
+
+	r.written[document.String()] = document
+	r.archive(document, d, false)
+	r.changes = append(r.changes, api.Change{Type: api.Added, Target: document, Document: d})
+
+	return d, nil
+}
+
+func (r *mockedTransaction) checkRevision(document api.ObjectRef, revision int64) error {
+	d, err := r.Get(document)
+	if err != nil && revision != 0 {
+		return revisionMismatch("document not found")
+	}
+	if d.Revision != revision {
+		return revisionMismatch("document revision mismatch")
+	}
+	return nil
+}
+
 func (r *mockedTransaction) Commit() error {
-	r.r.Data = r.Data
+
+	// Only the documents written by the transaction are committed, as other transactions may have been committed meanwhile
+	for _, document := range r.written {
+		c := document.Collection().String()
+		d, found := r.Data[c][document.ID()]
+		if !found {
+			delete(r.r.Data[c], document.ID())
+			continue
+		}
+		if r.r.Data[c] == nil {
+			r.r.Data[c] = make(map[string]api.Document)
+		}
+		r.r.Data[c][document.ID()] = d
+	}
+
+	r.r.mu.Lock()
+	defer r.r.mu.Unlock()
+	for _, c := range r.changes {
+		for _, s := range r.r.subscriptions {
+			s.changes <- c
+		}
+	}
+	r.changes = nil
+
 	return nil
 }
 func (r *mockedTransaction) Rollback() error {
-	return nil
+	return r.r.RollbackErr
 }
 
 func (r *mockedTransaction) Get(document api.ObjectRef) (api.Document, error) {
 
+	// Documents that were not written by the transaction are read as committed
+	data := r.Data
+	if _, found := r.written[document.String()]; !found {
+		data = r.r.Data
+	}
+
 	c := document.Collection().String()
-	col, found := r.Data[c]
+	col, found := data[c]
 
 	if !found {
 		return api.Document{}, notFound("document not found")
@@ -106,32 +321,7 @@ func (r *mockedTransaction) Get(document api.ObjectRef) (api.Document, error) {
 	return doc, nil
 }
 
-type SortDocuments struct {
-	docs    []api.Document
-	orderBy string
-}
-
-func (a SortDocuments) Len() int {
-	return len(a.docs)
-}
-func (a SortDocuments) Less(i, j int) bool {
-
-	if a.orderBy == "" || a.orderBy == "$id" {
-		return a.docs[i].ID < a.docs[j].ID
-	}
-
-	switch vi := a.docs[i].Properties[a.orderBy].(type) {
-	case string:
-		vj := a.docs[j].Properties[a.orderBy].(string)
-		return vi < vj
-	}
-	panic("unsupported type for sort")
-}
-func (a SortDocuments) Swap(i, j int) {
-	a.docs[i], a.docs[j] = a.docs[j], a.docs[i]
-}
-
-func (r *mockedTransaction) GetAll(c api.ObjectRef, orderBy []string) (api.Cursor, error) {
+func (r *mockedTransaction) GetAll(c api.ObjectRef, query api.Query) (api.Cursor, error) {
 
 	col, found := r.Data[c.String()]
 
@@ -141,19 +331,30 @@ func (r *mockedTransaction) GetAll(c api.ObjectRef, orderBy []string) (api.Curso
 
 	var res []api.Document
 	for _, d := range col {
-		res = append(res, d)
-	}
-
-	orderByItem := ""
-	if len(orderBy) > 0 {
-		orderByItem = orderBy[0]
+		if query.Match(d) {
+			res = append(res, d)
+		}
 	}
 
-	sort.Sort(SortDocuments{res, orderByItem})
+	sort.Slice(res, func(i, j int) bool {
+		return api.CompareDocuments(res[i], res[j], query.OrderBy) < 0
+	})
 
 	return &mockedCursor{res, 0}, nil
 }
 
+func (r *mockedTransaction) Aggregate(c api.ObjectRef, filter api.Filter, groupBy api.FieldPath, aggregations []api.Aggregation) ([]api.AggregateResult, error) {
+
+	agg := api.NewAggregator(groupBy, aggregations)
+	for _, d := range r.Data[c.String()] {
+		if filter.Match(d) {
+			agg.Add(d)
+		}
+	}
+
+	return agg.Results(), nil
+}
+
 func (r *mockedTransaction) Add(c api.ObjectRef, payload api.DocumentProperties) (api.Document, error) {
 
 	col, found := r.Data[c.String()]
@@ -169,11 +370,17 @@ func (r *mockedTransaction) Add(c api.ObjectRef, payload api.DocumentProperties)
 		ID:                   id,
 		CreationDate:         now,
 		LastModificationDate: now,
+		Revision:             r.nextRevision(),
 		Properties:           payload,
 	}
 
 	r.Data[c.String()] = col
 
+	ref := append(c[:len(c):len(c)], id)
+	r.written[ref.String()] = ref
+	r.archive(ref, col[id], false)
+	r.changes = append(r.changes, api.Change{Type: api.Added, Target: ref, Document: col[id]})
+
 	return col[id], nil
 }
 
@@ -187,38 +394,53 @@ func (r *mockedTransaction) Put(document api.ObjectRef, payload api.DocumentProp
 	}
 
 	now := r.Now
+	created := now
+	if existing, found := col[document.ID()]; found {
+		created = existing.CreationDate
+	}
 	col[document.ID()] = api.Document{
 		ID:                   document.ID(),
-		CreationDate:         now,
+		CreationDate:         created,
 		LastModificationDate: now,
+		Revision:             r.nextRevision(),
 		Properties:           payload,
 	}
 
 	r.Data[c] = col
 
+	r.written[document.String()] = document
+	r.archive(document, col[document.ID()], false)
+	r.changes = append(r.changes, api.Change{Type: api.Put, Target: document, Document: col[document.ID()]})
+
 	return nil
 }
 func (r *mockedTransaction) Patch(document api.ObjectRef, payload api.DocumentProperties) error {
 
 	c := document.Collection().String()
-	col, found := r.Data[c]
+	col := r.Data[c]
 
-	if !found {
-		col = make(map[string]api.Document)
+	d, exists := col[document.ID()]
+	if !exists {
+		return nil
 	}
 
-	d := col[document.ID()]
-
 	now := r.Now
 	d.LastModificationDate = now
+	d.Revision = r.nextRevision()
 
-	for k, v := range payload {
-		d.Properties[k] = v
+	properties, err := api.ApplyPatch(d.Properties, payload, now)
+	if err != nil {
+		return err
 	}
+	d.Properties = properties
 
 	col[document.ID()] = d
 	r.Data[c] = col
 
+	r.written[document.String()] = document
+	r.archive(document, d, false)
+	r.changes = append(r.changes, api.Change{Type: api.Patched, Target: document, Document: d})
+
 	return nil
 }
 func (r *mockedTransaction) Delete(document api.ObjectRef) error {
@@ -226,17 +448,78 @@ func (r *mockedTransaction) Delete(document api.ObjectRef) error {
 	c := document.Collection().String()
 	col, found := r.Data[c]
 
-	if found {
+	if d, exists := col[document.ID()]; found && exists {
 		delete(col, document.ID())
+		r.written[document.String()] = document
+		r.archive(document, d, true)
+		r.trashDocument(document, d)
+		r.changes = append(r.changes, api.Change{Type: api.Deleted, Target: document, Document: d})
 	}
 
 	r.Data[c] = col
 
 	return nil
 }
+func (r *mockedTransaction) PutIfRevision(document api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	if err := r.checkRevision(document, revision); err != nil {
+		return err
+	}
+	return r.Put(document, payload)
+}
+func (r *mockedTransaction) PatchIfRevision(document api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	if err := r.checkRevision(document, revision); err != nil {
+		return err
+	}
+	return r.Patch(document, payload)
+}
+func (r *mockedTransaction) DeleteIfRevision(document api.ObjectRef, revision int64) error {
+	if err := r.checkRevision(document, revision); err != nil {
+		return err
+	}
+	return r.Delete(document)
+}
+func (r *mockedTransaction) CheckRevision(document api.ObjectRef, revision int64) error {
+	return r.checkRevision(document, revision)
+}
 func (r *mockedTransaction) DeleteCollection(collection api.ObjectRef) error {
 
+	for _, d := range r.Data[collection.String()] {
+		ref := append(collection[:len(collection):len(collection)], d.ID)
+		r.written[ref.String()] = ref
+		r.archive(ref, d, true)
+		r.trashDocument(ref, d)
+		r.changes = append(r.changes, api.Change{Type: api.Deleted, Target: ref, Document: d})
+	}
 	delete(r.Data, collection.String())
 
 	return nil
 }
+
+// interleavedRepository performs a write, as another client would, right after the first document read in a transaction
+type interleavedRepository struct {
+	api.Repository
+	once  sync.Once
+	write func(api.Repository) error
+}
+
+type interleavedTransaction struct {
+	api.Transaction
+	r *interleavedRepository
+}
+
+func (r *interleavedRepository) Begin() (api.Transaction, error) {
+	tx, err := r.Repository.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return interleavedTransaction{tx, r}, nil
+}
+func (t interleavedTransaction) Get(document api.ObjectRef) (api.Document, error) {
+	d, err := t.Transaction.Get(document)
+	t.r.once.Do(func() {
+		if err := t.r.write(t.r.Repository); err != nil {
+			panic(err)
+		}
+	})
+	return d, err
+}
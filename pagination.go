@@ -0,0 +1,96 @@
+package grest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// pageToken is the content of the opaque token used to retrieve the next page of a collection.
+// It contains the sort keys of the last document returned, so that the next page starts right after it.
+type pageToken struct {
+	OrderBy string       `json:"o"`
+	After   api.Document `json:"a"`
+}
+
+func orderByString(orderBy []api.Order) string {
+	items := make([]string, len(orderBy))
+	for i := range orderBy {
+		items[i] = orderBy[i].String()
+	}
+	return strings.Join(items, ",")
+}
+
+func setPropertyValue(properties map[string]interface{}, path []string, v interface{}) {
+	for _, k := range path[:len(path)-1] {
+		child, ok := properties[k].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			properties[k] = child
+		}
+		properties = child
+	}
+	properties[path[len(path)-1]] = v
+}
+
+func encodePageToken(d api.Document, orderBy []api.Order) (string, error) {
+
+	after := api.Document{
+		ID:                   d.ID,
+		CreationDate:         d.CreationDate,
+		LastModificationDate: d.LastModificationDate,
+		Properties:           make(map[string]interface{}),
+	}
+	for _, o := range orderBy {
+		if o.Field.IsProperty() {
+			setPropertyValue(after.Properties, o.Field[1:], o.Field.Value(d))
+		}
+	}
+
+	b, err := json.Marshal(pageToken{
+		OrderBy: orderByString(orderBy),
+		After:   after,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getStartAfter(pageTokenString string, orderBy []api.Order) (*api.Document, error) {
+
+	if len(pageTokenString) == 0 {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(pageTokenString)
+	if err != nil {
+		return nil, badRequest("Invalid pageToken")
+	}
+
+	var token pageToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return nil, badRequest("Invalid pageToken")
+	}
+
+	if token.OrderBy != orderByString(orderBy) {
+		return nil, badRequest("Invalid pageToken: orderBy does not match")
+	}
+
+	return &token.After, nil
+}
+
+// nextPageLink returns the value of the Link header pointing to the next page of the collection
+func nextPageLink(r *http.Request, nextPageToken string) string {
+
+	u := *r.URL
+	q := u.Query()
+	q.Set("pageToken", nextPageToken)
+	u.RawQuery = q.Encode()
+
+	return "<" + u.RequestURI() + `>; rel="next"`
+}
@@ -0,0 +1,59 @@
+package grest
+
+import (
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// Content types of the patch formats defined by RFC 7396 and RFC 6902
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// patch is the body of a PATCH request.
+// By default, properties are merged recursively and may use operators (see api.ApplyPatch),
+// unless the body is a JSON Merge Patch or a JSON Patch, according to its content type.
+type patch struct {
+	contentType string
+	properties  api.DocumentProperties
+	operations  []api.JSONPatchOperation
+}
+
+func getPatch(r *http.Request, p *patch) error {
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch contentType {
+	case jsonPatchContentType:
+		p.contentType = contentType
+		p.operations = []api.JSONPatchOperation{}
+		return getPayload(r, &p.operations)
+	case mergePatchContentType:
+		p.contentType = contentType
+	}
+
+	p.properties = make(api.DocumentProperties)
+	return getPayload(r, &p.properties)
+}
+
+// apply returns the properties resulting from the patch
+func (p patch) apply(properties api.DocumentProperties, now time.Time) (api.DocumentProperties, error) {
+
+	switch p.contentType {
+	case jsonPatchContentType:
+		return api.ApplyJSONPatch(properties, p.operations)
+	case mergePatchContentType:
+		return api.MergePatch(properties, p.properties), nil
+	}
+	return api.ApplyPatch(properties, p.properties, now)
+}
+
+// isAtomic returns whether the patch can be applied by the datastore itself, from the current state of the document.
+// Other patches are applied to the document as it was read, which must not have been modified when it is written.
+func (p patch) isAtomic() bool {
+	return len(p.contentType) == 0
+}
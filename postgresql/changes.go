@@ -0,0 +1,168 @@
+package postgresql
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// changesChannel is the channel on which the changes are notified, so that all the instances sharing the database receive them.
+// It is qualified by the schema and prefix of the repository, as the tables are.
+const changesChannel = "grest_changes"
+
+// maxNotificationSize is the maximum size of a notification payload, slightly below the PostgreSQL limit of 8000 bytes
+const maxNotificationSize = 7900
+
+// subscriptionBufferSize is the number of changes a subscriber may lag behind before its subscription is closed
+const subscriptionBufferSize = 100
+
+// notification is the payload of the notifications.
+// When the change is too large, the properties of the document are removed and have to be retrieved by the listeners.
+type notification struct {
+	api.Change
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// notify sends a notification of the change, delivered to the listeners when the transaction is committed
+func (tx *transaction) notify(changeType api.ChangeType, target api.ObjectRef, d api.Document) error {
+
+	n := notification{
+		Change: api.Change{
+			Type:     changeType,
+			Target:   target,
+			Document: d,
+		},
+	}
+
+	b, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode notification")
+	}
+
+	if len(b) > maxNotificationSize {
+		n.Document.Properties = nil
+		n.Truncated = true
+		b, err = json.Marshal(n)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode notification")
+		}
+	}
+
+	if _, err := tx.tx.Exec("SELECT pg_notify($1,$2)", tx.channel, string(b)); err != nil {
+		return errors.Wrap(err, "unable to notify change")
+	}
+
+	return nil
+}
+
+type subscription struct {
+	r       *repository
+	changes chan api.Change
+}
+
+func (s *subscription) Changes() <-chan api.Change {
+	return s.changes
+}
+
+func (s *subscription) Close() error {
+
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	if _, found := s.r.subscriptions[s]; found {
+		delete(s.r.subscriptions, s)
+		close(s.changes)
+	}
+
+	return nil
+}
+
+func (r *repository) Subscribe() (api.Subscription, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener == nil {
+
+		l := pq.NewListener(r.cfg.ConnStr, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Println("Listener error: ", err)
+			}
+		})
+
+		if err := l.Listen(r.channel); err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "unable to listen to changes")
+		}
+
+		r.listener = l
+		go r.dispatch(l)
+	}
+
+	s := &subscription{
+		r:       r,
+		changes: make(chan api.Change, subscriptionBufferSize),
+	}
+	r.subscriptions[s] = struct{}{}
+
+	return s, nil
+}
+
+// dispatch decodes the notifications received by the listener and sends them to the subscribers
+func (r *repository) dispatch(l *pq.Listener) {
+
+	for n := range l.Notify {
+
+		if n == nil {
+			log.Println("Connection of the listener reestablished, changes may have been missed")
+			continue
+		}
+
+		c, err := r.decodeNotification(n.Extra)
+		if err != nil {
+			log.Println("Error: ", err)
+			continue
+		}
+
+		r.mu.Lock()
+		for s := range r.subscriptions {
+			select {
+			case s.changes <- c:
+			default:
+				log.Println("Subscriber is too slow, closing its subscription")
+				delete(r.subscriptions, s)
+				close(s.changes)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *repository) decodeNotification(payload string) (api.Change, error) {
+
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return api.Change{}, errors.Wrap(err, "unable to decode notification")
+	}
+
+	if n.Truncated && n.Type != api.Deleted {
+
+		tx, err := r.Begin()
+		if err != nil {
+			return api.Change{}, err
+		}
+		defer tx.Rollback()
+
+		n.Document, err = tx.Get(n.Target)
+		if err != nil {
+			return api.Change{}, errors.Wrap(err, "unable to retrieve notified document")
+		}
+	}
+
+	return n.Change, nil
+}
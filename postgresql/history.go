@@ -0,0 +1,92 @@
+package postgresql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// archive appends the written version of the document to its history
+func (tx *transaction) archive(d api.ObjectRef, doc api.Document, deleted bool) error {
+
+	b, err := json.Marshal(doc.Properties)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode history")
+	}
+
+	// The version of a deleted document is dated of the deletion
+	updated := "$4"
+	if deleted {
+		updated = "CURRENT_TIMESTAMP"
+	}
+
+	if _, err := tx.exec("INSERT INTO {history} (collection, id, created, updated, revision, content, deleted) VALUES ($1,$2,$3,"+updated+",$5,$6,$7)",
+		d.Collection().String(), d.ID(), doc.CreationDate, doc.LastModificationDate, doc.Revision, &b, deleted); err != nil {
+		return errors.Wrap(err, "unable to archive document")
+	}
+
+	return nil
+}
+
+func (tx *transaction) History(d api.ObjectRef) ([]api.Version, error) {
+
+	rows, err := tx.query("SELECT created, updated, revision, content, deleted FROM {history} WHERE collection=$1 AND id=$2 ORDER BY version DESC", d.Collection().String(), d.ID())
+	if err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+	defer rows.Close()
+
+	var versions []api.Version
+	for rows.Next() {
+		v := api.Version{
+			Document: api.Document{
+				ID: d.ID(),
+			},
+		}
+		var b []byte
+		if err := rows.Scan(&v.CreationDate, &v.LastModificationDate, &v.Revision, &b, &v.Deleted); err != nil {
+			return nil, errors.Wrap(err, "DB retrieval failed")
+		}
+		if err := json.Unmarshal(b, &v.Properties); err != nil {
+			return nil, errors.Wrap(err, "DB decoding failed")
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "DB retrieval failed")
+	}
+
+	if len(versions) == 0 {
+		return nil, notFound("document not found")
+	}
+
+	return versions, nil
+}
+
+func (tx *transaction) GetAsOf(d api.ObjectRef, t time.Time) (api.Document, error) {
+
+	row := tx.queryRow("SELECT content, created, updated, revision, deleted FROM {history} WHERE collection=$1 AND id=$2 AND updated<=$3 ORDER BY version DESC LIMIT 1", d.Collection().String(), d.ID(), t)
+
+	var b []byte
+	var deleted bool
+	doc := api.Document{
+		ID: d.ID(),
+	}
+	err := row.Scan(&b, &doc.CreationDate, &doc.LastModificationDate, &doc.Revision, &deleted)
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		return api.Document{}, notFound("document not found")
+	}
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "DB retrieval failed")
+	}
+
+	if err := json.Unmarshal(b, &doc.Properties); err != nil {
+		return api.Document{}, errors.Wrap(err, "DB decoding failed")
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,221 @@
+package postgresql
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+//Index declares a secondary index on a property of the documents of the collections matching a path pattern,
+//such as "tasks" or "users/{userId}/tasks"
+type Index struct {
+	Collection string
+	// Field is the path of the property, such as "properties.dueDate"
+	Field string
+	// Type is "btree", the default and only supported type, to filter and sort the documents by the property
+	Type string
+}
+
+// propertyIndexPrefix starts the names of the indexes created from the configuration, after the table prefix.
+// The other indexes of the documents table are neither modified nor dropped.
+const propertyIndexPrefix = "i_property_"
+
+// propertyIndex is the definition of an index, shared by the declarations resulting in the same index
+type propertyIndex struct {
+	name         string
+	definition   string
+	declarations []string
+}
+
+// indexDefinition returns the definition of the index, made of the same expression as the queries so that they use it
+func indexDefinition(i Index) (string, error) {
+
+	f, err := api.ParseFieldPath(i.Field)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid index on '%s'", i.Collection)
+	}
+	if !f.IsProperty() {
+		return "", errors.Errorf("invalid index on '%s': '%s' is not a property", i.Collection, i.Field)
+	}
+
+	switch strings.ToLower(i.Type) {
+	case "", "btree":
+	default:
+		return "", errors.Errorf("invalid index on '%s': unknown type '%s'", i.Collection, i.Type)
+	}
+	valueKey, textKey := propertyKeys(f)
+	definition := "USING btree (collection, " + valueKey + ", (" + textKey + "))"
+
+	// The index is partial when the pattern designates a single collection.
+	// Patterns with variables cannot be expressed as a predicate that the planner would match with the queries.
+	pattern := strings.Split(i.Collection, "/")
+	if len(pattern)%2 == 0 {
+		return "", errors.Errorf("invalid index on '%s': not a collection", i.Collection)
+	}
+	for _, item := range pattern {
+		if len(item) == 0 {
+			return "", errors.Errorf("invalid index on '%s': empty item", i.Collection)
+		}
+		if item[0] == '{' && item[len(item)-1] == '}' {
+			return definition, nil
+		}
+	}
+	return definition + " WHERE collection = " + quoteLiteral(i.Collection), nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// pathLiteral returns the path of a property as a text array literal.
+// The items are quoted and escaped as in the array literals of PostgreSQL, and the character following a brace is escaped as well,
+// so that the literal never contains the placeholders of the names of the database objects, replaced in the queries.
+func pathLiteral(f api.FieldPath) string {
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, item := range f[1:] {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(`"`)
+		escape := false
+		for _, c := range item {
+			if escape || c == '"' || c == '\\' {
+				b.WriteString(`\`)
+			}
+			b.WriteRune(c)
+			escape = c == '{'
+		}
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+
+	return quoteLiteral(b.String()) + "::text[]"
+}
+
+// propertyIndexes returns the indexes of the configuration, sorted by name.
+// Their names are derived from their definitions, so that an index is created again when its definition changes.
+func propertyIndexes(indexes []Index) ([]propertyIndex, error) {
+
+	byName := make(map[string]*propertyIndex)
+	for _, i := range indexes {
+
+		definition, err := indexDefinition(i)
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha1.Sum([]byte(definition))
+		name := propertyIndexPrefix + hex.EncodeToString(h[:8])
+
+		p, found := byName[name]
+		if !found {
+			p = &propertyIndex{name: name, definition: definition}
+			byName[name] = p
+		}
+		p.declarations = append(p.declarations, i.Collection+" "+i.Field)
+	}
+
+	res := make([]propertyIndex, 0, len(byName))
+	for _, p := range byName {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res, nil
+}
+
+// syncIndexes creates the declared indexes of the documents table, and drops those which are no longer declared.
+// The differences with the database are reported to w; with dryRun, the statements are only written to w.
+// The indexes are built concurrently, outside of a transaction, so that the documents remain writable meanwhile.
+func (r *repository) syncIndexes(w io.Writer, dryRun bool) error {
+
+	existing := make(map[string]bool)
+	rows, err := r.db.Query(r.names.Replace("SELECT c.relname, i.indisvalid FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid WHERE i.indrelid = to_regclass('{document}')"))
+	if err != nil {
+		return errors.Wrap(err, "unable to list the indexes of the documents")
+	}
+	for rows.Next() {
+		var name string
+		var valid bool
+		if err := rows.Scan(&name, &valid); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "unable to list the indexes of the documents")
+		}
+		if strings.HasPrefix(name, r.cfg.TablePrefix+propertyIndexPrefix) {
+			existing[name] = valid
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "unable to list the indexes of the documents")
+	}
+
+	// inSchema returns the name of an index, which already starts with the table prefix, in the schema of the repository
+	inSchema := func(name string) string {
+		if r.cfg.Schema == "" {
+			return name
+		}
+		return r.cfg.Schema + "." + name
+	}
+
+	// change reports a difference, and applies the statements resolving it
+	change := func(report string, statements ...string) error {
+		if dryRun {
+			fmt.Fprintf(w, "-- %s\n", report)
+			for _, statement := range statements {
+				fmt.Fprintf(w, "%s;\n", statement)
+			}
+			return nil
+		}
+		fmt.Fprintln(w, report)
+		for _, statement := range statements {
+			if _, err := r.db.Exec(statement); err != nil {
+				return errors.Wrap(err, "unable to update the indexes of the documents")
+			}
+		}
+		return nil
+	}
+
+	for _, p := range r.indexes {
+
+		name := r.cfg.TablePrefix + p.name
+		valid, found := existing[name]
+		delete(existing, name)
+
+		create := "CREATE INDEX CONCURRENTLY IF NOT EXISTS " + name + " ON " + r.names.Replace("{document}") + " " + p.definition
+		switch {
+		case found && valid:
+			continue
+		case found:
+			// A concurrent build was interrupted
+			err = change("Index "+name+" is invalid and is built again, for "+strings.Join(p.declarations, ", "),
+				"DROP INDEX CONCURRENTLY IF EXISTS "+inSchema(name), create)
+		default:
+			err = change("Index "+name+" is missing and is created, for "+strings.Join(p.declarations, ", "), create)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var obsolete []string
+	for name := range existing {
+		obsolete = append(obsolete, name)
+	}
+	sort.Strings(obsolete)
+	for _, name := range obsolete {
+		if err := change("Index "+name+" is no longer declared and is dropped", "DROP INDEX CONCURRENTLY IF EXISTS "+inSchema(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package postgresql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// migration is a change of the database schema, applied once, in the order of the versions.
+// Its statements are idempotent, as the databases created before the migrations were versioned already contain some of them.
+// The database objects are named by placeholders, such as {document}, replaced according to the schema and prefix of the repository.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations must only be appended, never modified once released
+var migrations = []migration{
+	{1, "create the documents table", []string{
+		`CREATE TABLE IF NOT EXISTS {document} (
+			collection text NOT NULL,
+			id         character varying(126) NOT NULL,
+			created    timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated    timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			content    jsonb,
+			CONSTRAINT {prefix}t_document_pkey PRIMARY KEY (collection, id)
+		)`,
+	}},
+	// Revisions are taken from a sequence, so that they are never reused, even when a document is deleted and created again
+	{2, "add the revisions of the documents", []string{
+		"CREATE SEQUENCE IF NOT EXISTS {revision}",
+		"ALTER TABLE {document} ADD COLUMN IF NOT EXISTS revision bigint NOT NULL DEFAULT nextval('{revision}')",
+	}},
+	// Append-only history of all the versions of the documents
+	{3, "create the history table", []string{
+		`CREATE TABLE IF NOT EXISTS {history} (
+			version    bigserial NOT NULL,
+			collection text NOT NULL,
+			id         character varying(126) NOT NULL,
+			created    timestamp with time zone NOT NULL,
+			updated    timestamp with time zone NOT NULL,
+			revision   bigint NOT NULL,
+			content    jsonb,
+			deleted    boolean NOT NULL DEFAULT false,
+			CONSTRAINT {prefix}t_document_history_pkey PRIMARY KEY (version)
+		)`,
+		"CREATE INDEX IF NOT EXISTS {prefix}i_document_history_document ON {history} (collection, id, updated)",
+	}},
+	// Deleted documents that can be restored, when soft-delete is enabled
+	{4, "create the trash table", []string{
+		`CREATE TABLE IF NOT EXISTS {trash} (
+			collection text NOT NULL,
+			id         character varying(126) NOT NULL,
+			created    timestamp with time zone NOT NULL,
+			updated    timestamp with time zone NOT NULL,
+			revision   bigint NOT NULL,
+			content    jsonb,
+			deleted    timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT {prefix}t_document_trash_pkey PRIMARY KEY (collection, id)
+		)`,
+	}},
+	// Patches are applied by the database, so that their operators are evaluated atomically (see api.ApplyPatch)
+	{5, "create the grest_patch function", []string{
+		`CREATE OR REPLACE FUNCTION {patch}(content jsonb, patch jsonb, ts timestamptz) RETURNS jsonb AS $func$
+	DECLARE
+		res jsonb := content;
+		k   text;
+		v   jsonb;
+		op  text;
+		arg jsonb;
+		cur jsonb;
+		e   jsonb;
+	BEGIN
+		IF jsonb_typeof(res) IS DISTINCT FROM 'object' THEN
+			res := '{}';
+		END IF;
+		FOR k, v IN SELECT * FROM jsonb_each(patch) LOOP
+			cur := res -> k;
+			op := NULL;
+			IF jsonb_typeof(v) = 'object' AND (SELECT count(*) FROM jsonb_object_keys(v)) = 1 THEN
+				SELECT key, value INTO op, arg FROM jsonb_each(v);
+				IF op NOT IN ('$inc', '$arrayUnion', '$arrayRemove', '$serverTimestamp', '$delete') THEN
+					op := NULL;
+				END IF;
+			END IF;
+			CASE
+			WHEN op = '$inc' THEN
+				IF jsonb_typeof(cur) IS DISTINCT FROM 'number' THEN
+					cur := '0';
+				END IF;
+				res := res || jsonb_build_object(k, cur::text::numeric + arg::text::numeric);
+			WHEN op = '$arrayUnion' THEN
+				IF jsonb_typeof(cur) IS DISTINCT FROM 'array' THEN
+					cur := '[]';
+				END IF;
+				FOR e IN SELECT value FROM jsonb_array_elements(arg) LOOP
+					IF NOT EXISTS (SELECT 1 FROM jsonb_array_elements(cur) AS a(c) WHERE c = e) THEN
+						cur := cur || jsonb_build_array(e);
+					END IF;
+				END LOOP;
+				res := res || jsonb_build_object(k, cur);
+			WHEN op = '$arrayRemove' THEN
+				IF jsonb_typeof(cur) IS DISTINCT FROM 'array' THEN
+					cur := '[]';
+				END IF;
+				cur := COALESCE((SELECT jsonb_agg(c ORDER BY i) FROM jsonb_array_elements(cur) WITH ORDINALITY AS a(c, i)
+					WHERE NOT EXISTS (SELECT 1 FROM jsonb_array_elements(arg) AS b(r) WHERE r = c)), '[]');
+				res := res || jsonb_build_object(k, cur);
+			WHEN op = '$serverTimestamp' THEN
+				res := res || jsonb_build_object(k, to_char(ts AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'));
+			WHEN op = '$delete' THEN
+				res := res - k;
+			WHEN jsonb_typeof(v) = 'object' THEN
+				res := res || jsonb_build_object(k, {patch}(cur, v, ts));
+			ELSE
+				res := res || jsonb_build_object(k, v);
+			END CASE;
+		END LOOP;
+		RETURN res;
+	END
+	$func$ LANGUAGE plpgsql IMMUTABLE`,
+	}},
+	// The documents are sorted by ID byte by byte, as by the other repositories, whatever the collation of the database
+	{6, "compare the IDs of the documents byte by byte", []string{
+		`ALTER TABLE {document} ALTER COLUMN id TYPE character varying(126) COLLATE "C"`,
+		`ALTER TABLE {trash} ALTER COLUMN id TYPE character varying(126) COLLATE "C"`,
+	}},
+}
+
+// createSchemaVersion creates the table recording the applied migrations
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS {schema_version} (
+	version     integer NOT NULL,
+	description text NOT NULL,
+	applied     timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT {prefix}schema_version_pkey PRIMARY KEY (version)
+)`
+
+// schemaVersion returns the version of the last migration applied to the database, 0 if none was
+func (r *repository) schemaVersion(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int, error) {
+
+	var found sql.NullString
+	if err := q.QueryRow(r.names.Replace("SELECT to_regclass('{schema_version}')::text")).Scan(&found); err != nil {
+		return 0, errors.Wrap(err, "Select query for schema_version failed")
+	}
+	if !found.Valid {
+		return 0, nil
+	}
+
+	var version int
+	if err := q.QueryRow(r.names.Replace("SELECT COALESCE(MAX(version), 0) FROM {schema_version}")).Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "Select query for schema_version failed")
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return 0, fmt.Errorf("database schema version %d is more recent than the supported one (%d)", version, latest)
+	}
+	return version, nil
+}
+
+//Migrate applies the pending migrations of the database schema, in a single transaction, then creates and drops indexes
+//according to the configuration. The changes are reported to w; with dryRun, their SQL statements are only written to w.
+func (r *repository) Migrate(w io.Writer, dryRun bool) error {
+
+	if dryRun {
+		version, err := r.schemaVersion(r.db)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			if r.cfg.Schema != "" {
+				fmt.Fprintf(w, "CREATE SCHEMA IF NOT EXISTS %s;\n", r.cfg.Schema)
+			}
+			fmt.Fprintf(w, "%s;\n\n", r.names.Replace(createSchemaVersion))
+		}
+		for _, m := range migrations {
+			if m.version <= version {
+				continue
+			}
+			fmt.Fprintf(w, "-- Migration %d: %s\n", m.version, m.description)
+			for _, statement := range m.statements {
+				fmt.Fprintf(w, "%s;\n", r.names.Replace(statement))
+			}
+			fmt.Fprintf(w, r.names.Replace("INSERT INTO {schema_version} (version, description) VALUES (%d, '%s');\n\n"), m.version, m.description)
+		}
+		return r.syncIndexes(w, true)
+	}
+
+	if r.cfg.Schema != "" {
+		if _, err := r.db.Exec("CREATE SCHEMA IF NOT EXISTS " + r.cfg.Schema); err != nil {
+			return errors.Wrap(err, "CREATE SCHEMA failed")
+		}
+	}
+	if _, err := r.db.Exec(r.names.Replace(createSchemaVersion)); err != nil {
+		return errors.Wrap(err, "CREATE TABLE schema_version failed")
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Instances starting concurrently apply the migrations once
+	if _, err = tx.Exec(r.names.Replace("LOCK TABLE {schema_version} IN EXCLUSIVE MODE")); err != nil {
+		return errors.Wrap(err, "LOCK TABLE schema_version failed")
+	}
+
+	version, err := r.schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		for _, statement := range m.statements {
+			if _, err = tx.Exec(r.names.Replace(statement)); err != nil {
+				return errors.Wrapf(err, "migration %d (%s) failed", m.version, m.description)
+			}
+		}
+		if _, err = tx.Exec(r.names.Replace("INSERT INTO {schema_version} (version, description) VALUES ($1, $2)"), m.version, m.description); err != nil {
+			return errors.Wrap(err, "INSERT INTO schema_version failed")
+		}
+		fmt.Fprintf(w, "Migration %d applied: %s\n", m.version, m.description)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return r.syncIndexes(w, false)
+}
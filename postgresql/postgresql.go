@@ -4,34 +4,115 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
 	//we expect to depend on specific behaviour of github.com/lib/pq
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/xdbsoft/grest/api"
 )
 
+// defaultTrashRetention is the period during which deleted documents can be restored, when soft-delete is enabled without retention
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// Config contains the settings of the repository
+type Config struct {
+	ConnStr string
+	// SoftDelete keeps the deleted documents in a trash, from which they can be restored during TrashRetention
+	SoftDelete     bool
+	TrashRetention time.Duration
+	// Schema and TablePrefix allow several repositories to share a database:
+	// the tables, sequences and functions are created in Schema (the search path by default), and their names are prefixed by TablePrefix
+	Schema      string
+	TablePrefix string
+	// Indexes are created on the properties of the documents by Init, which also drops those no longer declared
+	Indexes []Index
+}
+
+// validName matches the schemas and prefixes, which are written unquoted in the SQL statements
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
 func New(connStr string) (api.Repository, error) {
+	return NewWithConfig(Config{ConnStr: connStr})
+}
 
-	db, err := sql.Open("postgres", connStr)
+func NewWithConfig(cfg Config) (api.Repository, error) {
+
+	db, err := sql.Open("postgres", cfg.ConnStr)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to connect")
 	}
 
+	if cfg.Schema != "" && !validName.MatchString(cfg.Schema) {
+		return nil, errors.New("invalid schema name: " + cfg.Schema)
+	}
+	if cfg.TablePrefix != "" && !validName.MatchString(cfg.TablePrefix) {
+		return nil, errors.New("invalid table prefix: " + cfg.TablePrefix)
+	}
+
+	indexes, err := propertyIndexes(cfg.Indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TrashRetention <= 0 {
+		cfg.TrashRetention = defaultTrashRetention
+	}
+
 	return &repository{
-		db: db,
+		db:            db,
+		cfg:           cfg,
+		names:         objectNames(cfg),
+		channel:       qualifiedName(cfg, changesChannel),
+		indexes:       indexes,
+		subscriptions: make(map[*subscription]struct{}),
 	}, nil
 }
 
+// qualifiedName returns the name of a database object of the repository, in its schema and with its prefix
+func qualifiedName(cfg Config, name string) string {
+	if cfg.Schema == "" {
+		return cfg.TablePrefix + name
+	}
+	return cfg.Schema + "." + cfg.TablePrefix + name
+}
+
+// objectNames returns the replacer of the placeholders of the SQL statements, such as {document}, by the names of the database objects.
+// {prefix} is used for the names of the constraints and indexes, which belong to the schema of their table.
+func objectNames(cfg Config) *strings.Replacer {
+	return strings.NewReplacer(
+		"{document}", qualifiedName(cfg, "t_document"),
+		"{history}", qualifiedName(cfg, "t_document_history"),
+		"{trash}", qualifiedName(cfg, "t_document_trash"),
+		"{revision}", qualifiedName(cfg, "s_document_revision"),
+		"{patch}", qualifiedName(cfg, "grest_patch"),
+		"{schema_version}", qualifiedName(cfg, "schema_version"),
+		"{prefix}", cfg.TablePrefix,
+	)
+}
+
 type repository struct {
-	db *sql.DB
+	db      *sql.DB
+	cfg     Config
+	names   *strings.Replacer
+	channel string
+	indexes []propertyIndex
+
+	mu            sync.Mutex
+	listener      *pq.Listener
+	subscriptions map[*subscription]struct{}
 }
 
 type transaction struct {
-	tx *sql.Tx
+	tx         *sql.Tx
+	softDelete bool
+	names      *strings.Replacer
+	channel    string
 }
 
 type cursor struct {
@@ -48,32 +129,27 @@ func (err notFound) Error() string {
 	return string(err)
 }
 
+type documentExists string
+
+func (err documentExists) IsConflict() bool {
+	return true
+}
+func (err documentExists) Error() string {
+	return string(err)
+}
+
+type revisionMismatch string
+
+func (err revisionMismatch) IsPreconditionFailed() bool {
+	return true
+}
+func (err revisionMismatch) Error() string {
+	return string(err)
+}
+
+//Init applies the pending migrations of the database schema, and creates the declared indexes
 func (r *repository) Init() error {
-	// Check if tables exists, if not create them
-	rows, err := r.db.Query("SELECT to_regclass('t_document')")
-	if err != nil {
-		return errors.Wrap(err, "Select query for t_document failed")
-	}
-	defer rows.Close()
-	tablesFound := false
-	for rows.Next() {
-		var found string
-		rows.Scan(&found)
-		tablesFound = len(found) > 0
-	}
-	if !tablesFound {
-		if _, err := r.db.Exec(`CREATE TABLE t_document (
-			collection text NOT NULL,
-			id         character varying(126) NOT NULL,
-			created    timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated    timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			content    jsonb,
-			CONSTRAINT t_document_pkey PRIMARY KEY (collection, id)
-		)`); err != nil {
-			return errors.Wrap(err, "CREATE TABLE t_document failed")
-		}
-	}
-	return nil
+	return r.Migrate(log.Writer(), false)
 }
 
 func (r *repository) Begin() (api.Transaction, error) {
@@ -82,7 +158,20 @@ func (r *repository) Begin() (api.Transaction, error) {
 		return nil, err
 	}
 
-	return &transaction{tx: tx}, nil
+	return &transaction{tx: tx, softDelete: r.cfg.SoftDelete, names: r.names, channel: r.channel}, nil
+}
+
+// query, queryRow and exec execute a statement whose database objects are named by placeholders, such as {document}
+func (tx *transaction) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.Query(tx.names.Replace(query), args...)
+}
+
+func (tx *transaction) queryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRow(tx.names.Replace(query), args...)
+}
+
+func (tx *transaction) exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.names.Replace(query), args...)
 }
 
 func (tx *transaction) Commit() error {
@@ -95,7 +184,7 @@ func (tx *transaction) Rollback() error {
 
 func (tx *transaction) Get(d api.ObjectRef) (api.Document, error) {
 
-	rows, err := tx.tx.Query("SELECT content, created, updated FROM t_document WHERE collection=$1 AND id=$2", d.Collection().String(), d.ID())
+	rows, err := tx.query("SELECT content, created, updated, revision FROM {document} WHERE collection=$1 AND id=$2", d.Collection().String(), d.ID())
 	if err != nil {
 		return api.Document{}, errors.Wrap(err, "Select query failed")
 	}
@@ -107,7 +196,8 @@ func (tx *transaction) Get(d api.ObjectRef) (api.Document, error) {
 
 	var s []byte
 	var created, updated time.Time
-	if err := rows.Scan(&s, &created, &updated); err != nil {
+	var revision int64
+	if err := rows.Scan(&s, &created, &updated, &revision); err != nil {
 		return api.Document{}, errors.Wrap(err, "DB retrieval failed")
 	}
 
@@ -120,38 +210,232 @@ func (tx *transaction) Get(d api.ObjectRef) (api.Document, error) {
 		ID:                   d.ID(),
 		CreationDate:         created,
 		LastModificationDate: updated,
+		Revision:             revision,
 		Properties:           content,
 	}, nil
 }
 
-func (tx *transaction) GetAll(c api.ObjectRef, orderBy []string) (api.Cursor, error) {
+var sqlOperators = map[api.Operator]string{
+	api.Equal:          "=",
+	api.NotEqual:       "<>",
+	api.Less:           "<",
+	api.LessOrEqual:    "<=",
+	api.Greater:        ">",
+	api.GreaterOrEqual: ">=",
+}
 
-	cursorName := api.NextID()
+var columns = map[string]string{
+	"id":                   "id",
+	"creationDate":         "created",
+	"lastModificationDate": "updated",
+}
 
-	orderByString := "id"
-	if len(orderBy) > 0 {
-		mappedOrderBy := make([]string, len(orderBy))
-		for i := range orderBy {
-			items := strings.Split(orderBy[i], ".")
-			if len(items) == 1 {
-				switch items[0] {
-				case "id":
-					mappedOrderBy[i] = "id"
-				case "creationDate":
-					mappedOrderBy[i] = "created"
-				case "lastModificationDate":
-					mappedOrderBy[i] = "updated"
-				default:
-					return nil, errors.New("Unknown item in order by clause: " + orderBy[i])
-				}
-			} else {
-				return nil, errors.New("Unknown item in order by clause: " + orderBy[i])
+// propertyExpression returns the jsonb expression of a document property, missing properties being JSON null.
+// The path is a constant rather than a query parameter, so that the expression matches the indexes on the property.
+func propertyExpression(f api.FieldPath) string {
+	return "COALESCE(content #> " + pathLiteral(f) + ", 'null'::jsonb)"
+}
+
+// propertyKeys returns the expressions comparing a document property as api.Compare does.
+// jsonb compares the strings with the collation of the database, which may differ from their byte order:
+// the first key is the value of the property where the strings are replaced by the empty string,
+// and the second one is the text of the strings, compared byte by byte.
+func propertyKeys(f api.FieldPath) (string, string) {
+	expr := propertyExpression(f)
+	isString := "jsonb_typeof(" + expr + ")='string'"
+	return "(CASE WHEN " + isString + ` THEN '""'::jsonb ELSE ` + expr + " END)",
+		"(CASE WHEN " + isString + " THEN " + expr + ` #>> '{}' END) COLLATE "C"`
+}
+
+func conditionClause(c api.Condition, args *[]interface{}) (string, error) {
+
+	op, found := sqlOperators[c.Operator]
+	if !found {
+		return "", errors.New("Unknown operator in where clause: " + string(c.Operator))
+	}
+
+	if c.Field.IsProperty() {
+
+		valueKey, textKey := propertyKeys(c.Field)
+
+		if str, ok := c.Value.(string); ok {
+			*args = append(*args, str)
+			isString := valueKey + `='""'::jsonb`
+			if c.Operator == api.NotEqual {
+				return fmt.Sprintf("NOT (%s AND %s=$%d)", isString, textKey, len(*args)), nil
+			}
+			return fmt.Sprintf("(%s AND %s%s$%d)", isString, textKey, op, len(*args)), nil
+		}
+
+		b, err := json.Marshal(c.Value)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to encode value of where clause")
+		}
+		*args = append(*args, string(b))
+		value := fmt.Sprintf("$%d::jsonb", len(*args))
+
+		if c.Operator == api.Equal || c.Operator == api.NotEqual {
+			return valueKey + op + value, nil
+		}
+		// Values of different types cannot be compared with range operators
+		return "(jsonb_typeof(" + valueKey + ")=jsonb_typeof(" + value + ") AND " + valueKey + op + value + ")", nil
+	}
+
+	column, found := columns[c.Field.String()]
+	if !found {
+		return "", errors.New("Unknown field in where clause: " + c.Field.String())
+	}
+
+	compatible := false
+	switch c.Value.(type) {
+	case string:
+		compatible = column == "id"
+	case time.Time:
+		compatible = column != "id"
+	}
+	if !compatible {
+		if c.Operator == api.NotEqual {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	}
+
+	*args = append(*args, c.Value)
+	return fmt.Sprintf("%s%s$%d", column, op, len(*args)), nil
+}
+
+// Kinds of sort keys: a column, or the value or the text of a property (see propertyKeys)
+const (
+	columnKey = iota
+	propertyValueKey
+	propertyTextKey
+)
+
+type sortKey struct {
+	field      api.FieldPath
+	kind       int
+	expr       string
+	descending bool
+}
+
+// sortKeys returns the expressions used to sort the documents, ending with the document ID to make the order deterministic
+func sortKeys(orderBy []api.Order, args *[]interface{}) ([]sortKey, error) {
+
+	orderBy = append(append([]api.Order{}, orderBy...), api.Order{Field: api.FieldPath{"id"}})
+
+	keys := make([]sortKey, 0, len(orderBy))
+	for _, o := range orderBy {
+
+		if o.Field.IsProperty() {
+			valueKey, textKey := propertyKeys(o.Field)
+			keys = append(keys,
+				sortKey{field: o.Field, kind: propertyValueKey, expr: valueKey, descending: o.Descending},
+				sortKey{field: o.Field, kind: propertyTextKey, expr: textKey, descending: o.Descending})
+			continue
+		}
+
+		column, found := columns[o.Field.String()]
+		if !found {
+			return nil, errors.New("Unknown item in order by clause: " + o.String())
+		}
+		keys = append(keys, sortKey{field: o.Field, kind: columnKey, expr: column, descending: o.Descending})
+	}
+
+	return keys, nil
+}
+
+func orderByClause(keys []sortKey) string {
+
+	items := make([]string, len(keys))
+	for i, k := range keys {
+		items[i] = k.expr
+		if k.descending {
+			items[i] += " DESC"
+		}
+	}
+
+	return strings.Join(items, ",")
+}
+
+// startAfterClause returns the condition selecting the documents sorted after d:
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+// The text key of a property is skipped when d has no string value, as the documents with the same value key have none either.
+func startAfterClause(keys []sortKey, d api.Document, args *[]interface{}) (string, error) {
+
+	var used []sortKey
+	var values []string
+	for _, k := range keys {
+		v := k.field.Value(d)
+		switch k.kind {
+		case propertyTextKey:
+			str, ok := v.(string)
+			if !ok {
+				continue
+			}
+			*args = append(*args, str)
+			values = append(values, fmt.Sprintf("$%d", len(*args)))
+		case propertyValueKey:
+			if _, ok := v.(string); ok {
+				v = ""
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", errors.Wrap(err, "unable to encode start after value")
 			}
+			*args = append(*args, string(b))
+			values = append(values, fmt.Sprintf("$%d::jsonb", len(*args)))
+		default:
+			*args = append(*args, v)
+			values = append(values, fmt.Sprintf("$%d", len(*args)))
 		}
-		orderByString = strings.Join(mappedOrderBy, ",")
+		used = append(used, k)
 	}
 
-	_, err := tx.tx.Exec("DECLARE "+cursorName+" CURSOR FOR SELECT id, created, updated, content FROM t_document WHERE collection=$1 ORDER BY "+orderByString, c.String())
+	alternatives := make([]string, len(used))
+	for i, k := range used {
+		var items []string
+		for j := 0; j < i; j++ {
+			items = append(items, used[j].expr+"="+values[j])
+		}
+		op := ">"
+		if k.descending {
+			op = "<"
+		}
+		items = append(items, k.expr+op+values[i])
+		alternatives[i] = "(" + strings.Join(items, " AND ") + ")"
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", nil
+}
+
+func (tx *transaction) GetAll(c api.ObjectRef, query api.Query) (api.Cursor, error) {
+
+	cursorName := api.NextID()
+
+	args := []interface{}{c.String()}
+	whereString := "collection=$1"
+	for _, condition := range query.Filter {
+		clause, err := conditionClause(condition, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	keys, err := sortKeys(query.OrderBy, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.StartAfter != nil {
+		clause, err := startAfterClause(keys, *query.StartAfter, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	_, err = tx.exec("DECLARE "+cursorName+" CURSOR FOR SELECT id, created, updated, revision, content FROM {document} WHERE "+whereString+" ORDER BY "+orderByClause(keys), args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "DB query failed")
 	}
@@ -162,6 +446,118 @@ func (tx *transaction) GetAll(c api.ObjectRef, orderBy []string) (api.Cursor, er
 	}, nil
 }
 
+func aggregationExpression(a api.Aggregation, args *[]interface{}) (string, error) {
+
+	if len(a.Field) == 0 {
+		if a.Function != api.Count {
+			return "", errors.New("Missing field in aggregation: " + a.String())
+		}
+		return "COUNT(*)", nil
+	}
+
+	if !a.Field.IsProperty() {
+		return "", errors.New("Only properties can be aggregated: " + a.String())
+	}
+
+	expr := propertyExpression(a.Field)
+	if a.Function == api.Count {
+		return "COUNT(NULLIF(" + expr + ",'null'::jsonb))", nil
+	}
+
+	// Only numeric values are considered
+	number := "CASE WHEN jsonb_typeof(" + expr + ")='number' THEN (" + expr + " #>> '{}')::numeric END"
+	switch a.Function {
+	case api.Sum:
+		return "SUM(" + number + ")", nil
+	case api.Min:
+		return "MIN(" + number + ")", nil
+	case api.Max:
+		return "MAX(" + number + ")", nil
+	case api.Avg:
+		return "AVG(" + number + ")", nil
+	}
+
+	return "", errors.New("Unknown aggregate function: " + string(a.Function))
+}
+
+func (tx *transaction) Aggregate(c api.ObjectRef, filter api.Filter, groupBy api.FieldPath, aggregations []api.Aggregation) ([]api.AggregateResult, error) {
+
+	args := []interface{}{c.String()}
+	whereString := "collection=$1"
+	for _, condition := range filter {
+		clause, err := conditionClause(condition, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	// The group is always the first selected item, 'null' when not grouping
+	items := []string{"'null'::jsonb"}
+	groupByString := ""
+	if len(groupBy) > 0 {
+		if !groupBy.IsProperty() {
+			return nil, errors.New("Only properties can be used to group documents: " + groupBy.String())
+		}
+		valueKey, textKey := propertyKeys(groupBy)
+		items[0] = propertyExpression(groupBy)
+		groupByString = " GROUP BY 1 ORDER BY " + valueKey + "," + textKey
+	}
+
+	for _, a := range aggregations {
+		expr, err := aggregationExpression(a, &args)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, expr)
+	}
+
+	rows, err := tx.query("SELECT "+strings.Join(items, ",")+" FROM {document} WHERE "+whereString+groupByString, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+	defer rows.Close()
+
+	results := []api.AggregateResult{}
+	for rows.Next() {
+
+		var group []byte
+		counts := make([]int64, len(aggregations))
+		numbers := make([]sql.NullFloat64, len(aggregations))
+
+		dest := []interface{}{&group}
+		for i, a := range aggregations {
+			if a.Function == api.Count {
+				dest = append(dest, &counts[i])
+			} else {
+				dest = append(dest, &numbers[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "DB retrieval failed")
+		}
+
+		r := api.AggregateResult{
+			Values: make(map[string]interface{}),
+		}
+		if err := json.Unmarshal(group, &r.Group); err != nil {
+			return nil, errors.Wrap(err, "DB decoding failed")
+		}
+		for i, a := range aggregations {
+			if a.Function == api.Count {
+				r.Values[a.String()] = counts[i]
+			} else if numbers[i].Valid {
+				r.Values[a.String()] = numbers[i].Float64
+			} else {
+				r.Values[a.String()] = nil
+			}
+		}
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
 func (c *cursor) Close() error {
 	_, err := c.tx.Exec("CLOSE " + c.name)
 	if err != nil {
@@ -182,7 +578,8 @@ func (c *cursor) Fetch(count int) ([]api.Document, error) {
 		var id string
 		var b []byte
 		var created, updated time.Time
-		if err := rows.Scan(&id, &created, &updated, &b); err != nil {
+		var revision int64
+		if err := rows.Scan(&id, &created, &updated, &revision, &b); err != nil {
 			return nil, errors.Wrap(err, "DB retrieval failed")
 		}
 
@@ -195,6 +592,7 @@ func (c *cursor) Fetch(count int) ([]api.Document, error) {
 			ID:                   id,
 			CreationDate:         created,
 			LastModificationDate: updated,
+			Revision:             revision,
 			Properties:           content,
 		})
 	}
@@ -211,23 +609,48 @@ func (tx *transaction) Add(c api.ObjectRef, payload api.DocumentProperties) (api
 		return api.Document{}, errors.Wrap(err, "unable to encode payload")
 	}
 
-	row := tx.tx.QueryRow("INSERT INTO t_document (collection, id, content) VALUES ($1,$2,$3) RETURNING CURRENT_TIMESTAMP", c.String(), id, &b)
+	row := tx.queryRow("INSERT INTO {document} (collection, id, content) VALUES ($1,$2,$3) RETURNING content, created, updated, revision", c.String(), id, &b)
 
-	var t time.Time
-	if err := row.Scan(&t); err != nil {
+	d, err := scanDocument(row, id)
+	if err != nil {
 		return api.Document{}, errors.Wrap(err, "unable to insert document")
 	}
 
-	d := api.Document{
-		ID:                   id,
-		CreationDate:         t,
-		LastModificationDate: t,
-		Properties:           payload,
+	ref := append(c[:len(c):len(c)], id)
+	if err := tx.archive(ref, d, false); err != nil {
+		return api.Document{}, err
+	}
+	if err := tx.notify(api.Added, ref, d); err != nil {
+		return api.Document{}, err
 	}
 
 	return d, nil
 }
 
+// write executes a query writing a single document and returning its content, dates and revision, and notifies the change.
+// It returns sql.ErrNoRows if no document was written.
+func (tx *transaction) write(changeType api.ChangeType, d api.ObjectRef, query string, args ...interface{}) error {
+
+	doc, err := scanDocument(tx.queryRow(query, args...), d.ID())
+	if err == sql.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to write document")
+	}
+
+	if err := tx.archive(d, doc, changeType == api.Deleted); err != nil {
+		return err
+	}
+	if changeType == api.Deleted && tx.softDelete {
+		if err := tx.trash(d, doc); err != nil {
+			return err
+		}
+	}
+
+	return tx.notify(changeType, d, doc)
+}
+
 func (tx *transaction) Put(d api.ObjectRef, payload api.DocumentProperties) error {
 
 	b, err := json.Marshal(&payload)
@@ -235,12 +658,27 @@ func (tx *transaction) Put(d api.ObjectRef, payload api.DocumentProperties) erro
 		return errors.Wrap(err, "unable to encode payload")
 	}
 
-	if _, err := tx.tx.Exec("INSERT INTO t_document (collection, id, content) VALUES ($1,$2,$3) ON CONFLICT(collection,id) DO UPDATE SET content=$3,updated=CURRENT_TIMESTAMP", d.Collection().String(), d.ID(), &b); err != nil {
-		return errors.Wrap(err, "unable to insert or update document")
+	return tx.write(api.Put, d, "INSERT INTO {document} (collection, id, content) VALUES ($1,$2,$3) ON CONFLICT(collection,id) DO UPDATE SET content=$3,updated=CURRENT_TIMESTAMP,revision=nextval('{revision}') RETURNING content, created, updated, revision", d.Collection().String(), d.ID(), &b)
+}
+
+func (tx *transaction) PutIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
 	}
 
-	return nil
+	if revision == 0 {
+		err = tx.write(api.Put, d, "INSERT INTO {document} (collection, id, content) VALUES ($1,$2,$3) ON CONFLICT(collection,id) DO NOTHING RETURNING content, created, updated, revision", d.Collection().String(), d.ID(), &b)
+	} else {
+		err = tx.write(api.Put, d, "UPDATE {document} SET content=$1,updated=CURRENT_TIMESTAMP,revision=nextval('{revision}') WHERE collection=$2 AND id=$3 AND revision=$4 RETURNING content, created, updated, revision", &b, d.Collection().String(), d.ID(), revision)
+	}
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
 }
+
 func (tx *transaction) Patch(d api.ObjectRef, payload api.DocumentProperties) error {
 
 	b, err := json.Marshal(&payload)
@@ -248,27 +686,135 @@ func (tx *transaction) Patch(d api.ObjectRef, payload api.DocumentProperties) er
 		return errors.Wrap(err, "unable to encode payload")
 	}
 
-	if _, err := tx.tx.Exec("UPDATE t_document SET content = (content || $1),updated=CURRENT_TIMESTAMP WHERE collection=$2 AND id=$3", &b, d.Collection().String(), d.ID()); err != nil {
-		return errors.Wrap(err, "unable to update document")
+	err = tx.write(api.Patched, d, "UPDATE {document} SET content = {patch}(content, $1, CURRENT_TIMESTAMP),updated=CURRENT_TIMESTAMP,revision=nextval('{revision}') WHERE collection=$2 AND id=$3 RETURNING content, created, updated, revision", &b, d.Collection().String(), d.ID())
+	if err == sql.ErrNoRows {
+		return nil
 	}
+	return err
+}
 
-	return nil
+func (tx *transaction) PatchIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
+	}
+
+	err = tx.write(api.Patched, d, "UPDATE {document} SET content = {patch}(content, $1, CURRENT_TIMESTAMP),updated=CURRENT_TIMESTAMP,revision=nextval('{revision}') WHERE collection=$2 AND id=$3 AND revision=$4 RETURNING content, created, updated, revision", &b, d.Collection().String(), d.ID(), revision)
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
 }
 
 func (tx *transaction) Delete(d api.ObjectRef) error {
 
-	if _, err := tx.tx.Exec("DELETE FROM t_document where collection=$1 and id=$2", d.Collection().String(), d.ID()); err != nil {
-		return errors.Wrap(err, "unable to delete document")
+	err := tx.write(api.Deleted, d, "DELETE FROM {document} where collection=$1 and id=$2 RETURNING content, created, updated, revision", d.Collection().String(), d.ID())
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (tx *transaction) DeleteIfRevision(d api.ObjectRef, revision int64) error {
+
+	err := tx.write(api.Deleted, d, "DELETE FROM {document} where collection=$1 and id=$2 and revision=$3 RETURNING content, created, updated, revision", d.Collection().String(), d.ID(), revision)
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
+}
+
+// CheckRevision locks the document until the transaction ends, so that the concurrent writes wait for it.
+// A missing document is inserted and deleted at once, so that the transactions creating it wait as well.
+func (tx *transaction) CheckRevision(d api.ObjectRef, revision int64) error {
+
+	var current int64
+	err := tx.queryRow("SELECT revision FROM {document} WHERE collection=$1 AND id=$2 FOR SHARE", d.Collection().String(), d.ID()).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "DB retrieval failed")
 	}
 
+	if err == sql.ErrNoRows && revision == 0 {
+		res, err := tx.exec("INSERT INTO {document} (collection, id, content) VALUES ($1,$2,'null') ON CONFLICT(collection,id) DO NOTHING", d.Collection().String(), d.ID())
+		if err != nil {
+			return errors.Wrap(err, "unable to lock document")
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			// Created concurrently
+			return revisionMismatch("document revision mismatch")
+		}
+		if _, err := tx.exec("DELETE FROM {document} WHERE collection=$1 AND id=$2", d.Collection().String(), d.ID()); err != nil {
+			return errors.Wrap(err, "unable to lock document")
+		}
+	}
+
+	if current != revision {
+		return revisionMismatch("document revision mismatch")
+	}
 	return nil
 }
 
 func (tx *transaction) DeleteCollection(c api.ObjectRef) error {
 
-	if _, err := tx.tx.Exec("DELETE FROM t_document where collection=$1", c.String()); err != nil {
+	rows, err := tx.query("DELETE FROM {document} where collection=$1 RETURNING id, content, created, updated, revision", c.String())
+	if err != nil {
+		return errors.Wrap(err, "unable to delete collection")
+	}
+
+	var deleted []api.Document
+	for rows.Next() {
+		var id string
+		var b []byte
+		doc := api.Document{}
+		if err := rows.Scan(&id, &b, &doc.CreationDate, &doc.LastModificationDate, &doc.Revision); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "DB retrieval failed")
+		}
+		doc.ID = id
+		if err := json.Unmarshal(b, &doc.Properties); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "DB decoding failed")
+		}
+		deleted = append(deleted, doc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return errors.Wrap(err, "unable to delete collection")
 	}
 
+	for _, doc := range deleted {
+		ref := append(c[:len(c):len(c)], doc.ID)
+		if err := tx.archive(ref, doc, true); err != nil {
+			return err
+		}
+		if tx.softDelete {
+			if err := tx.trash(ref, doc); err != nil {
+				return err
+			}
+		}
+		if err := tx.notify(api.Deleted, ref, doc); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// scanDocument reads a document from a row made of its content, creation and last modification dates, and revision
+func scanDocument(row *sql.Row, id string) (api.Document, error) {
+
+	var b []byte
+	doc := api.Document{
+		ID: id,
+	}
+	if err := row.Scan(&b, &doc.CreationDate, &doc.LastModificationDate, &doc.Revision); err != nil {
+		return api.Document{}, err
+	}
+
+	if err := json.Unmarshal(b, &doc.Properties); err != nil {
+		return api.Document{}, errors.Wrap(err, "DB decoding failed")
+	}
+
+	return doc, nil
+}
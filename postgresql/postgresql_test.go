@@ -3,9 +3,12 @@ package postgresql
 import (
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/repotest"
 )
 
 const ConnectionString string = "user=nestor password=nestor dbname=nestor sslmode=disable"
@@ -34,232 +37,298 @@ func TestNew(t *testing.T) {
 	}
 }
 
-func TestPutPatchGetDeleteDocument(t *testing.T) {
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) api.Repository {
+		r, err := New(ConnectionString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+}
+
+func TestHistory(t *testing.T) {
 
-	d := api.ObjectRef{"test", "doc1"}
-	payload := make(api.DocumentProperties)
-	payload["k"] = "v"
-	payload["n"] = 123
+	d := api.ObjectRef{"test_history", api.NextID()}
 
 	r, err := New(ConnectionString)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	tx, err := r.Begin()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer tx.Rollback()
 
-	if err := tx.Put(d, payload); err != nil {
-		t.Error(err)
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Patch(d, api.DocumentProperties{"k": "v2"}); err != nil {
+		t.Fatal(err)
 	}
+	if err := tx.Delete(d); err != nil {
+		t.Fatal(err)
+	}
+
+	h := tx.(api.Historian)
 
-	res, err := tx.Get(d)
+	versions, err := h.History(d)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	if res.ID != "doc1" {
-		t.Errorf("Invalid ID: got '%s', expected 'doc1'", res.ID)
+	if len(versions) != 3 {
+		t.Fatalf("Invalid number of versions, got %d, expected 3", len(versions))
 	}
-
-	if res.CreationDate != res.LastModificationDate {
-		t.Error("Different creation and last modification dates", res.CreationDate, res.LastModificationDate)
+	if !versions[0].Deleted || versions[0].Properties["k"] != "v2" {
+		t.Errorf("Invalid deleted version: %v", versions[0])
 	}
-
-	v, ok := res.Properties["k"]
-	if !ok {
-		t.Errorf("Missing field 'k'")
+	if versions[1].Deleted || versions[1].Properties["k"] != "v2" {
+		t.Errorf("Invalid patched version: %v", versions[1])
 	}
-	if v != "v" {
-		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
+	if versions[2].Deleted || versions[2].Properties["k"] != "v" {
+		t.Errorf("Invalid put version: %v", versions[2])
 	}
 
-	v2, ok := res.Properties["n"]
-	if !ok {
-		t.Errorf("Missing field 'n'")
+	// All the versions share the date of the transaction, so the latest one is the deletion
+	if _, err := h.GetAsOf(d, versions[0].LastModificationDate); err == nil {
+		t.Error("The document should not exist after its deletion")
 	}
-	if v2 != 123. { //TODO: why float and not int? is it supported by json?
-		t.Errorf("Invalid field 'n': got %v, expected 123", v2)
+	if _, err := h.GetAsOf(d, versions[2].CreationDate.Add(-time.Second)); err == nil {
+		t.Error("The document should not exist before its creation")
 	}
+}
 
-	err = tx.Commit()
-	if err != nil {
-		t.Error(err)
-	}
+func TestTrash(t *testing.T) {
 
-	tx, err = r.Begin()
-	if err != nil {
-		t.Error(err)
-	}
+	c := api.ObjectRef{"test_trash_" + api.NextID()}
+	d := api.ObjectRef{c[0], "doc1"}
 
-	payload = make(api.DocumentProperties)
-	payload["k2"] = "v2"
-	payload["n"] = 125
-	if err := tx.Patch(d, payload); err != nil {
-		t.Error(err)
+	r, err := NewWithConfig(Config{ConnStr: ConnectionString, SoftDelete: true})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	res, err = tx.Get(d)
+	tx, err := r.Begin()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer tx.Rollback()
 
-	if res.ID != "doc1" {
-		t.Errorf("Invalid ID: got '%s', expected 'doc1'", res.ID)
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
 	}
-	if !res.CreationDate.Before(res.LastModificationDate) {
-		t.Error("Creation date expected before last modification date", res.CreationDate, res.LastModificationDate)
+	if err := tx.Delete(d); err != nil {
+		t.Fatal(err)
 	}
 
-	v, ok = res.Properties["k"]
-	if !ok {
-		t.Errorf("Missing field 'k'")
-	}
-	if v != "v" {
-		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
-	}
-	v, ok = res.Properties["k2"]
-	if !ok {
-		t.Errorf("Missing field 'k2'")
+	b := tx.(api.RecycleBin)
+
+	trashed, err := b.GetTrash(c)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if v != "v2" {
-		t.Errorf("Invalid field 'k2': got '%s', expected 'v2'", v)
+	if len(trashed) != 1 || trashed[0].ID != "doc1" || trashed[0].Properties["k"] != "v" {
+		t.Fatalf("Invalid trash: %v", trashed)
 	}
 
-	v2, ok = res.Properties["n"]
-	if !ok {
-		t.Errorf("Missing field 'n'")
+	restored, err := b.Restore(d)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if v2 != 125. { //TODO: why float and not int? is it supported by json?
-		t.Errorf("Invalid field 'n': got %v, expected 125", v2)
+	if restored.Properties["k"] != "v" || restored.Revision <= trashed[0].Revision {
+		t.Errorf("Invalid restored document: %v", restored)
 	}
-
-	if err := tx.Delete(d); err != nil {
+	if _, err := tx.Get(d); err != nil {
 		t.Error(err)
 	}
-
-	res, err = tx.Get(d)
-	if err == nil {
-		t.Error("Document should not be found")
+	if _, err := b.Restore(d); err == nil {
+		t.Error("A document can only be restored once")
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if _, err := r.(api.Purger).Purge(); err != nil {
 		t.Error(err)
 	}
 }
 
-func TestAddGetDeleteCollection(t *testing.T) {
-
-	payload := make(api.DocumentProperties)
-	payload["k"] = "v"
-	payload["n"] = 123
-	payload2 := make(api.DocumentProperties)
-	payload2["k"] = "v2"
-	payload2["m"] = 125
+func TestMigrate(t *testing.T) {
 
 	r, err := New(ConnectionString)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	m := r.(api.Migrator)
 
-	tx, err := r.Begin()
-	if err != nil {
-		t.Error(err)
+	// The migrations were applied by TestMain: applying them again does nothing
+	var b strings.Builder
+	if err := m.Migrate(&b, false); err != nil {
+		t.Fatal(err)
 	}
-
-	c := api.ObjectRef{"test"}
-	d, err := tx.Add(c, payload)
-	if err != nil {
-		t.Error(err)
+	if err := m.Migrate(&b, true); err != nil {
+		t.Fatal(err)
 	}
-	if len(d.ID) == 0 {
-		t.Error("Document ID should be returned")
+	if b.Len() > 0 {
+		t.Errorf("No migration should be pending, got:\n%s", b.String())
 	}
+}
 
-	dref := api.ObjectRef{"test", d.ID}
+func TestSchemaAndPrefix(t *testing.T) {
 
-	res, err := tx.Get(dref)
-	if err != nil {
-		t.Error(err)
+	if _, err := NewWithConfig(Config{ConnStr: ConnectionString, Schema: "grest; DROP TABLE t_document"}); err == nil {
+		t.Error("Invalid schema should be rejected")
 	}
-
-	if res.ID != d.ID {
-		t.Errorf("Invalid ID: got '%s', expected '%s'", res.ID, d.ID)
+	if _, err := NewWithConfig(Config{ConnStr: ConnectionString, TablePrefix: "App-"}); err == nil {
+		t.Error("Invalid table prefix should be rejected")
 	}
 
-	v, ok := res.Properties["k"]
-	if !ok {
-		t.Errorf("Missing field 'k'")
-	}
-	if v != "v" {
-		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
+	newRepository := func(t *testing.T) api.Repository {
+		r, err := NewWithConfig(Config{ConnStr: ConnectionString, SoftDelete: true, Schema: "grest_test", TablePrefix: "app1_"})
+		if err == nil {
+			err = r.Init()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
 	}
 
-	v2, ok := res.Properties["n"]
-	if !ok {
-		t.Errorf("Missing field 'n'")
-	}
-	if v2 != 123. {
-		t.Errorf("Invalid field 'n': got %v, expected 123", v2)
-	}
+	repotest.Run(t, newRepository)
 
-	d2, err := tx.Add(c, payload)
+	// The documents of the prefixed tables are not visible from the default ones
+	d := api.ObjectRef{"test_prefix", api.NextID()}
+
+	tx, err := newRepository(t).Begin()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if len(d2.ID) == 0 {
-		t.Error("Document 2 ID should be returned")
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
 	}
-
-	cu, err := tx.GetAll(c, nil)
-	if err != nil {
-		t.Error(err)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
 	}
 
-	all, err := cu.Fetch(2)
+	r, err := New(ConnectionString)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	err = cu.Close()
+	tx, err = r.Begin()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer tx.Rollback()
 
-	if len(all) != 2 {
-		t.Errorf("Invalid list length, got %v, expected 2", len(all))
+	if _, err := tx.Get(d); err == nil {
+		t.Error("The document should only exist in the prefixed table")
 	}
+}
+
+func TestIndexes(t *testing.T) {
 
-	err = tx.DeleteCollection(c)
+	indexes, err := propertyIndexes([]Index{
+		{Collection: "users/{userId}/tasks", Field: "properties.dueDate"},
+		{Collection: "projects/{projectId}/tasks", Field: "properties.dueDate"},
+		{Collection: "tasks", Field: "properties.dueDate"},
+		{Collection: "tasks", Field: "properties.priority", Type: "btree"},
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if len(indexes) != 3 {
+		t.Errorf("Identical indexes should be shared, got %v", indexes)
 	}
 
-	cu2, err := tx.GetAll(c, nil)
-	if err != nil {
-		t.Error(err)
+	for _, invalid := range []Index{
+		{Collection: "tasks", Field: "dueDate"},
+		{Collection: "tasks", Field: "creationDate"},
+		{Collection: "tasks/t1", Field: "properties.dueDate"},
+		{Collection: "tasks", Field: "properties.dueDate", Type: "hash"},
+		{Collection: "tasks", Field: "properties.tags", Type: "gin"},
+	} {
+		if _, err := propertyIndexes([]Index{invalid}); err == nil {
+			t.Errorf("Invalid index should be rejected: %v", invalid)
+		}
 	}
 
-	all, err = cu2.Fetch(2)
+	cfg := Config{
+		ConnStr:     ConnectionString,
+		Schema:      "grest_test",
+		TablePrefix: "index_test_",
+		Indexes:     []Index{{Collection: "tasks", Field: "properties.dueDate"}},
+	}
+	r, err := NewWithConfig(cfg)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := r.(api.Migrator).Migrate(&b, true); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() > 0 {
+		t.Errorf("The indexes should match the configuration, got:\n%s", b.String())
 	}
 
-	err = cu2.Close()
+	// The index is reported as drift once it is no longer declared
+	cfg.Indexes = nil
+	r, err = NewWithConfig(cfg)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if err := r.(api.Migrator).Migrate(&b, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "DROP INDEX") {
+		t.Errorf("The index should be dropped, got:\n%s", b.String())
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
 	}
 
-	if len(all) != 0 {
-		t.Errorf("Invalid list length, got %v, expected 0", len(all))
+	var count int
+	if err := r.(*repository).db.QueryRow("SELECT count(*) FROM pg_indexes WHERE schemaname = 'grest_test' AND indexname LIKE 'index\\_test\\_i\\_property\\_%'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("The index should have been dropped, %d remain", count)
 	}
 
-	err = tx.Rollback()
-	if err != nil {
-		t.Error(err)
+	b.Reset()
+	if err := r.(api.Migrator).Migrate(&b, true); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() > 0 {
+		t.Errorf("No index should be left to drop, got:\n%s", b.String())
 	}
+}
 
+func TestPropertyExpression(t *testing.T) {
+
+	names := objectNames(Config{Schema: "grest", TablePrefix: "app_"})
+
+	for _, tc := range []struct {
+		field    string
+		expected string
+	}{
+		{"properties.dueDate", `COALESCE(content #> '{"dueDate"}'::text[], 'null'::jsonb)`},
+		{"properties.sub.it's", `COALESCE(content #> '{"sub","it''s"}'::text[], 'null'::jsonb)`},
+		{`properties.a"b\c`, `COALESCE(content #> '{"a\"b\\c"}'::text[], 'null'::jsonb)`},
+		{"properties.{document}", `COALESCE(content #> '{"{\document}"}'::text[], 'null'::jsonb)`},
+	} {
+		f, err := api.ParseFieldPath(tc.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expr := propertyExpression(f)
+		if expr != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.field, tc.expected, expr)
+		}
+		if names.Replace(expr) != expr {
+			t.Errorf("%s: the expression should not contain placeholders, got %s", tc.field, names.Replace(expr))
+		}
+	}
 }
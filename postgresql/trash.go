@@ -0,0 +1,92 @@
+package postgresql
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// trash keeps a deleted document, so that it can be restored during the retention period
+func (tx *transaction) trash(d api.ObjectRef, doc api.Document) error {
+
+	b, err := json.Marshal(doc.Properties)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode trashed document")
+	}
+
+	// Only the last deletion of a document is kept
+	if _, err := tx.exec(`INSERT INTO {trash} (collection, id, created, updated, revision, content) VALUES ($1,$2,$3,$4,$5,$6)
+		ON CONFLICT(collection,id) DO UPDATE SET created=$3,updated=$4,revision=$5,content=$6,deleted=CURRENT_TIMESTAMP`,
+		d.Collection().String(), d.ID(), doc.CreationDate, doc.LastModificationDate, doc.Revision, &b); err != nil {
+		return errors.Wrap(err, "unable to trash document")
+	}
+
+	return nil
+}
+
+func (tx *transaction) GetTrash(c api.ObjectRef) ([]api.TrashedDocument, error) {
+
+	rows, err := tx.query("SELECT id, created, updated, revision, content, deleted FROM {trash} WHERE collection=$1 ORDER BY deleted DESC, id", c.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+	defer rows.Close()
+
+	var trashed []api.TrashedDocument
+	for rows.Next() {
+		var t api.TrashedDocument
+		var b []byte
+		if err := rows.Scan(&t.ID, &t.CreationDate, &t.LastModificationDate, &t.Revision, &b, &t.DeletionDate); err != nil {
+			return nil, errors.Wrap(err, "DB retrieval failed")
+		}
+		if err := json.Unmarshal(b, &t.Properties); err != nil {
+			return nil, errors.Wrap(err, "DB decoding failed")
+		}
+		trashed = append(trashed, t)
+	}
+
+	return trashed, rows.Err()
+}
+
+func (tx *transaction) Restore(d api.ObjectRef) (api.Document, error) {
+
+	row := tx.queryRow("DELETE FROM {trash} WHERE collection=$1 AND id=$2 RETURNING content, created, updated, revision", d.Collection().String(), d.ID())
+
+	trashed, err := scanDocument(row, d.ID())
+	if err == sql.ErrNoRows {
+		return api.Document{}, notFound("document not found in trash")
+	}
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "unable to restore document")
+	}
+
+	b, err := json.Marshal(trashed.Properties)
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "unable to encode payload")
+	}
+
+	// The restored document is a new version of the document, with its original creation date.
+	// Nothing is returned if the document was created again in the meantime.
+	err = tx.write(api.Added, d, "INSERT INTO {document} (collection, id, content, created) VALUES ($1,$2,$3,$4) ON CONFLICT(collection,id) DO NOTHING RETURNING content, created, updated, revision", d.Collection().String(), d.ID(), &b, trashed.CreationDate)
+	if err == sql.ErrNoRows {
+		return api.Document{}, documentExists("document already exists")
+	}
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	return tx.Get(d)
+}
+
+func (r *repository) Purge() (int64, error) {
+
+	res, err := r.db.Exec(r.names.Replace("DELETE FROM {trash} WHERE deleted < CURRENT_TIMESTAMP - make_interval(secs => $1)"), r.cfg.TrashRetention.Seconds())
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to purge trash")
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,70 @@
+package grest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// preconditions are the conditions on the current state of a document that a write request requires
+type preconditions struct {
+	IfMatch           string
+	IfUnmodifiedSince string
+}
+
+func (p preconditions) isSet() bool {
+	return len(p.IfMatch) > 0 || len(p.IfUnmodifiedSince) > 0
+}
+
+func getPreconditions(r *http.Request) preconditions {
+	return preconditions{
+		IfMatch:           r.Header.Get("If-Match"),
+		IfUnmodifiedSince: r.Header.Get("If-Unmodified-Since"),
+	}
+}
+
+// matchesEtag returns whether one of the entity tags of the If-Match list is the given ETag.
+// As required for If-Match, weak entity tags never match.
+func matchesEtag(ifMatch string, etag string) bool {
+	for _, item := range strings.Split(ifMatch, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" || (!strings.HasPrefix(item, "W/") && item == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// check verifies the preconditions against the current document, read in the transaction performing the write.
+// As stated by RFC 7232, If-Unmodified-Since is ignored when If-Match is present, or when it is not a valid date.
+func (p preconditions) check(s *server, target api.ObjectRef, current api.Document, exists bool) error {
+
+	if len(p.IfMatch) > 0 {
+		if !exists {
+			return preconditionFailedError{target}
+		}
+		etag, err := s.computeEtag(current)
+		if err != nil {
+			return err
+		}
+		if !matchesEtag(p.IfMatch, etag) {
+			return preconditionFailedError{target}
+		}
+		return nil
+	}
+
+	if len(p.IfUnmodifiedSince) > 0 {
+		ifUnmodifiedSince, err := http.ParseTime(p.IfUnmodifiedSince)
+		if err != nil {
+			return nil
+		}
+		// HTTP dates have a precision of one second
+		if exists && current.LastModificationDate.Truncate(time.Second).After(ifUnmodifiedSince) {
+			return preconditionFailedError{target}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package grest
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/schema"
+)
+
+// requestIDHeader is the header carrying the identifier of a request, which is provided by the client or a proxy, or generated
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID restricts the request identifiers provided by clients, as they are logged and sent back
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID returns the request with its identifier, which is also sent back in the response headers
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = xid.New().String()
+	}
+
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// problem is the body of an error response, as defined by RFC 7807.
+// The type is always about:blank, and code is a stable identifier of the kind of error.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	Path      string `json:"path,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+// errorCode returns the stable code of the errors sent with the status
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "not_authorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusUnprocessableEntity:
+		return "invalid_content"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "internal_error"
+}
+
+// newProblem describes the error for the client.
+// The details of internal errors are not disclosed, and only the path pattern of the rule that denied an access is,
+// never its conditions.
+func newProblem(r *http.Request, err error) problem {
+
+	status, _ := errorStatus(err)
+
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		Code:      errorCode(status),
+		RequestID: requestID(r),
+	}
+	if status == http.StatusInternalServerError {
+		return p
+	}
+
+	cause := errors.Cause(err)
+	p.Detail = cause.Error()
+
+	var target api.ObjectRef
+	switch e := cause.(type) {
+	case notAuthorizedError:
+		target, p.Rule = e.Target, e.Rule
+	case forbiddenError:
+		if e.Hidden {
+			// Same detail as the datastores when a document does not exist
+			p.Detail = "document not found"
+			return p
+		}
+		target, p.Rule = e.Target, e.Rule
+	case notFoundError:
+		target = e.Target
+	case preconditionFailedError:
+		target = e.Target
+	case conflictError:
+		target = e.Target
+	case invalidContentError:
+		target, p.Violations = e.Target, e.Violations
+	}
+	if len(target) > 0 {
+		p.Path = target.String()
+	}
+
+	return p
+}
+
+// authenticationChallenge returns the WWW-Authenticate header of the 401 response to the error, as defined by RFC 6750
+func authenticationChallenge(err error) string {
+	if e, ok := errors.Cause(err).(notAuthorizedError); ok && len(e.Target) == 0 {
+		return `Bearer realm="grest", error="invalid_token", error_description="` + e.Error() + `"`
+	}
+	return `Bearer realm="grest"`
+}
+
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+
+	p := newProblem(r, err)
+
+	log.Printf("Error (request %s): %v", p.RequestID, err)
+
+	if p.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", authenticationChallenge(err))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Println("Error: ", err)
+	}
+}
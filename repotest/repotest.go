@@ -0,0 +1,1004 @@
+//Package repotest checks that an implementation of api.Repository behaves as grest expects.
+//
+//The tests of a repository run the scenarios on the repositories returned by a factory:
+//
+//	func TestRepository(t *testing.T) {
+//		repotest.Run(t, func(t *testing.T) api.Repository {
+//			r, err := myrepository.New(...)
+//			if err == nil {
+//				err = r.Init()
+//			}
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return r
+//		})
+//	}
+//
+//The repositories may share their documents, such as a database reused across runs:
+//the scenarios only commit documents in collections that they do not read afterwards, or that are unique to the run.
+package repotest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+//Factory returns an initialized repository to test.
+//It is called at least once per scenario, and may return the same repository.
+type Factory func(t *testing.T) api.Repository
+
+//Run runs all the scenarios, as subtests, on the repositories returned by the factory
+func Run(t *testing.T, newRepository Factory) {
+
+	for _, s := range []struct {
+		name string
+		test func(t *testing.T, newRepository Factory)
+	}{
+		{"PutPatchGetDeleteDocument", testPutPatchGetDeleteDocument},
+		{"AddGetDeleteCollection", testAddGetDeleteCollection},
+		{"GetAllWithFilter", testGetAllWithFilter},
+		{"GetAllOrderByProperties", testGetAllOrderByProperties},
+		{"GetAllStartAfter", testGetAllStartAfter},
+		{"StringOrder", testStringOrder},
+		{"Aggregate", testAggregate},
+		{"Revisions", testRevisions},
+		{"PatchOperators", testPatchOperators},
+		{"NotFound", testNotFound},
+		{"CursorPaging", testCursorPaging},
+		{"DeleteCollectionKeepsSubCollections", testDeleteCollectionKeepsSubCollections},
+		{"Rollback", testRollback},
+		{"Isolation", testIsolation},
+		{"CheckRevision", testCheckRevision},
+	} {
+		t.Run(s.name, func(t *testing.T) {
+			s.test(t, newRepository)
+		})
+	}
+}
+
+func testPutPatchGetDeleteDocument(t *testing.T, newRepository Factory) {
+
+	d := api.ObjectRef{"test", "doc1"}
+	payload := make(api.DocumentProperties)
+	payload["k"] = "v"
+	payload["n"] = 123
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := tx.Put(d, payload); err != nil {
+		t.Error(err)
+	}
+
+	res, err := tx.Get(d)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.ID != "doc1" {
+		t.Errorf("Invalid ID: got '%s', expected 'doc1'", res.ID)
+	}
+
+	if res.CreationDate != res.LastModificationDate {
+		t.Error("Different creation and last modification dates", res.CreationDate, res.LastModificationDate)
+	}
+
+	v, ok := res.Properties["k"]
+	if !ok {
+		t.Errorf("Missing field 'k'")
+	}
+	if v != "v" {
+		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
+	}
+
+	v2, ok := res.Properties["n"]
+	if !ok {
+		t.Errorf("Missing field 'n'")
+	}
+	if v2 != 123. { //TODO: why float and not int? is it supported by json?
+		t.Errorf("Invalid field 'n': got %v, expected 123", v2)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+
+	payload = make(api.DocumentProperties)
+	payload["k2"] = "v2"
+	payload["n"] = 125
+	if err := tx.Patch(d, payload); err != nil {
+		t.Error(err)
+	}
+
+	res, err = tx.Get(d)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.ID != "doc1" {
+		t.Errorf("Invalid ID: got '%s', expected 'doc1'", res.ID)
+	}
+	if !res.CreationDate.Before(res.LastModificationDate) {
+		t.Error("Creation date expected before last modification date", res.CreationDate, res.LastModificationDate)
+	}
+
+	v, ok = res.Properties["k"]
+	if !ok {
+		t.Errorf("Missing field 'k'")
+	}
+	if v != "v" {
+		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
+	}
+	v, ok = res.Properties["k2"]
+	if !ok {
+		t.Errorf("Missing field 'k2'")
+	}
+	if v != "v2" {
+		t.Errorf("Invalid field 'k2': got '%s', expected 'v2'", v)
+	}
+
+	v2, ok = res.Properties["n"]
+	if !ok {
+		t.Errorf("Missing field 'n'")
+	}
+	if v2 != 125. { //TODO: why float and not int? is it supported by json?
+		t.Errorf("Invalid field 'n': got %v, expected 125", v2)
+	}
+
+	if err := tx.Delete(d); err != nil {
+		t.Error(err)
+	}
+
+	res, err = tx.Get(d)
+	if err == nil {
+		t.Error("Document should not be found")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func testAddGetDeleteCollection(t *testing.T, newRepository Factory) {
+
+	payload := make(api.DocumentProperties)
+	payload["k"] = "v"
+	payload["n"] = 123
+	payload2 := make(api.DocumentProperties)
+	payload2["k"] = "v2"
+	payload2["m"] = 125
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+
+	c := api.ObjectRef{"test"}
+	d, err := tx.Add(c, payload)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(d.ID) == 0 {
+		t.Error("Document ID should be returned")
+	}
+
+	dref := api.ObjectRef{"test", d.ID}
+
+	res, err := tx.Get(dref)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res.ID != d.ID {
+		t.Errorf("Invalid ID: got '%s', expected '%s'", res.ID, d.ID)
+	}
+
+	v, ok := res.Properties["k"]
+	if !ok {
+		t.Errorf("Missing field 'k'")
+	}
+	if v != "v" {
+		t.Errorf("Invalid field 'k': got '%s', expected 'v'", v)
+	}
+
+	v2, ok := res.Properties["n"]
+	if !ok {
+		t.Errorf("Missing field 'n'")
+	}
+	if v2 != 123. {
+		t.Errorf("Invalid field 'n': got %v, expected 123", v2)
+	}
+
+	d2, err := tx.Add(c, payload)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(d2.ID) == 0 {
+		t.Error("Document 2 ID should be returned")
+	}
+
+	cu, err := tx.GetAll(c, api.Query{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	all, err := cu.Fetch(2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = cu.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(all) != 2 {
+		t.Errorf("Invalid list length, got %v, expected 2", len(all))
+	}
+
+	err = tx.DeleteCollection(c)
+	if err != nil {
+		t.Error(err)
+	}
+
+	cu2, err := tx.GetAll(c, api.Query{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	all, err = cu2.Fetch(2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = cu2.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(all) != 0 {
+		t.Errorf("Invalid list length, got %v, expected 0", len(all))
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+	}
+
+}
+
+func testGetAllWithFilter(t *testing.T, newRepository Factory) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_filter"}
+	for _, p := range []api.DocumentProperties{
+		{"status": "open", "priority": 1},
+		{"status": "open", "priority": 3},
+		{"status": "closed", "priority": 5},
+		{"status": "open", "priority": "high"},
+	} {
+		if _, err := tx.Add(c, p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	filter := api.Filter{
+		{Field: api.FieldPath{"properties", "status"}, Operator: api.Equal, Value: "open"},
+		{Field: api.FieldPath{"properties", "priority"}, Operator: api.Greater, Value: 2.},
+	}
+
+	cu, err := tx.GetAll(c, api.Query{Filter: filter})
+	if err != nil {
+		t.Error(err)
+	}
+
+	all, err := cu.Fetch(10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = cu.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(all) != 1 {
+		t.Fatalf("Invalid list length, got %v, expected 1", len(all))
+	}
+	if all[0].Properties["priority"] != 3. {
+		t.Errorf("Invalid document returned: %v", all[0].Properties)
+	}
+}
+
+func testGetAllOrderByProperties(t *testing.T, newRepository Factory) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_order"}
+	for _, p := range []api.DocumentProperties{
+		{"priority": 1, "due": "2020-01-03"},
+		{"priority": 2, "due": "2020-01-01"},
+		{"priority": 2, "due": "2020-01-02"},
+	} {
+		if _, err := tx.Add(c, p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	orderBy := []api.Order{
+		{Field: api.FieldPath{"properties", "priority"}, Descending: true},
+		{Field: api.FieldPath{"properties", "due"}},
+	}
+
+	cu, err := tx.GetAll(c, api.Query{OrderBy: orderBy})
+	if err != nil {
+		t.Error(err)
+	}
+
+	all, err := cu.Fetch(10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = cu.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{"2020-01-01", "2020-01-02", "2020-01-03"}
+	if len(all) != len(expected) {
+		t.Fatalf("Invalid list length, got %v, expected %v", len(all), len(expected))
+	}
+	for i := range expected {
+		if all[i].Properties["due"] != expected[i] {
+			t.Errorf("Invalid document at position %d: got %v, expected %s", i, all[i].Properties["due"], expected[i])
+		}
+	}
+}
+
+func testGetAllStartAfter(t *testing.T, newRepository Factory) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_start_after"}
+	for _, p := range []api.DocumentProperties{
+		{"priority": 1},
+		{"priority": 2},
+		{"priority": 2},
+		{"priority": 3},
+	} {
+		if _, err := tx.Add(c, p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	q := api.Query{
+		OrderBy: []api.Order{{Field: api.FieldPath{"properties", "priority"}, Descending: true}},
+	}
+
+	var all []api.Document
+	for {
+		cu, err := tx.GetAll(c, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page, err := cu.Fetch(1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = cu.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+		q.StartAfter = &page[0]
+	}
+
+	expected := []float64{3, 2, 2, 1}
+	if len(all) != len(expected) {
+		t.Fatalf("Invalid list length, got %v, expected %v", len(all), len(expected))
+	}
+	for i := range expected {
+		if all[i].Properties["priority"] != expected[i] {
+			t.Errorf("Invalid document at position %d: got %v, expected %v", i, all[i].Properties["priority"], expected[i])
+		}
+	}
+}
+
+// testStringOrder checks that strings are compared byte by byte, whatever the collation of the datastore
+func testStringOrder(t *testing.T, newRepository Factory) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_string_order"}
+	for id, p := range map[string]api.DocumentProperties{
+		"é":        {"name": "é"},
+		"b":        {"name": "b"},
+		"ab":       {"name": "ab"},
+		"a":        {"name": "a"},
+		"Z":        {"name": "Z"},
+		"B":        {"name": "B"},
+		"1missing": {},
+		"2number":  {"name": 1},
+	} {
+		if err := tx.Put(api.ObjectRef{c[0], id}, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ids returns the IDs of the documents of the query, fetched one page of a single document at a time
+	ids := func(q api.Query) []string {
+		var res []string
+		for {
+			cu, err := tx.GetAll(c, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := cu.Fetch(1)
+			if err != nil {
+				t.Error(err)
+			}
+			if err := cu.Close(); err != nil {
+				t.Error(err)
+			}
+			if len(page) == 0 {
+				return res
+			}
+			res = append(res, page[0].ID)
+			q.StartAfter = &page[0]
+		}
+	}
+
+	name := api.FieldPath{"properties", "name"}
+	for _, tc := range []struct {
+		query    api.Query
+		expected []string
+	}{
+		{api.Query{}, []string{"1missing", "2number", "B", "Z", "a", "ab", "b", "é"}},
+		{api.Query{OrderBy: []api.Order{{Field: name}}}, []string{"1missing", "B", "Z", "a", "ab", "b", "é", "2number"}},
+		{api.Query{OrderBy: []api.Order{{Field: name, Descending: true}}}, []string{"2number", "é", "b", "ab", "a", "Z", "B", "1missing"}},
+		{api.Query{Filter: api.Filter{{Field: name, Operator: api.Greater, Value: "Z"}}}, []string{"a", "ab", "b", "é"}},
+		{api.Query{Filter: api.Filter{{Field: name, Operator: api.Less, Value: "a"}}}, []string{"B", "Z"}},
+		{api.Query{Filter: api.Filter{{Field: name, Operator: api.Equal, Value: "é"}}}, []string{"é"}},
+		{api.Query{Filter: api.Filter{{Field: name, Operator: api.NotEqual, Value: "a"}}}, []string{"1missing", "2number", "B", "Z", "ab", "b", "é"}},
+		{api.Query{Filter: api.Filter{{Field: api.FieldPath{"id"}, Operator: api.GreaterOrEqual, Value: "Z"}}}, []string{"Z", "a", "ab", "b", "é"}},
+	} {
+		if got := ids(tc.query); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Invalid order for %+v: got %v, expected %v", tc.query, got, tc.expected)
+		}
+	}
+}
+
+func testAggregate(t *testing.T, newRepository Factory) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_aggregate"}
+	for _, p := range []api.DocumentProperties{
+		{"status": "open", "amount": 10},
+		{"status": "open", "amount": 5},
+		{"status": "closed", "amount": "n/a"},
+	} {
+		if _, err := tx.Add(c, p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	count := api.Aggregation{Function: api.Count}
+	sum := api.Aggregation{Function: api.Sum, Field: api.FieldPath{"properties", "amount"}}
+
+	res, err := tx.Aggregate(c, nil, api.FieldPath{"properties", "status"}, []api.Aggregation{count, sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 2 {
+		t.Fatalf("Invalid number of groups, got %v, expected 2", len(res))
+	}
+	if res[0].Group != "closed" || res[0].Values["count"] != int64(1) || res[0].Values["sum(properties.amount)"] != nil {
+		t.Errorf("Invalid group: %v", res[0])
+	}
+	if res[1].Group != "open" || res[1].Values["count"] != int64(2) || res[1].Values["sum(properties.amount)"] != 15. {
+		t.Errorf("Invalid group: %v", res[1])
+	}
+}
+
+func testRevisions(t *testing.T, newRepository Factory) {
+
+	d := api.ObjectRef{"test_revisions", "doc1"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.PatchIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err == nil {
+		t.Error("Patching a missing document should fail")
+	}
+	if err := tx.PutIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.PutIfRevision(d, api.DocumentProperties{"k": "v"}, 0); err == nil {
+		t.Error("Creating an existing document should fail")
+	}
+
+	created, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Revision == 0 {
+		t.Error("Missing revision")
+	}
+
+	if err := tx.PatchIfRevision(d, api.DocumentProperties{"k": "v2"}, created.Revision+1); err == nil {
+		t.Error("Patching with a wrong revision should fail")
+	}
+	if err := tx.PatchIfRevision(d, api.DocumentProperties{"k": "v2"}, created.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Revision <= created.Revision {
+		t.Errorf("Revision should increase, got %d after %d", patched.Revision, created.Revision)
+	}
+	if patched.Properties["k"] != "v2" {
+		t.Errorf("Invalid field 'k': got '%v', expected 'v2'", patched.Properties["k"])
+	}
+
+	if err := tx.Put(d, api.DocumentProperties{"k": "v3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteIfRevision(d, patched.Revision); err == nil {
+		t.Error("Deleting with a wrong revision should fail")
+	}
+
+	put, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.Revision <= patched.Revision {
+		t.Errorf("Revision should increase, got %d after %d", put.Revision, patched.Revision)
+	}
+	if err := tx.DeleteIfRevision(d, put.Revision); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPatchOperators(t *testing.T, newRepository Factory) {
+
+	d := api.ObjectRef{"test_patch_operators", "doc1"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	initial := api.DocumentProperties{
+		"views": 2,
+		"tags":  []interface{}{"a", "b"},
+		"old":   true,
+		"sub":   map[string]interface{}{"count": 1, "name": "n"},
+	}
+	if err := tx.Put(d, initial); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := api.DocumentProperties{
+		"views":   map[string]interface{}{"$inc": 3},
+		"likes":   map[string]interface{}{"$inc": 1.5},
+		"tags":    map[string]interface{}{"$arrayUnion": []interface{}{"b", "c", "c"}},
+		"old":     map[string]interface{}{"$delete": true},
+		"sub":     map[string]interface{}{"count": map[string]interface{}{"$inc": -1}},
+		"updated": map[string]interface{}{"$serverTimestamp": true},
+	}
+	if err := tx.Patch(d, patch); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Patch(d, api.DocumentProperties{"tags": map[string]interface{}{"$arrayRemove": []interface{}{"a"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"views": 5.0,
+		"likes": 1.5,
+		"tags":  []interface{}{"b", "c"},
+		"sub":   map[string]interface{}{"count": 0.0, "name": "n"},
+	}
+	updated, _ := patched.Properties["updated"].(string)
+	if _, err := time.Parse(api.TimestampFormat, updated); err != nil {
+		t.Errorf("Invalid server timestamp '%v': %v", patched.Properties["updated"], err)
+	}
+	delete(patched.Properties, "updated")
+	if !reflect.DeepEqual(patched.Properties, expected) {
+		t.Errorf("Invalid properties: got %v, expected %v", patched.Properties, expected)
+	}
+}
+
+func isNotFound(err error) bool {
+	e, ok := errors.Cause(err).(interface{ IsNotFound() bool })
+	return ok && e.IsNotFound()
+}
+
+func testNotFound(t *testing.T, newRepository Factory) {
+
+	c := api.ObjectRef{"test_not_found_" + api.NextID()}
+	d := api.ObjectRef{c[0], "doc1"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Get(d); !isNotFound(err) {
+		t.Errorf("Getting a missing document should fail with a not found error, got %v", err)
+	}
+
+	// Patching or deleting a missing document does nothing
+	if err := tx.Patch(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Errorf("Patching a missing document should do nothing, got %v", err)
+	}
+	if err := tx.Delete(d); err != nil {
+		t.Errorf("Deleting a missing document should do nothing, got %v", err)
+	}
+	if _, err := tx.Get(d); !isNotFound(err) {
+		t.Errorf("Patching a missing document should not create it, got %v", err)
+	}
+
+	cu, err := tx.GetAll(c, api.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := cu.Fetch(10)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cu.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(all) != 0 {
+		t.Errorf("Missing collection should be empty, got %d documents", len(all))
+	}
+
+	if err := tx.DeleteCollection(c); err != nil {
+		t.Errorf("Deleting a missing collection should do nothing, got %v", err)
+	}
+}
+
+func testCursorPaging(t *testing.T, newRepository Factory) {
+
+	c := api.ObjectRef{"test_paging"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range []string{"c", "a", "e", "b", "d"} {
+		if err := tx.Put(api.ObjectRef{c[0], id}, api.DocumentProperties{"id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cu, err := tx.GetAll(c, api.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents are sorted by ID by default
+	var ids []string
+	for _, expected := range []int{2, 2, 1, 0, 0} {
+		page, err := cu.Fetch(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != expected {
+			t.Errorf("Invalid page length, got %d, expected %d", len(page), expected)
+		}
+		for _, d := range page {
+			ids = append(ids, d.ID)
+			if d.Properties["id"] != d.ID {
+				t.Errorf("Invalid document %s: %v", d.ID, d.Properties)
+			}
+		}
+	}
+
+	if err := cu.Close(); err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{"a", "b", "c", "d", "e"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Invalid order, got %v, expected %v", ids, expected)
+	}
+}
+
+func testDeleteCollectionKeepsSubCollections(t *testing.T, newRepository Factory) {
+
+	c := api.ObjectRef{"test_delete_collection"}
+	sub := api.ObjectRef{c[0], "doc1", "sub"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.Put(api.ObjectRef{c[0], "doc1"}, api.DocumentProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(api.ObjectRef{sub[0], sub[1], sub[2], "doc2"}, api.DocumentProperties{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.DeleteCollection(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx.Get(api.ObjectRef{c[0], "doc1"}); !isNotFound(err) {
+		t.Errorf("Document of the deleted collection should not be found, got %v", err)
+	}
+	if _, err := tx.Get(api.ObjectRef{sub[0], sub[1], sub[2], "doc2"}); err != nil {
+		t.Errorf("Document of the sub-collection should be kept, got %v", err)
+	}
+}
+
+func testRollback(t *testing.T, newRepository Factory) {
+
+	d := api.ObjectRef{"test_rollback", api.NextID()}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Get(d); !isNotFound(err) {
+		t.Errorf("Rolled back document should not be found, got %v", err)
+	}
+}
+
+func testIsolation(t *testing.T, newRepository Factory) {
+
+	d := api.ObjectRef{"test_isolation", api.NextID()}
+
+	r := newRepository(t)
+
+	tx1, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx1.Rollback()
+
+	if err := tx1.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx2, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx2.Get(d); !isNotFound(err) {
+		t.Errorf("Uncommitted document should not be visible to other transactions, got %v", err)
+	}
+	cu, err := tx2.GetAll(d.Collection(), api.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := cu.Fetch(10)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := cu.Close(); err != nil {
+		t.Error(err)
+	}
+	for _, doc := range all {
+		if doc.ID == d.ID() {
+			t.Error("Uncommitted document should not be listed to other transactions")
+		}
+	}
+	if err := tx2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx3, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx3.Rollback()
+
+	res, err := tx3.Get(d)
+	if err != nil {
+		t.Fatalf("Committed document should be visible to new transactions, got %v", err)
+	}
+	if res.Properties["k"] != "v" {
+		t.Errorf("Invalid field 'k': got '%v', expected 'v'", res.Properties["k"])
+	}
+}
+
+func testCheckRevision(t *testing.T, newRepository Factory) {
+
+	c := api.ObjectRef{"test_check_revision_" + api.NextID()}
+	d := api.ObjectRef{c[0], "doc1"}
+	missing := api.ObjectRef{c[0], "missing"}
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	created, err := tx.Get(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkAndCommit checks a revision in a new transaction, and reports whether both the check and the commit succeeded
+	checkAndCommit := func(document api.ObjectRef, revision int64) bool {
+		tx, err := r.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.CheckRevision(document, revision); err != nil {
+			tx.Rollback()
+			return false
+		}
+		return tx.Commit() == nil
+	}
+
+	if !checkAndCommit(d, created.Revision) {
+		t.Error("Checking the revision of the document should succeed")
+	}
+	if checkAndCommit(d, created.Revision+1) {
+		t.Error("Checking a wrong revision should fail")
+	}
+	if checkAndCommit(d, 0) {
+		t.Error("Checking that an existing document is missing should fail")
+	}
+	if !checkAndCommit(missing, 0) {
+		t.Error("Checking that a missing document is missing should succeed")
+	}
+
+	tx1, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx1.Rollback()
+
+	if err := tx1.CheckRevision(d, created.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// The concurrent write may either wait for tx1 to end, or be committed first and make tx1 fail
+	written := make(chan error, 1)
+	go func() {
+		tx2, err := r.Begin()
+		if err != nil {
+			written <- err
+			return
+		}
+		if err := tx2.Put(d, api.DocumentProperties{"k": "v2"}); err != nil {
+			tx2.Rollback()
+			written <- err
+			return
+		}
+		written <- tx2.Commit()
+	}()
+
+	select {
+	case err := <-written:
+		if err == nil {
+			if err := tx1.Commit(); err == nil {
+				t.Error("Committing after a concurrent modification of a checked document should fail")
+			}
+		} else if err := tx1.Commit(); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		if err := tx1.Commit(); err != nil {
+			t.Errorf("Committing while the concurrent write waits should succeed, got %v", err)
+		}
+		<-written
+	}
+}
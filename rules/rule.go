@@ -1,9 +1,10 @@
 package rules
 
 type Rule struct {
-	Path  string
-	Read  Allow
-	Write Allow
+	Path   string
+	Read   Allow
+	Write  Allow
+	Schema string //JSON Schema that the properties of the documents must match when they are written
 }
 
 type Allow struct {
@@ -6,17 +6,37 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/schema"
 	"github.com/xdbsoft/gript"
 )
 
 type Checker struct {
-	rules []Rule
+	rules   []Rule
+	schemas []*schema.Schema
+	err     error
 }
 
 type RetrievalFunc func(api.ObjectRef, api.User) (api.Document, error)
 
 func NewChecker(rules []Rule) Checker {
-	return Checker{rules: rules}
+
+	c := Checker{rules: rules, schemas: make([]*schema.Schema, len(rules))}
+	for i, rule := range rules {
+		if len(rule.Schema) == 0 {
+			continue
+		}
+		s, err := schema.Parse(rule.Schema)
+		if err != nil && c.err == nil {
+			c.err = errors.Wrapf(err, "invalid schema of rule '%s'", rule.Path)
+		}
+		c.schemas[i] = s
+	}
+	return c
+}
+
+//Err returns the error of the first rule whose schema is invalid, if any
+func (c Checker) Err() error {
+	return c.err
 }
 
 func isVariable(s string) (bool, string) {
@@ -46,6 +66,7 @@ func checkCondition(condition string, variables map[string]interface{}) (bool, e
 
 type RuleCheck struct {
 	rule          Rule
+	schema        *schema.Schema
 	pathVariables map[string]interface{}
 	user          api.User
 }
@@ -54,6 +75,11 @@ func (r RuleCheck) IsValid() bool {
 	return len(r.rule.Path) > 0
 }
 
+//Path returns the path pattern of the rule
+func (r RuleCheck) Path() string {
+	return r.rule.Path
+}
+
 func (c Checker) SelectMatchingRule(target api.ObjectRef, user api.User) RuleCheck {
 
 	docTarget := target
@@ -61,7 +87,7 @@ func (c Checker) SelectMatchingRule(target api.ObjectRef, user api.User) RuleChe
 		docTarget = append(docTarget, "*")
 	}
 
-	for _, rule := range c.rules {
+	for i, rule := range c.rules {
 
 		path := strings.Split(rule.Path, "/")
 
@@ -86,6 +112,7 @@ func (c Checker) SelectMatchingRule(target api.ObjectRef, user api.User) RuleChe
 		if match {
 			return RuleCheck{
 				rule:          rule,
+				schema:        c.schemas[i],
 				pathVariables: pathVariables,
 				user:          user,
 			}
@@ -95,6 +122,28 @@ func (c Checker) SelectMatchingRule(target api.ObjectRef, user api.User) RuleChe
 	return RuleCheck{}
 }
 
+//HasSchema returns whether the properties of the documents must match the schema of the rule
+func (r RuleCheck) HasSchema() bool {
+	return len(r.rule.Schema) > 0
+}
+
+//Validate returns the violations of the schema of the rule by the properties of a document.
+//A rule with an invalid schema rejects all documents.
+func (r RuleCheck) Validate(properties api.DocumentProperties) ([]schema.Violation, error) {
+
+	if len(r.rule.Schema) == 0 {
+		return nil, nil
+	}
+	if r.schema == nil {
+		return nil, errors.New("invalid schema of rule '" + r.rule.Path + "'")
+	}
+
+	if properties == nil {
+		properties = api.DocumentProperties{}
+	}
+	return r.schema.Validate(properties), nil
+}
+
 func (r RuleCheck) RetrieveWith(a Allow, get RetrievalFunc) map[string]interface{} {
 
 	withContent := make(map[string]interface{})
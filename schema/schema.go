@@ -0,0 +1,464 @@
+//Package schema validates JSON values against a JSON Schema.
+//
+//The following keywords are supported, other keywords are ignored:
+//type, enum, const, properties, required, additionalProperties, items, minItems, maxItems, uniqueItems,
+//minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, minLength, maxLength, pattern,
+//allOf, anyOf, oneOf and not.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+//Schema is a compiled JSON Schema
+type Schema struct {
+	always *bool
+
+	types      []string
+	enum       []interface{}
+	constant   interface{}
+	hasConst   bool
+	properties map[string]*Schema
+	required   []string
+	additional *Schema
+	items      *Schema
+	minItems   *int
+	maxItems   *int
+	unique     bool
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	multipleOf *float64
+	minLength  *int
+	maxLength  *int
+	pattern    *regexp.Regexp
+	allOf      []*Schema
+	anyOf      []*Schema
+	oneOf      []*Schema
+	not        *Schema
+}
+
+//Violation is a constraint of the schema that a value does not satisfy
+type Violation struct {
+	Path    string `json:"path"` //JSON Pointer to the invalid value
+	Message string `json:"message"`
+}
+
+//Parse compiles a JSON Schema
+func Parse(s string) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	return compile(v, "")
+}
+
+func compile(v interface{}, path string) (*Schema, error) {
+
+	if b, ok := v.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("schema" + path + " must be an object or a boolean")
+	}
+
+	s := &Schema{}
+	var err error
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, e := range t {
+			name, ok := e.(string)
+			if !ok {
+				return nil, errors.New("type of schema" + path + " must be a string or an array of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, errors.New("type of schema" + path + " must be a string or an array of strings")
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, errors.New("unknown type '" + t + "' in schema" + path)
+		}
+	}
+
+	if e, found := m["enum"]; found {
+		if s.enum, ok = e.([]interface{}); !ok {
+			return nil, errors.New("enum of schema" + path + " must be an array")
+		}
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if p, found := m["properties"]; found {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("properties of schema" + path + " must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, child := range props {
+			if s.properties[name], err = compile(child, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, found := m["required"]; found {
+		names, ok := r.([]interface{})
+		if !ok {
+			return nil, errors.New("required of schema" + path + " must be an array of strings")
+		}
+		for _, n := range names {
+			name, ok := n.(string)
+			if !ok {
+				return nil, errors.New("required of schema" + path + " must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if a, found := m["additionalProperties"]; found {
+		if s.additional, err = compile(a, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if i, found := m["items"]; found {
+		if s.items, err = compile(i, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, dest := range map[string]**int{"minItems": &s.minItems, "maxItems": &s.maxItems, "minLength": &s.minLength, "maxLength": &s.maxLength} {
+		if n, found := m[keyword]; found {
+			f, ok := n.(float64)
+			if !ok || f < 0 || f != math.Trunc(f) {
+				return nil, errors.New(keyword + " of schema" + path + " must be a non-negative integer")
+			}
+			i := int(f)
+			*dest = &i
+		}
+	}
+	for keyword, dest := range map[string]**float64{"minimum": &s.minimum, "maximum": &s.maximum, "exclusiveMinimum": &s.exclMin, "exclusiveMaximum": &s.exclMax, "multipleOf": &s.multipleOf} {
+		if n, found := m[keyword]; found {
+			f, ok := n.(float64)
+			if !ok {
+				return nil, errors.New(keyword + " of schema" + path + " must be a number")
+			}
+			*dest = &f
+		}
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, errors.New("multipleOf of schema" + path + " must be strictly positive")
+	}
+
+	if u, found := m["uniqueItems"]; found {
+		if s.unique, ok = u.(bool); !ok {
+			return nil, errors.New("uniqueItems of schema" + path + " must be a boolean")
+		}
+	}
+	if p, found := m["pattern"]; found {
+		expr, ok := p.(string)
+		if !ok {
+			return nil, errors.New("pattern of schema" + path + " must be a string")
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, errors.Wrap(err, "invalid pattern of schema"+path)
+		}
+	}
+
+	for keyword, dest := range map[string]*[]*Schema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		if l, found := m[keyword]; found {
+			list, ok := l.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, errors.New(keyword + " of schema" + path + " must be a non-empty array")
+			}
+			for i, child := range list {
+				c, err := compile(child, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+				if err != nil {
+					return nil, err
+				}
+				*dest = append(*dest, c)
+			}
+		}
+	}
+	if n, found := m["not"]; found {
+		if s.not, err = compile(n, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+//Validate returns the violations of the schema by the value, which is valid if there are none
+func (s *Schema) Validate(v interface{}) []Violation {
+	return s.validate(v, "")
+}
+
+func violation(path string, format string, args ...interface{}) []Violation {
+	return []Violation{{Path: path, Message: fmt.Sprintf(format, args...)}}
+}
+
+func (s *Schema) validate(v interface{}, path string) []Violation {
+
+	if s.always != nil {
+		if *s.always {
+			return nil
+		}
+		return violation(path, "no value is allowed")
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return violation(path, "must be of type %s", strings.Join(s.types, " or "))
+	}
+
+	var res []Violation
+
+	if s.enum != nil && !contains(s.enum, v) {
+		values := make([]string, 0, len(s.enum))
+		for _, e := range s.enum {
+			b, _ := json.Marshal(e)
+			values = append(values, string(b))
+		}
+		res = append(res, violation(path, "must be one of %s", strings.Join(values, ", "))...)
+	}
+	if s.hasConst && api.Compare(s.constant, v) != 0 {
+		b, _ := json.Marshal(s.constant)
+		res = append(res, violation(path, "must be %s", b)...)
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		res = append(res, s.validateObject(value, path)...)
+	case api.DocumentProperties:
+		res = append(res, s.validateObject(value, path)...)
+	case []interface{}:
+		res = append(res, s.validateArray(value, path)...)
+	case string:
+		res = append(res, s.validateString(value, path)...)
+	default:
+		if f, ok := number(v); ok {
+			res = append(res, s.validateNumber(f, path)...)
+		}
+	}
+
+	for _, c := range s.allOf {
+		res = append(res, c.validate(v, path)...)
+	}
+	if s.anyOf != nil && s.countValid(s.anyOf, v, path) == 0 {
+		res = append(res, violation(path, "must match at least one of the schemas of anyOf")...)
+	}
+	if s.oneOf != nil && s.countValid(s.oneOf, v, path) != 1 {
+		res = append(res, violation(path, "must match exactly one of the schemas of oneOf")...)
+	}
+	if s.not != nil && len(s.not.validate(v, path)) == 0 {
+		res = append(res, violation(path, "must not match the schema of not")...)
+	}
+
+	return res
+}
+
+func (s *Schema) countValid(schemas []*Schema, v interface{}, path string) int {
+	count := 0
+	for _, c := range schemas {
+		if len(c.validate(v, path)) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	for _, t := range s.types {
+		switch value := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case map[string]interface{}, api.DocumentProperties:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		default:
+			if f, ok := number(value); ok && (t == "number" || (t == "integer" && f == math.Trunc(f))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// number returns the value of the numbers of any Go numeric type, as decoded from JSON or set by the server
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, path string) []Violation {
+
+	var res []Violation
+
+	for _, name := range s.required {
+		if _, found := m[name]; !found {
+			res = append(res, violation(path+"/"+escape(name), "is required")...)
+		}
+	}
+
+	// Properties are validated in order, so that violations are reported consistently
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := s.properties[name]
+		if child == nil {
+			child = s.additional
+		}
+		if child != nil {
+			res = append(res, child.validate(m[name], path+"/"+escape(name))...)
+		}
+	}
+
+	return res
+}
+
+func (s *Schema) validateArray(a []interface{}, path string) []Violation {
+
+	var res []Violation
+
+	if s.minItems != nil && len(a) < *s.minItems {
+		res = append(res, violation(path, "must have at least %d items", *s.minItems)...)
+	}
+	if s.maxItems != nil && len(a) > *s.maxItems {
+		res = append(res, violation(path, "must have at most %d items", *s.maxItems)...)
+	}
+	if s.unique {
+		for i := range a {
+			if contains(a[:i], a[i]) {
+				res = append(res, violation(path, "must have unique items")...)
+				break
+			}
+		}
+	}
+	if s.items != nil {
+		for i, e := range a {
+			res = append(res, s.items.validate(e, fmt.Sprintf("%s/%d", path, i))...)
+		}
+	}
+
+	return res
+}
+
+func (s *Schema) validateNumber(f float64, path string) []Violation {
+
+	var res []Violation
+
+	if s.minimum != nil && f < *s.minimum {
+		res = append(res, violation(path, "must be greater than or equal to %v", *s.minimum)...)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		res = append(res, violation(path, "must be less than or equal to %v", *s.maximum)...)
+	}
+	if s.exclMin != nil && f <= *s.exclMin {
+		res = append(res, violation(path, "must be greater than %v", *s.exclMin)...)
+	}
+	if s.exclMax != nil && f >= *s.exclMax {
+		res = append(res, violation(path, "must be less than %v", *s.exclMax)...)
+	}
+	if s.multipleOf != nil {
+		if q := f / *s.multipleOf; q != math.Trunc(q) {
+			res = append(res, violation(path, "must be a multiple of %v", *s.multipleOf)...)
+		}
+	}
+
+	return res
+}
+
+func (s *Schema) validateString(str string, path string) []Violation {
+
+	var res []Violation
+
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		res = append(res, violation(path, "must have at least %d characters", *s.minLength)...)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		res = append(res, violation(path, "must have at most %d characters", *s.maxLength)...)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		res = append(res, violation(path, "must match the pattern '%s'", s.pattern)...)
+	}
+
+	return res
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if api.Compare(e, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//escape escapes a property name as a JSON Pointer reference token
+func escape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,164 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+func TestParse_Invalid(t *testing.T) {
+
+	for _, s := range []string{
+		`not json`,
+		`"string"`,
+		`{"type": 1}`,
+		`{"type": ["string", 1]}`,
+		`{"type": "text"}`,
+		`{"enum": "a"}`,
+		`{"properties": []}`,
+		`{"properties": {"a": 1}}`,
+		`{"required": "a"}`,
+		`{"required": [1]}`,
+		`{"additionalProperties": "no"}`,
+		`{"items": 1}`,
+		`{"minItems": -1}`,
+		`{"maxItems": 1.5}`,
+		`{"minLength": "1"}`,
+		`{"maxLength": -2}`,
+		`{"minimum": "0"}`,
+		`{"exclusiveMaximum": true}`,
+		`{"multipleOf": 0}`,
+		`{"multipleOf": -2}`,
+		`{"uniqueItems": 1}`,
+		`{"pattern": 1}`,
+		`{"pattern": "("}`,
+		`{"allOf": []}`,
+		`{"anyOf": {}}`,
+		`{"oneOf": [1]}`,
+		`{"not": "a"}`,
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parsing %s should fail", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	for _, tc := range []struct {
+		schema   string
+		value    interface{}
+		expected []Violation
+	}{
+		// Boolean schemas
+		{`true`, "any", nil},
+		{`false`, "any", []Violation{{"", "no value is allowed"}}},
+
+		// type
+		{`{"type": "null"}`, nil, nil},
+		{`{"type": "null"}`, false, []Violation{{"", "must be of type null"}}},
+		{`{"type": "boolean"}`, true, nil},
+		{`{"type": "boolean"}`, "true", []Violation{{"", "must be of type boolean"}}},
+		{`{"type": "object"}`, map[string]interface{}{}, nil},
+		{`{"type": "object"}`, api.DocumentProperties{}, nil},
+		{`{"type": "object"}`, []interface{}{}, []Violation{{"", "must be of type object"}}},
+		{`{"type": "array"}`, []interface{}{}, nil},
+		{`{"type": "array"}`, map[string]interface{}{}, []Violation{{"", "must be of type array"}}},
+		{`{"type": "string"}`, "s", nil},
+		{`{"type": "string"}`, 1., []Violation{{"", "must be of type string"}}},
+		{`{"type": "number"}`, 1.5, nil},
+		{`{"type": "number"}`, "1.5", []Violation{{"", "must be of type number"}}},
+		{`{"type": "integer"}`, 2., nil},
+		{`{"type": "integer"}`, 2.5, []Violation{{"", "must be of type integer"}}},
+		{`{"type": ["string", "null"]}`, nil, nil},
+		{`{"type": ["string", "null"]}`, 1., []Violation{{"", "must be of type string or null"}}},
+
+		// Numbers of any Go type
+		{`{"type": "integer", "maximum": 5}`, int(3), nil},
+		{`{"type": "integer", "maximum": 5}`, int8(3), nil},
+		{`{"type": "integer", "maximum": 5}`, int16(3), nil},
+		{`{"type": "integer", "maximum": 5}`, int32(3), nil},
+		{`{"type": "integer", "maximum": 5}`, int64(6), []Violation{{"", "must be less than or equal to 5"}}},
+		{`{"type": "integer", "maximum": 5}`, uint(3), nil},
+		{`{"type": "integer", "maximum": 5}`, uint8(3), nil},
+		{`{"type": "integer", "maximum": 5}`, uint16(3), nil},
+		{`{"type": "integer", "maximum": 5}`, uint32(3), nil},
+		{`{"type": "integer", "maximum": 5}`, uint64(6), []Violation{{"", "must be less than or equal to 5"}}},
+		{`{"type": "number", "maximum": 5}`, float32(4.5), nil},
+		{`{"type": "integer", "maximum": 5}`, json.Number("3"), nil},
+		{`{"type": "integer"}`, json.Number("3.5"), []Violation{{"", "must be of type integer"}}},
+
+		// enum and const
+		{`{"enum": ["a", 1, null]}`, 1., nil},
+		{`{"enum": ["a", 1, null]}`, nil, nil},
+		{`{"enum": ["a", 1, null]}`, "b", []Violation{{"", `must be one of "a", 1, null`}}},
+		{`{"const": {"k": [1, 2]}}`, map[string]interface{}{"k": []interface{}{1., 2.}}, nil},
+		{`{"const": {"k": [1, 2]}}`, map[string]interface{}{"k": []interface{}{2., 1.}}, []Violation{{"", `must be {"k":[1,2]}`}}},
+
+		// Objects
+		{`{"required": ["a", "b/c"]}`, map[string]interface{}{"a": 1.}, []Violation{{"/b~1c", "is required"}}},
+		{`{"required": ["a"]}`, "not an object", nil},
+		{`{"properties": {"a": {"type": "string"}}}`, map[string]interface{}{"a": "s", "b": 1.}, nil},
+		{`{"properties": {"a": {"type": "string"}}}`, map[string]interface{}{"a": 1.}, []Violation{{"/a", "must be of type string"}}},
+		{`{"properties": {"a": {"type": "string"}}, "additionalProperties": false}`, map[string]interface{}{"a": "s", "b": 1.}, []Violation{{"/b", "no value is allowed"}}},
+		{`{"additionalProperties": {"type": "number"}}`, map[string]interface{}{"b": 1., "a~b": "s"}, []Violation{{"/a~0b", "must be of type number"}}},
+		{`{"properties": {"a": {"properties": {"b": {"type": "null"}}}}}`, api.DocumentProperties{"a": map[string]interface{}{"b": 1.}}, []Violation{{"/a/b", "must be of type null"}}},
+
+		// Arrays
+		{`{"minItems": 2}`, []interface{}{1.}, []Violation{{"", "must have at least 2 items"}}},
+		{`{"minItems": 2}`, []interface{}{1., 2.}, nil},
+		{`{"maxItems": 1}`, []interface{}{1., 2.}, []Violation{{"", "must have at most 1 items"}}},
+		{`{"maxItems": 1}`, []interface{}{}, nil},
+		{`{"uniqueItems": true}`, []interface{}{1., "1", 2.}, nil},
+		{`{"uniqueItems": true}`, []interface{}{1., 2., 1.}, []Violation{{"", "must have unique items"}}},
+		{`{"uniqueItems": false}`, []interface{}{1., 1.}, nil},
+		{`{"items": {"type": "string"}}`, []interface{}{"a", 1., "b", true}, []Violation{{"/1", "must be of type string"}, {"/3", "must be of type string"}}},
+
+		// Numbers
+		{`{"minimum": 2}`, 2., nil},
+		{`{"minimum": 2}`, 1., []Violation{{"", "must be greater than or equal to 2"}}},
+		{`{"maximum": 2}`, 2., nil},
+		{`{"maximum": 2}`, 3., []Violation{{"", "must be less than or equal to 2"}}},
+		{`{"exclusiveMinimum": 2}`, 2.5, nil},
+		{`{"exclusiveMinimum": 2}`, 2., []Violation{{"", "must be greater than 2"}}},
+		{`{"exclusiveMaximum": 2}`, 1.5, nil},
+		{`{"exclusiveMaximum": 2}`, 2., []Violation{{"", "must be less than 2"}}},
+		{`{"multipleOf": 0.5}`, 2.5, nil},
+		{`{"multipleOf": 0.5}`, 2.2, []Violation{{"", "must be a multiple of 0.5"}}},
+		{`{"minimum": 2}`, "1", nil},
+
+		// Strings
+		{`{"minLength": 2}`, "é!", nil},
+		{`{"minLength": 2}`, "é", []Violation{{"", "must have at least 2 characters"}}},
+		{`{"maxLength": 2}`, "éé", nil},
+		{`{"maxLength": 2}`, "abc", []Violation{{"", "must have at most 2 characters"}}},
+		{`{"pattern": "^[a-z]+$"}`, "abc", nil},
+		{`{"pattern": "^[a-z]+$"}`, "aBc", []Violation{{"", "must match the pattern '^[a-z]+$'"}}},
+		{`{"pattern": "^[a-z]+$"}`, 1., nil},
+
+		// Combinations
+		{`{"allOf": [{"minimum": 1}, {"maximum": 3}]}`, 2., nil},
+		{`{"allOf": [{"minimum": 1}, {"maximum": 3}]}`, 4., []Violation{{"", "must be less than or equal to 3"}}},
+		{`{"anyOf": [{"type": "string"}, {"type": "null"}]}`, nil, nil},
+		{`{"anyOf": [{"type": "string"}, {"type": "null"}]}`, 1., []Violation{{"", "must match at least one of the schemas of anyOf"}}},
+		{`{"oneOf": [{"type": "integer"}, {"minimum": 2}]}`, 1., nil},
+		{`{"oneOf": [{"type": "integer"}, {"minimum": 2}]}`, 3., []Violation{{"", "must match exactly one of the schemas of oneOf"}}},
+		{`{"oneOf": [{"type": "integer"}, {"minimum": 2}]}`, 0.5, []Violation{{"", "must match exactly one of the schemas of oneOf"}}},
+		{`{"not": {"type": "null"}}`, 1., nil},
+		{`{"not": {"type": "null"}}`, nil, []Violation{{"", "must not match the schema of not"}}},
+
+		// Unknown keywords are ignored
+		{`{"format": "email"}`, "not an email", nil},
+	} {
+		s, err := Parse(tc.schema)
+		if err != nil {
+			t.Errorf("%s: %v", tc.schema, err)
+			continue
+		}
+		if got := s.Validate(tc.value); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s with %#v: expected %v, got %v", tc.schema, tc.value, tc.expected, got)
+		}
+	}
+}
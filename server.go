@@ -2,11 +2,10 @@ package grest
 
 import (
 	"crypto/sha1"
-	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,14 +15,18 @@ import (
 
 	"github.com/xdbsoft/grest/api"
 	"github.com/xdbsoft/grest/oidc"
-	"github.com/xdbsoft/grest/postgresql"
 	"github.com/xdbsoft/grest/rules"
 )
 
 // Server instantiate a new grest server
 func Server(cfg Config) (http.Handler, error) {
 
-	r, err := postgresql.New(cfg.DBConnStr)
+	checker := rules.NewChecker(cfg.Rules)
+	if err := checker.Err(); err != nil {
+		return nil, err
+	}
+
+	r, err := newRepository(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +48,17 @@ func Server(cfg Config) (http.Handler, error) {
 	s := server{
 		Authenticator:  a,
 		DataRepository: r,
-		RuleChecker:    rules.NewChecker(cfg.Rules),
+		RuleChecker:    checker,
+		HideForbidden:  cfg.HideForbidden,
+	}
+
+	err = s.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	if p, ok := r.(api.Purger); ok && cfg.SoftDelete {
+		go purge(p)
 	}
 
 	return &s, nil
@@ -55,61 +68,142 @@ type server struct {
 	Authenticator  api.Authenticator
 	DataRepository api.Repository
 	RuleChecker    rules.Checker
+	Changes        changeBroker
+	Transactions   transactionRegistry
+	HideForbidden  bool
 }
 
-func getLimit(limitString string) int {
+// defaultLimit is the maximum number of documents of a collection listing
+const defaultLimit = 100
 
-	limit := 100
+func getLimit(limitString string) (int, error) {
+
+	limit := defaultLimit
 	limitValue, err := strconv.Atoi(limitString)
+	if err == nil && limitValue < 0 {
+		return 0, badRequest("Invalid limit: must not be negative")
+	}
 	if err == nil && limitValue < limit {
 		limit = limitValue
 	}
-	return limit
+	return limit, nil
 }
-func getOrderBy(orderByString string) []string {
+func getOrderBy(orderByString string) ([]api.Order, error) {
 	if len(orderByString) == 0 {
-		return nil
+		return nil, nil
+	}
+
+	items := strings.Split(orderByString, ",")
+	orderBy := make([]api.Order, len(items))
+	for i := range items {
+		o, err := api.ParseOrder(items[i])
+		if err != nil {
+			return nil, badRequest("Invalid orderBy: " + err.Error())
+		}
+		orderBy[i] = o
+	}
+	return orderBy, nil
+}
+
+func getAggregations(aggregateString string) ([]api.Aggregation, error) {
+
+	items := strings.Split(aggregateString, ",")
+	aggregations := make([]api.Aggregation, len(items))
+	for i := range items {
+		a, err := api.ParseAggregation(items[i])
+		if err != nil {
+			return nil, badRequest("Invalid aggregate: " + err.Error())
+		}
+		aggregations[i] = a
+	}
+	return aggregations, nil
+}
+
+func getGroupBy(groupByString string) (api.FieldPath, error) {
+	if len(groupByString) == 0 {
+		return nil, nil
+	}
+
+	f, err := api.ParseFieldPath(groupByString)
+	if err != nil {
+		return nil, badRequest("Invalid groupBy: " + err.Error())
+	}
+	if !f.IsProperty() {
+		return nil, badRequest("Invalid groupBy: only properties can be used to group documents")
 	}
-	return strings.Split(orderByString, ",")
+	return f, nil
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	r = withRequestID(w, r)
+
 	user, err := s.authenticate(r)
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	target, err := s.getTarget(r)
+	switch {
+	case r.URL.Path == webSocketPath:
+		s.serveWebSocket(w, r, user)
+		return
+	case r.URL.Path == batchPath:
+		s.serveBatch(w, r, user)
+		return
+	case r.URL.Path == transactionsPath || strings.HasPrefix(r.URL.Path, transactionsPath+"/"):
+		s.serveTransactions(w, r, user)
+		return
+	}
+
+	target, err := getTarget(r.URL.Path)
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
+	if r.Method == "GET" && r.FormValue("watch") == "true" {
+		s.watch(w, r, target, user)
+		return
+	}
+
+	if id := r.FormValue("transaction"); len(id) > 0 {
+		s.serveInTransaction(w, r, id, target, user)
+		return
+	}
+
 	var data interface{}
+	var written *api.Document
 
 	if target.IsDocument() {
 
 		switch r.Method {
 		case "GET":
-			data, err = s.GetDocument(target, user)
+			data, err = s.readDocument(r, target, user)
 		case "PUT":
 			var payload api.Document
 			if err := getPayload(r, &payload); err != nil {
 				handleError(w, r, err)
 				return
 			}
-			err = s.PutDocument(target, payload, user)
+			var doc api.Document
+			doc, err = s.PutDocument(target, payload, getPreconditions(r), user)
+			written = &doc
 		case "POST", "PATCH":
-			payload := make(api.DocumentProperties)
-			if err := getPayload(r, &payload); err != nil {
+			if r.Method == "POST" && r.FormValue("restore") == "true" {
+				data, err = s.RestoreDocument(target, user)
+				break
+			}
+			var payload patch
+			if err := getPatch(r, &payload); err != nil {
 				handleError(w, r, err)
 				return
 			}
-			err = s.PatchDocument(target, payload, user)
+			var doc api.Document
+			doc, err = s.PatchDocument(target, payload, getPreconditions(r), user)
+			written = &doc
 		case "DELETE":
-			err = s.DeleteDocument(target, user)
+			err = s.DeleteDocument(target, getPreconditions(r), user)
 		default:
 			handleError(w, r, badRequest("unsupported method"))
 			return
@@ -117,10 +211,8 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 
 		switch r.Method {
-		case "GET":
-			limit := getLimit(r.FormValue("limit"))
-			orderBy := getOrderBy(r.FormValue("orderBy"))
-			data, err = s.GetCollection(target, limit, orderBy, user)
+		case "GET", "HEAD":
+			data, err = s.readCollection(w, r, target, user)
 		case "POST":
 			payload := make(api.DocumentProperties)
 			if err := getPayload(r, &payload); err != nil {
@@ -141,15 +233,100 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if written != nil {
+		// The ETag of the written document allows the client to perform its next conditional write
+		if etag, err := s.computeEtag(*written); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
 	s.handleResponse(w, r, data)
 }
 
+func (s *server) readDocument(r *http.Request, target api.ObjectRef, user api.User) (interface{}, error) {
+
+	if r.FormValue("history") == "true" {
+		return s.GetDocumentHistory(target, user)
+	}
+
+	if asOfString := r.FormValue("asOf"); len(asOfString) > 0 {
+		asOf, err := time.Parse(time.RFC3339, asOfString)
+		if err != nil {
+			return nil, badRequest("Invalid asOf: " + err.Error())
+		}
+		return s.GetDocumentAsOf(target, asOf, user)
+	}
+
+	return s.GetDocument(target, user)
+}
+
+func (s *server) readCollection(w http.ResponseWriter, r *http.Request, target api.ObjectRef, user api.User) (interface{}, error) {
+
+	if r.FormValue("trash") == "true" {
+		return s.GetTrash(target, user)
+	}
+
+	filter, err := getFilter(r.FormValue("where"))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method == "HEAD" || r.FormValue("count") == "true" {
+		count, err := s.CountCollection(target, filter, user)
+		if err != nil {
+			return nil, err
+		}
+		w.Header().Set("X-Total-Count", strconv.FormatInt(count.Count, 10))
+		return count, nil
+	}
+
+	if aggregate := r.FormValue("aggregate"); len(aggregate) > 0 {
+		aggregations, err := getAggregations(aggregate)
+		if err != nil {
+			return nil, err
+		}
+		groupBy, err := getGroupBy(r.FormValue("groupBy"))
+		if err != nil {
+			return nil, err
+		}
+		return s.AggregateCollection(target, filter, groupBy, aggregations, user)
+	}
+
+	query := api.Query{Filter: filter}
+	query.OrderBy, err = getOrderBy(r.FormValue("orderBy"))
+	if err != nil {
+		return nil, err
+	}
+	query.StartAfter, err = getStartAfter(r.FormValue("pageToken"), query.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := getLimit(r.FormValue("limit"))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.GetCollection(target, limit, query, user)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := data.(api.Collection); ok && len(c.NextPageToken) > 0 {
+		w.Header().Set("Link", nextPageLink(r, c.NextPageToken))
+	}
+	return data, nil
+}
+
 func (s *server) authenticate(r *http.Request) (api.User, error) {
 	if s.Authenticator == nil {
 		return api.User{}, nil
 	}
 
-	return s.Authenticator.Authenticate(r)
+	user, err := s.Authenticator.Authenticate(r)
+	if IsNotAuthorized(err) {
+		return api.User{}, notAuthorizedError{}
+	}
+	return user, err
 }
 
 func getPayload(r *http.Request, payload interface{}) error {
@@ -164,9 +341,9 @@ func getPayload(r *http.Request, payload interface{}) error {
 	return nil
 }
 
-func (s *server) getTarget(r *http.Request) (api.ObjectRef, error) {
+func getTarget(path string) (api.ObjectRef, error) {
 
-	items := strings.Split(r.URL.Path, "/")
+	items := strings.Split(path, "/")
 	if len(items) > 0 && len(items[0]) == 0 {
 		items = items[1:]
 	}
@@ -181,15 +358,51 @@ func (s *server) getTarget(r *http.Request) (api.ObjectRef, error) {
 	return api.ObjectRef(items), nil
 }
 
+// computeEtag returns the ETag of a response. It is the revision for documents, and is computed
+// from the IDs and revisions of the documents for collections, unless the datastore does not support revisions.
 func (s *server) computeEtag(data interface{}) (string, error) {
 
 	h := sha1.New()
-	enc := gob.NewEncoder(h)
-	err := enc.Encode(data)
+
+	switch d := data.(type) {
+	case api.Document:
+		if d.Revision > 0 {
+			return `"` + strconv.FormatInt(d.Revision, 10) + `"`, nil
+		}
+	case api.Collection:
+		withRevisions := true
+		for _, f := range d.Features {
+			if f.Revision == 0 {
+				withRevisions = false
+				break
+			}
+		}
+		if withRevisions {
+			for _, f := range d.Features {
+				fmt.Fprintf(h, "%s:%d\n", f.ID, f.Revision)
+			}
+			return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+		}
+	}
+
+	if err := json.NewEncoder(h).Encode(data); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// collectionEtag returns the ETag of a page of a collection. As the same documents may be listed in the pages
+// of other collections or of other sizes, it also depends on the path, the limit and the page token of the request.
+func (s *server) collectionEtag(r *http.Request, c api.Collection) (string, error) {
+
+	etag, err := s.computeEtag(c)
 	if err != nil {
 		return "", err
 	}
 
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n", r.URL.Path, r.FormValue("limit"), r.FormValue("pageToken"), c.NextPageToken, etag)
 	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
 }
 
@@ -200,7 +413,13 @@ func (s *server) handleResponse(w http.ResponseWriter, r *http.Request, data int
 	} else {
 
 		// Handle ETag / If-None-Match
-		etag, err := s.computeEtag(data)
+		var etag string
+		var err error
+		if c, ok := data.(api.Collection); ok {
+			etag, err = s.collectionEtag(r, c)
+		} else {
+			etag, err = s.computeEtag(data)
+		}
 		if err == nil && len(etag) > 0 {
 			w.Header().Set("ETag", etag)
 
@@ -229,6 +448,10 @@ func (s *server) handleResponse(w http.ResponseWriter, r *http.Request, data int
 		}
 		w.WriteHeader(statusCode)
 
+		if r.Method == "HEAD" {
+			return
+		}
+
 		encoder := json.NewEncoder(w)
 
 		print := r.FormValue("print")
@@ -244,34 +467,68 @@ func (s *server) handleResponse(w http.ResponseWriter, r *http.Request, data int
 	}
 }
 
-func handleError(w http.ResponseWriter, r *http.Request, err error) {
+// validateContent checks the properties of a document against the schema of its rule
+func validateContent(r rules.RuleCheck, target api.ObjectRef, properties api.DocumentProperties) error {
+
+	violations, err := r.Validate(properties)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return invalidContentError{target, violations}
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status code and the message to send to the client for the error
+func errorStatus(err error) (int, string) {
 
-	log.Println("Error: ", err)
 	cause := errors.Cause(err)
 
 	if IsBadRequest(cause) {
-		http.Error(w, cause.Error(), http.StatusBadRequest)
-		return
+		return http.StatusBadRequest, cause.Error()
 	}
 
 	if IsNotAuthorized(cause) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return http.StatusUnauthorized, "Unauthorized"
 	}
 
 	if IsNotFound(cause) {
-		http.Error(w, "Data not found", http.StatusNotFound)
-		return
+		return http.StatusNotFound, "Data not found"
+	}
+
+	if IsPreconditionFailed(cause) {
+		return http.StatusPreconditionFailed, "Precondition failed"
+	}
+
+	if IsConflict(cause) {
+		return http.StatusConflict, "Conflict"
+	}
+
+	if IsForbidden(cause) {
+		return http.StatusForbidden, "Forbidden"
+	}
+
+	if IsInvalidContent(cause) {
+		return http.StatusUnprocessableEntity, "Invalid content"
 	}
 
-	http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if IsTooManyRequests(cause) {
+		return http.StatusTooManyRequests, "Too many requests"
+	}
+
+	if IsUnavailable(cause) {
+		return http.StatusServiceUnavailable, "Service unavailable"
+	}
+
+	return http.StatusInternalServerError, "Internal server error"
 }
 
 func (s *server) GetRuleAndCheckPath(target api.ObjectRef, user api.User, isWrite bool) (rules.RuleCheck, error) {
 	r := s.RuleChecker.SelectMatchingRule(target, user)
 
 	if !r.IsValid() {
-		return rules.RuleCheck{}, notAuthorizedError{target}
+		return rules.RuleCheck{}, s.denied(target, r, user, isWrite)
 	}
 
 	ok, err := r.CheckPath(isWrite, s.GetDocument)
@@ -279,18 +536,24 @@ func (s *server) GetRuleAndCheckPath(target api.ObjectRef, user api.User, isWrit
 		return rules.RuleCheck{}, err
 	}
 	if !ok {
-		return rules.RuleCheck{}, notAuthorizedError{target}
+		return rules.RuleCheck{}, s.denied(target, r, user, isWrite)
 	}
 
 	return r, nil
 }
 
-func (s *server) GetDocument(target api.ObjectRef, user api.User) (api.Document, error) {
+// denied returns the error reporting that the rule denies the access to the target.
+// Anonymous users are asked to authenticate, and the existence of the documents that a user is not allowed to read
+// is hidden if configured.
+func (s *server) denied(target api.ObjectRef, r rules.RuleCheck, user api.User, isWrite bool) error {
 
-	r, err := s.GetRuleAndCheckPath(target, user, false)
-	if err != nil {
-		return api.Document{}, err
+	if len(user.ID) == 0 && s.Authenticator != nil {
+		return notAuthorizedError{target, r.Path()}
 	}
+	return forbiddenError{target, r.Path(), s.HideForbidden && !isWrite}
+}
+
+func (s *server) GetDocument(target api.ObjectRef, user api.User) (api.Document, error) {
 
 	tx, err := s.DataRepository.Begin()
 	if err != nil {
@@ -304,6 +567,21 @@ func (s *server) GetDocument(target api.ObjectRef, user api.User) (api.Document,
 		}
 	}()
 
+	data, err := s.getDocument(tx, target, user)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	return data, nil
+}
+
+func (s *server) getDocument(tx api.Transaction, target api.ObjectRef, user api.User) (api.Document, error) {
+
+	r, err := s.GetRuleAndCheckPath(target, user, false)
+	if err != nil {
+		return api.Document{}, err
+	}
+
 	data, err := tx.Get(target)
 	if err != nil {
 		return api.Document{}, err
@@ -314,13 +592,13 @@ func (s *server) GetDocument(target api.ObjectRef, user api.User) (api.Document,
 		return api.Document{}, err
 	}
 	if !ok {
-		return api.Document{}, notAuthorizedError{target}
+		return api.Document{}, s.denied(target, r, user, false)
 	}
 
 	return data, nil
 }
 
-func (s *server) GetCollection(target api.ObjectRef, limit int, orderBy []string, user api.User) (interface{}, error) {
+func (s *server) GetCollection(target api.ObjectRef, limit int, query api.Query, user api.User) (interface{}, error) {
 
 	r, err := s.GetRuleAndCheckPath(target, user, false)
 	if err != nil {
@@ -339,7 +617,7 @@ func (s *server) GetCollection(target api.ObjectRef, limit int, orderBy []string
 		}
 	}()
 
-	cu, err := tx.GetAll(target, orderBy)
+	cu, err := tx.GetAll(target, query)
 	if err != nil {
 		return nil, err
 	}
@@ -351,7 +629,8 @@ func (s *server) GetCollection(target api.ObjectRef, limit int, orderBy []string
 
 	checker := r.PrepareCheckContent(false, s.GetDocument)
 
-	for len(c.Features) < limit {
+	// One more document than requested is looked for, to know whether there is a next page
+	for len(c.Features) <= limit {
 
 		fetched, err := cu.Fetch(10)
 		if err != nil {
@@ -366,7 +645,7 @@ func (s *server) GetCollection(target api.ObjectRef, limit int, orderBy []string
 
 			if ok {
 				c.Features = append(c.Features, f)
-				if len(c.Features) == limit {
+				if len(c.Features) > limit {
 					break
 				}
 			}
@@ -376,19 +655,29 @@ func (s *server) GetCollection(target api.ObjectRef, limit int, orderBy []string
 		}
 	}
 
+	if len(c.Features) > limit {
+		c.Features = c.Features[:limit]
+		if limit > 0 {
+			c.NextPageToken, err = encodePageToken(c.Features[limit-1], query.OrderBy)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return c, nil
 }
 
-func (s *server) AddDocument(target api.ObjectRef, payload api.DocumentProperties, user api.User) (interface{}, error) {
+func (s *server) AggregateCollection(target api.ObjectRef, filter api.Filter, groupBy api.FieldPath, aggregations []api.Aggregation, user api.User) (api.Aggregates, error) {
 
-	r, err := s.GetRuleAndCheckPath(target, user, true)
+	r, err := s.GetRuleAndCheckPath(target, user, false)
 	if err != nil {
-		return nil, err
+		return api.Aggregates{}, err
 	}
 
 	tx, err := s.DataRepository.Begin()
 	if err != nil {
-		return nil, err
+		return api.Aggregates{}, err
 	}
 	defer func() {
 		if err == nil {
@@ -398,49 +687,129 @@ func (s *server) AddDocument(target api.ObjectRef, payload api.DocumentPropertie
 		}
 	}()
 
-	t := time.Now()
-	newDoc := api.Document{
-		ID:                   "*",
-		CreationDate:         t,
-		LastModificationDate: t,
-		Properties:           payload,
+	a := api.Aggregates{
+		ID:      target.ID(),
+		GroupBy: groupBy.String(),
 	}
 
-	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(api.Document{}, newDoc)
+	checker := r.PrepareCheckContent(false, s.GetDocument)
+
+	if len(checker.IfContent) == 0 {
+		// All documents matching the filter are readable: the aggregation is delegated to the datastore
+		a.Results, err = tx.Aggregate(target, filter, groupBy, aggregations)
+		if err != nil {
+			return api.Aggregates{}, err
+		}
+		return a, nil
+	}
+
+	// Readability depends on the content: only the readable documents are aggregated
+	cu, err := tx.GetAll(target, api.Query{Filter: filter})
 	if err != nil {
-		return nil, err
+		return api.Aggregates{}, err
 	}
-	if !ok {
-		return nil, notAuthorizedError{target}
+	defer cu.Close()
+
+	agg := api.NewAggregator(groupBy, aggregations)
+	for {
+		fetched, err := cu.Fetch(10)
+		if err != nil {
+			return api.Aggregates{}, err
+		}
+		if len(fetched) == 0 {
+			break
+		}
+		for _, f := range fetched {
+			ok, err := checker.Check(f, api.Document{})
+			if err != nil {
+				return api.Aggregates{}, err
+			}
+			if ok {
+				agg.Add(f)
+			}
+		}
+	}
+	a.Results = agg.Results()
+
+	return a, nil
+}
+
+func (s *server) CountCollection(target api.ObjectRef, filter api.Filter, user api.User) (api.CollectionCount, error) {
+
+	count := api.Aggregation{Function: api.Count}
+
+	a, err := s.AggregateCollection(target, filter, nil, []api.Aggregation{count}, user)
+	if err != nil {
+		return api.CollectionCount{}, err
+	}
+
+	c := api.CollectionCount{
+		ID: target.ID(),
+	}
+	if len(a.Results) > 0 {
+		c.Count, _ = a.Results[0].Values[count.String()].(int64)
 	}
 
-	doc, err := tx.Add(target, newDoc.Properties)
+	return c, nil
+}
+
+func (s *server) AddDocument(target api.ObjectRef, payload api.DocumentProperties, user api.User) (interface{}, error) {
+
+	tx, err := s.DataRepository.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
 
-	err = tx.Commit()
+	doc, err := s.addDocument(tx, target, payload, user)
 	if err != nil {
 		return nil, err
 	}
 
-	return doc, nil
+	return doc, tx.Commit()
 }
 
-func (s *server) PutDocument(target api.ObjectRef, payload api.Document, user api.User) error {
+func (s *server) addDocument(tx api.Transaction, target api.ObjectRef, payload api.DocumentProperties, user api.User) (api.Document, error) {
 
-	if payload.ID != target.ID() {
-		return badRequest("Invalid ID")
+	r, err := s.GetRuleAndCheckPath(target, user, true)
+	if err != nil {
+		return api.Document{}, err
 	}
 
-	r, err := s.GetRuleAndCheckPath(target, user, true)
+	t := time.Now()
+	newDoc := api.Document{
+		ID:                   "*",
+		CreationDate:         t,
+		LastModificationDate: t,
+		Properties:           payload,
+	}
+
+	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(api.Document{}, newDoc)
 	if err != nil {
-		return err
+		return api.Document{}, err
+	}
+	if !ok {
+		return api.Document{}, s.denied(target, r, user, true)
 	}
 
+	if err := validateContent(r, target, newDoc.Properties); err != nil {
+		return api.Document{}, err
+	}
+
+	return tx.Add(target, newDoc.Properties)
+}
+
+func (s *server) PutDocument(target api.ObjectRef, payload api.Document, cond preconditions, user api.User) (api.Document, error) {
+
 	tx, err := s.DataRepository.Begin()
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 	defer func() {
 		if err == nil {
@@ -450,6 +819,25 @@ func (s *server) PutDocument(target api.ObjectRef, payload api.Document, user ap
 		}
 	}()
 
+	written, err := s.putDocument(tx, target, payload, cond, user)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	return written, tx.Commit()
+}
+
+func (s *server) putDocument(tx api.Transaction, target api.ObjectRef, payload api.Document, cond preconditions, user api.User) (api.Document, error) {
+
+	if payload.ID != target.ID() {
+		return api.Document{}, badRequest("Invalid ID")
+	}
+
+	r, err := s.GetRuleAndCheckPath(target, user, true)
+	if err != nil {
+		return api.Document{}, err
+	}
+
 	t := time.Now()
 	newDoc := api.Document{
 		ID:                   target.ID(),
@@ -459,114 +847,131 @@ func (s *server) PutDocument(target api.ObjectRef, payload api.Document, user ap
 	}
 
 	data, err := tx.Get(target)
-	if IsNotFound(err) {
+	exists := err == nil
+	if exists {
 		newDoc.CreationDate = data.CreationDate
-	} else if err != nil {
-		return err
+	} else if !IsNotFound(err) {
+		return api.Document{}, err
+	}
+
+	err = cond.check(s, target, data, exists)
+	if err != nil {
+		return api.Document{}, err
 	}
 
 	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(data, newDoc)
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 	if !ok {
-		return notAuthorizedError{target}
+		return api.Document{}, s.denied(target, r, user, true)
+	}
+
+	if err := validateContent(r, target, newDoc.Properties); err != nil {
+		return api.Document{}, err
 	}
 
-	err = tx.Put(target, newDoc.Properties)
+	if cond.isSet() {
+		// The write only succeeds if the document has not been modified since the preconditions were checked
+		err = tx.PutIfRevision(target, newDoc.Properties, data.Revision)
+	} else {
+		err = tx.Put(target, newDoc.Properties)
+	}
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 
-	return tx.Commit()
+	return tx.Get(target)
 }
 
-func patchPayload(data, patch map[string]interface{}) map[string]interface{} {
-
-	res := make(map[string]interface{})
-
-	for k := range data {
-
-		if patched, found := patch[k]; found {
-
-			dataChild, dataOk := data[k].(map[string]interface{})
-			patchChild, patchOk := patched.(map[string]interface{})
-			if dataOk && patchOk {
-				res[k] = patchPayload(dataChild, patchChild)
-			} else {
-				res[k] = patched
-			}
-
-		} else {
-			res[k] = data[k]
-		}
+func (s *server) PatchDocument(target api.ObjectRef, payload patch, cond preconditions, user api.User) (api.Document, error) {
 
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return api.Document{}, err
 	}
-
-	for k := range patch {
-		if _, found := data[k]; found {
-			continue
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
 		}
+	}()
 
-		res[k] = patch[k]
+	written, err := s.patchDocument(tx, target, payload, cond, user)
+	if err != nil {
+		return api.Document{}, err
 	}
 
-	return res
+	return written, tx.Commit()
 }
 
-func (s *server) PatchDocument(target api.ObjectRef, payload api.DocumentProperties, user api.User) error {
+func (s *server) patchDocument(tx api.Transaction, target api.ObjectRef, payload patch, cond preconditions, user api.User) (api.Document, error) {
 
 	r, err := s.GetRuleAndCheckPath(target, user, true)
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 
-	tx, err := s.DataRepository.Begin()
+	data, err := tx.Get(target)
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
-	defer func() {
-		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Rollback()
-		}
-	}()
 
-	data, err := tx.Get(target)
+	err = cond.check(s, target, data, true)
 	if err != nil {
-		return err
+		return api.Document{}, err
+	}
+
+	// The patch is applied here to check the resulting document. Atomic patches are applied again by the datastore,
+	// unless the document has a schema: the result of the operators would then not be validated.
+	t := time.Now()
+	properties, err := payload.apply(data.Properties, t)
+	if IsConflict(err) {
+		return api.Document{}, err
+	}
+	if err != nil {
+		return api.Document{}, badRequest("Invalid patch: " + err.Error())
 	}
 
 	newDoc := api.Document{
 		ID:                   target.ID(),
 		CreationDate:         data.CreationDate,
-		LastModificationDate: time.Now(),
-		Properties:           patchPayload(data.Properties, payload),
+		LastModificationDate: t,
+		Properties:           properties,
 	}
 
 	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(data, newDoc)
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 	if !ok {
-		return notAuthorizedError{target}
+		return api.Document{}, s.denied(target, r, user, true)
 	}
 
-	err = tx.Patch(target, newDoc.Properties)
+	if err := validateContent(r, target, newDoc.Properties); err != nil {
+		return api.Document{}, err
+	}
+
+	switch {
+	case !payload.isAtomic() || r.HasSchema():
+		err = tx.PutIfRevision(target, newDoc.Properties, data.Revision)
+		if IsPreconditionFailed(err) && !cond.isSet() {
+			err = conflictError{target}
+		}
+	case cond.isSet():
+		err = tx.PatchIfRevision(target, payload.properties, data.Revision)
+	default:
+		err = tx.Patch(target, payload.properties)
+	}
 	if err != nil {
-		return err
+		return api.Document{}, err
 	}
 
-	return tx.Commit()
+	return tx.Get(target)
 }
 
-func (s *server) DeleteDocument(target api.ObjectRef, user api.User) error {
-
-	r, err := s.GetRuleAndCheckPath(target, user, true)
-	if err != nil {
-		return err
-	}
+func (s *server) DeleteDocument(target api.ObjectRef, cond preconditions, user api.User) error {
 
 	tx, err := s.DataRepository.Begin()
 	if err != nil {
@@ -580,25 +985,43 @@ func (s *server) DeleteDocument(target api.ObjectRef, user api.User) error {
 		}
 	}()
 
-	data, err := tx.Get(target)
+	err = s.deleteDocument(tx, target, cond, user)
 	if err != nil {
 		return err
 	}
 
-	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(data, api.Document{})
+	return tx.Commit()
+}
+
+func (s *server) deleteDocument(tx api.Transaction, target api.ObjectRef, cond preconditions, user api.User) error {
+
+	r, err := s.GetRuleAndCheckPath(target, user, true)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		return notAuthorizedError{target}
+
+	data, err := tx.Get(target)
+	if err != nil {
+		return err
 	}
 
-	err = tx.Delete(target)
+	err = cond.check(s, target, data, true)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(data, api.Document{})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.denied(target, r, user, true)
+	}
+
+	if cond.isSet() {
+		return tx.DeleteIfRevision(target, data.Revision)
+	}
+	return tx.Delete(target)
 }
 
 func (s *server) DeleteCollection(target api.ObjectRef, user api.User) error {
@@ -620,7 +1043,7 @@ func (s *server) DeleteCollection(target api.ObjectRef, user api.User) error {
 		}
 	}()
 
-	cu, err := tx.GetAll(target, nil)
+	cu, err := tx.GetAll(target, api.Query{})
 	if err != nil {
 		return err
 	}
@@ -639,8 +1062,10 @@ func (s *server) DeleteCollection(target api.ObjectRef, user api.User) error {
 				return err
 			}
 			if ok {
-				documentRef := append(target, d.ID)
-				tx.Delete(documentRef)
+				documentRef := append(target[:len(target):len(target)], d.ID)
+				if err := tx.Delete(documentRef); err != nil {
+					return err
+				}
 			}
 		}
 
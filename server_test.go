@@ -1,15 +1,23 @@
 package grest
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
 	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/memory"
 	"github.com/xdbsoft/grest/rules"
 )
 
@@ -25,9 +33,10 @@ type testRequest struct {
 }
 
 type testCase struct {
-	rules    []rules.Rule
-	data     map[string]map[string]api.Document
-	requests []testRequest
+	rules         []rules.Rule
+	data          map[string]map[string]api.Document
+	hideForbidden bool
+	requests      []testRequest
 }
 
 func (c testCase) Run(t *testing.T) {
@@ -40,6 +49,7 @@ func (c testCase) Run(t *testing.T) {
 		Authenticator:  mockedAuthenticator{},
 		DataRepository: mock,
 		RuleChecker:    rules.NewChecker(c.rules),
+		HideForbidden:  c.hideForbidden,
 	}
 
 	for j, request := range c.requests {
@@ -49,9 +59,10 @@ func (c testCase) Run(t *testing.T) {
 		}
 
 		req := httptest.NewRequest(request.method, request.url, b)
+		req.Header.Set("X-Request-Id", fmt.Sprintf("req-%d", j))
 		if request.headers != nil {
 			for key, value := range request.headers {
-				req.Header.Add(key, value)
+				req.Header.Set(key, value)
 			}
 		}
 
@@ -108,6 +119,7 @@ func TestServeHTTP_Get_Document(t *testing.T) {
 				ID:                   "doc1",
 				CreationDate:         aDate,
 				LastModificationDate: aDate,
+				Revision:             3,
 				Properties:           map[string]interface{}{"k": "v"},
 			}},
 		},
@@ -117,8 +129,8 @@ func TestServeHTTP_Get_Document(t *testing.T) {
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        200,
 				expectedContentType: "application/json",
-				expectedHeaders:     map[string]string{"ETag": `"f21bd9d57dc248f0be1d1e0e4ad3a15796eb8f03"`, "Last-Modified": "Sat, 30 Aug 2008 15:25:00 GMT"},
-				expectedBody: `{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}
+				expectedHeaders:     map[string]string{"ETag": `"3"`, "Last-Modified": "Sat, 30 Aug 2008 15:25:00 GMT"},
+				expectedBody: `{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":3,"properties":{"k":"v"}}
 `,
 			},
 		},
@@ -136,6 +148,7 @@ func TestServeHTTP_Get_Document_NotModified(t *testing.T) {
 				ID:                   "doc1",
 				CreationDate:         aDate,
 				LastModificationDate: aDate,
+				Revision:             3,
 				Properties:           map[string]interface{}{"k": "v"},
 			}},
 		},
@@ -143,16 +156,16 @@ func TestServeHTTP_Get_Document_NotModified(t *testing.T) {
 			{
 				method:          "GET",
 				url:             "http://example.com/test/doc1",
-				headers:         map[string]string{"If-None-Match": `"f21bd9d57dc248f0be1d1e0e4ad3a15796eb8f03"`},
+				headers:         map[string]string{"If-None-Match": `"3"`},
 				expectedCode:    304,
-				expectedHeaders: map[string]string{"ETag": `"f21bd9d57dc248f0be1d1e0e4ad3a15796eb8f03"`},
+				expectedHeaders: map[string]string{"ETag": `"3"`},
 			},
 			{
 				method:          "GET",
 				url:             "http://example.com/test/doc1",
 				headers:         map[string]string{"If-Modified-Since": aDate.UTC().Format(http.TimeFormat)},
 				expectedCode:    304,
-				expectedHeaders: map[string]string{"ETag": `"f21bd9d57dc248f0be1d1e0e4ad3a15796eb8f03"`, "Last-Modified": "Sat, 30 Aug 2008 15:25:00 GMT"},
+				expectedHeaders: map[string]string{"ETag": `"3"`, "Last-Modified": "Sat, 30 Aug 2008 15:25:00 GMT"},
 			},
 		},
 	}
@@ -169,32 +182,32 @@ func TestServeHTTP_BadRequests(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com",
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `empty path
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"empty path","code":"bad_request","requestId":"req-0"}
 `,
 			},
 			{
 				method:              "GET",
 				url:                 "http://example.com/test//test2/doc",
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `empty item in path
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"empty item in path","instance":"/test//test2/doc","code":"bad_request","requestId":"req-1"}
 `,
 			},
 			{
 				method:              "GET2",
 				url:                 "http://example.com/test/doc",
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `unsupported method
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"unsupported method","instance":"/test/doc","code":"bad_request","requestId":"req-2"}
 `,
 			},
 			{
 				method:              "GET2",
 				url:                 "http://example.com/test",
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `unsupported method
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"unsupported method","instance":"/test","code":"bad_request","requestId":"req-3"}
 `,
 			},
 			{
@@ -202,8 +215,8 @@ func TestServeHTTP_BadRequests(t *testing.T) {
 				url:                 "http://example.com/test/doc",
 				body:                `not json`,
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unable to decode JSON body: invalid character 'o' in literal null (expecting 'u')
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Unable to decode JSON body: invalid character 'o' in literal null (expecting 'u')","instance":"/test/doc","code":"bad_request","requestId":"req-4"}
 `,
 			},
 			{
@@ -211,8 +224,8 @@ func TestServeHTTP_BadRequests(t *testing.T) {
 				url:                 "http://example.com/test/doc",
 				body:                `123`,
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unable to decode JSON body: json: cannot unmarshal number into Go value of type api.DocumentProperties
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Unable to decode JSON body: json: cannot unmarshal number into Go value of type api.DocumentProperties","instance":"/test/doc","code":"bad_request","requestId":"req-5"}
 `,
 			},
 			{
@@ -220,8 +233,8 @@ func TestServeHTTP_BadRequests(t *testing.T) {
 				url:                 "http://example.com/test",
 				body:                `"invalid"`,
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unable to decode JSON body: json: cannot unmarshal string into Go value of type api.DocumentProperties
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Unable to decode JSON body: json: cannot unmarshal string into Go value of type api.DocumentProperties","instance":"/test","code":"bad_request","requestId":"req-6"}
 `,
 			},
 			{
@@ -229,8 +242,8 @@ func TestServeHTTP_BadRequests(t *testing.T) {
 				url:                 "http://example.com/test/doc",
 				body:                `{"k":"v"}`,
 				expectedCode:        400,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Invalid ID
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid ID","instance":"/test/doc","code":"bad_request","requestId":"req-7"}
 `,
 			},
 		},
@@ -278,10 +291,258 @@ func TestServeHTTP_Get_Collection(t *testing.T) {
 			},
 			{
 				method:              "GET",
-				url:                 "http://example.com/test?limit=1&orderBy=k",
+				url:                 "http://example.com/test?limit=1&orderBy=properties.k",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedHeaders:     map[string]string{"Link": `</test?limit=1&orderBy=properties.k&pageToken=eyJvIjoicHJvcGVydGllcy5rIiwiYSI6eyJpZCI6ImRvYzIiLCJjcmVhdGlvbkRhdGUiOiIyMDA4LTA4LTMwVDE1OjI1OjAwWiIsImxhc3RNb2RpZmljYXRpb25EYXRlIjoiMjAwOC0wOC0zMFQxNToyNTowMFoiLCJwcm9wZXJ0aWVzIjp7ImsiOiJhIn19fQ>; rel="next"`},
+				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"a"}}],"nextPageToken":"eyJvIjoicHJvcGVydGllcy5rIiwiYSI6eyJpZCI6ImRvYzIiLCJjcmVhdGlvbkRhdGUiOiIyMDA4LTA4LTMwVDE1OjI1OjAwWiIsImxhc3RNb2RpZmljYXRpb25EYXRlIjoiMjAwOC0wOC0zMFQxNToyNTowMFoiLCJwcm9wZXJ0aWVzIjp7ImsiOiJhIn19fQ"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?limit=1&orderBy=properties.k&pageToken=eyJvIjoicHJvcGVydGllcy5rIiwiYSI6eyJpZCI6ImRvYzIiLCJjcmVhdGlvbkRhdGUiOiIyMDA4LTA4LTMwVDE1OjI1OjAwWiIsImxhc3RNb2RpZmljYXRpb25EYXRlIjoiMjAwOC0wOC0zMFQxNToyNTowMFoiLCJwcm9wZXJ0aWVzIjp7ImsiOiJhIn19fQ",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedHeaders:     map[string]string{"Link": ""},
+				expectedBody: `{"id":"test","features":[{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?limit=1&orderBy=id&pageToken=eyJvIjoicHJvcGVydGllcy5rIiwiYSI6eyJpZCI6ImRvYzIiLCJjcmVhdGlvbkRhdGUiOiIyMDA4LTA4LTMwVDE1OjI1OjAwWiIsImxhc3RNb2RpZmljYXRpb25EYXRlIjoiMjAwOC0wOC0zMFQxNToyNTowMFoiLCJwcm9wZXJ0aWVzIjp7ImsiOiJhIn19fQ",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid pageToken: orderBy does not match","instance":"/test","code":"bad_request","requestId":"req-4"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?pageToken=abcd",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid pageToken","instance":"/test","code":"bad_request","requestId":"req-5"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?limit=1&orderBy=-properties.k",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}],"nextPageToken":"eyJvIjoiLXByb3BlcnRpZXMuayIsImEiOnsiaWQiOiJkb2MxIiwiY3JlYXRpb25EYXRlIjoiMjAwOC0wOC0zMFQxNToyNTowMFoiLCJsYXN0TW9kaWZpY2F0aW9uRGF0ZSI6IjIwMDgtMDgtMzBUMTU6MjU6MDBaIiwicHJvcGVydGllcyI6eyJrIjoidiJ9fX0"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?orderBy=%2BcreationDate,-id",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"a"}},{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?orderBy=k",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid orderBy: unknown field 'k' in field path 'k'","instance":"/test","code":"bad_request","requestId":"req-8"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?limit=0",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?limit=-1",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid limit: must not be negative","instance":"/test","code":"bad_request","requestId":"req-10"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+func TestServeHTTP_Get_Collection_Where(t *testing.T) {
+
+	c := testCase{
+		rules: allowAll("test/{docId}"),
+		data: map[string]map[string]api.Document{
+			"test": {
+				"doc1": api.Document{
+					ID:                   "doc1",
+					CreationDate:         aDate,
+					LastModificationDate: aDate,
+					Properties:           map[string]interface{}{"status": "open", "priority": 1.},
+				},
+				"doc2": api.Document{
+					ID:                   "doc2",
+					CreationDate:         aDate,
+					LastModificationDate: aDate,
+					Properties:           map[string]interface{}{"status": "open", "priority": 3.},
+				},
+				"doc3": api.Document{
+					ID:                   "doc3",
+					CreationDate:         aDate,
+					LastModificationDate: aDate,
+					Properties:           map[string]interface{}{"status": "closed", "priority": 5.},
+				},
+			},
+		},
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 `http://example.com/test?where=properties.status=="open"%20%26%26%20properties.priority>2`,
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"priority":3,"status":"open"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 `http://example.com/test?where=properties.status!='open'`,
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc3","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"priority":5,"status":"closed"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 `http://example.com/test?where=id<="doc2"%26%26properties.missing==null`,
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"priority":1,"status":"open"}},{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"priority":3,"status":"open"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 `http://example.com/test?where=properties.status="open"`,
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid where clause: expected an operator at position 17","instance":"/test","code":"bad_request","requestId":"req-3"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 `http://example.com/test?where=status=="open"`,
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid where clause: unknown field 'status' in field path 'status'","instance":"/test","code":"bad_request","requestId":"req-4"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Get_Collection_Aggregates(t *testing.T) {
+
+	data := map[string]map[string]api.Document{
+		"test": {
+			"doc1": api.Document{
+				ID:         "doc1",
+				Properties: map[string]interface{}{"status": "open", "amount": 10., "private": false},
+			},
+			"doc2": api.Document{
+				ID:         "doc2",
+				Properties: map[string]interface{}{"status": "open", "amount": 5., "private": true},
+			},
+			"doc3": api.Document{
+				ID:         "doc3",
+				Properties: map[string]interface{}{"status": "closed", "amount": "n/a", "private": false},
+			},
+		},
+	}
+
+	c := testCase{
+		rules: allowAll("test/{docId}"),
+		data:  data,
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?count=true",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedHeaders:     map[string]string{"X-Total-Count": "3"},
+				expectedBody: `{"id":"test","count":3}
+`,
+			},
+			{
+				method:              "HEAD",
+				url:                 `http://example.com/test?where=properties.status=="open"`,
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedHeaders:     map[string]string{"X-Total-Count": "2"},
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?aggregate=count,count(properties.amount),sum(properties.amount),min(properties.amount),max(properties.amount),avg(properties.amount)",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","results":[{"group":null,"values":{"avg(properties.amount)":7.5,"count":3,"count(properties.amount)":3,"max(properties.amount)":10,"min(properties.amount)":5,"sum(properties.amount)":15}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?aggregate=count,sum(properties.amount)&groupBy=properties.status",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","groupBy":"properties.status","results":[{"group":"closed","values":{"count":1,"sum(properties.amount)":null}},{"group":"open","values":{"count":2,"sum(properties.amount)":15}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?aggregate=median(properties.amount)",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid aggregate: unknown aggregate function 'median'","instance":"/test","code":"bad_request","requestId":"req-4"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?aggregate=count&groupBy=id",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid groupBy: only properties can be used to group documents","instance":"/test","code":"bad_request","requestId":"req-5"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+
+	c = testCase{
+		rules: []rules.Rule{
+			{
+				Path: "test/{docId}",
+				Read: rules.Allow{
+					IfContent: `content.properties.private != true`,
+				},
+			},
+		},
+		data: data,
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?count=true",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedHeaders:     map[string]string{"X-Total-Count": "2"},
+				expectedBody: `{"id":"test","count":2}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?aggregate=sum(properties.amount)&groupBy=properties.status",
 				expectedCode:        200,
 				expectedContentType: "application/json",
-				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"a"}}]}
+				expectedBody: `{"id":"test","groupBy":"properties.status","results":[{"group":"closed","values":{"sum(properties.amount)":null}},{"group":"open","values":{"sum(properties.amount)":10}}]}
 `,
 			},
 		},
@@ -289,6 +550,7 @@ func TestServeHTTP_Get_Collection(t *testing.T) {
 
 	c.Run(t)
 }
+
 func TestServeHTTP_Get_Print(t *testing.T) {
 
 	c := testCase{
@@ -342,8 +604,9 @@ func TestServeHTTP_Get_NotFound(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        404,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Data not found
+				expectedHeaders:     map[string]string{"X-Request-Id": "req-0"},
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-0"}
 `,
 			},
 		},
@@ -361,24 +624,25 @@ func TestServeHTTP_Get_InvalidAuth(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/doc1?auth=abcd",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedHeaders:     map[string]string{"WWW-Authenticate": `Bearer realm="grest", error="invalid_token", error_description="Invalid credentials"`},
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Invalid credentials","instance":"/test/doc1","code":"not_authorized","requestId":"req-0"}
 `,
 			},
 			{
 				method:              "GET",
 				url:                 "http://example.com/test?auth=abcd",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Invalid credentials","instance":"/test","code":"not_authorized","requestId":"req-1"}
 `,
 			},
 			{
 				method:              "GET",
 				url:                 "http://example.com/test/doc1?auth=abcd||",
 				expectedCode:        404,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Data not found
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-2"}
 `,
 			},
 		},
@@ -406,7 +670,7 @@ func TestServeHTTP_PutGet(t *testing.T) {
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        200,
 				expectedContentType: "application/json",
-				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","properties":{"k":"v"}}
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v"}}
 `,
 			},
 		},
@@ -427,7 +691,7 @@ func TestServeHTTP_PostGet_Collection(t *testing.T) {
 				body:                `{"k":"v"}`,
 				expectedCode:        202,
 				expectedContentType: "application/json",
-				expectedBody: `{"id":"ID_1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","properties":{"k":"v"}}
+				expectedBody: `{"id":"ID_1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v"}}
 `,
 			},
 			{
@@ -435,7 +699,7 @@ func TestServeHTTP_PostGet_Collection(t *testing.T) {
 				url:                 "http://example.com/test/ID_1",
 				expectedCode:        200,
 				expectedContentType: "application/json",
-				expectedBody: `{"id":"ID_1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","properties":{"k":"v"}}
+				expectedBody: `{"id":"ID_1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v"}}
 `,
 			},
 		},
@@ -471,7 +735,7 @@ func TestServeHTTP_PutPostGet(t *testing.T) {
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        200,
 				expectedContentType: "application/json",
-				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T06:00:00Z","properties":{"k":"v2","u":"x","x":123}}
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T06:00:00Z","revision":2,"properties":{"k":"v2","u":"x","x":123}}
 `,
 			},
 		},
@@ -480,80 +744,51 @@ func TestServeHTTP_PutPostGet(t *testing.T) {
 	c.Run(t)
 }
 
-func TestServeHTTP_Get_IncorrectRule(t *testing.T) {
+func TestServeHTTP_Patch_Operators(t *testing.T) {
 
 	c := testCase{
-		data: map[string]map[string]api.Document{
-			"test": {"101": api.Document{
-				ID:         "101",
-				Properties: map[string]interface{}{"k": "v"},
-			}, "099": api.Document{
-				ID:         "099",
-				Properties: map[string]interface{}{"k": "v"},
-			}},
-		},
-		rules: []rules.Rule{
+		rules: allowAll("test/{docId}"),
+		data:  map[string]map[string]api.Document{},
+		requests: []testRequest{
 			{
-				Path: "test/{doc}",
-				Read: rules.Allow{
-					IfPath: `path.doc > '100`,
-				},
+				method:              "PUT",
+				url:                 "http://example.com/test/doc1",
+				body:                `{"id":"doc1","properties":{"views":2,"tags":["a","b"],"old":true,"sub":{"count":1,"name":"n"}}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
 			},
-		},
-		requests: []testRequest{
 			{
-				method:              "GET",
-				url:                 "http://example.com/test/099",
-				expectedCode:        500,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Internal server error
-`,
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				body:                `{"views":{"$inc":3},"likes":{"$inc":1.5},"tags":{"$arrayUnion":["b","c","c"]},"old":{"$delete":true},"sub":{"count":{"$inc":-1}},"updated":{"$serverTimestamp":true}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
 			},
-		},
-	}
-
-	c.Run(t)
-}
-
-func TestServeHTTP_Get_RuleOnPath(t *testing.T) {
-
-	c := testCase{
-		data: map[string]map[string]api.Document{
-			"test": {"101": api.Document{
-				ID:                   "101",
-				CreationDate:         aDate,
-				LastModificationDate: aDate,
-				Properties:           map[string]interface{}{"k": "v"},
-			}, "099": api.Document{
-				ID:                   "099",
-				CreationDate:         aDate,
-				LastModificationDate: aDate,
-				Properties:           map[string]interface{}{"k": "v"},
-			}},
-		},
-		rules: []rules.Rule{
 			{
-				Path: "test/{doc}",
-				Read: rules.Allow{
-					IfPath: `path.doc > '100'`,
-				},
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				body:                `{"tags":{"$arrayRemove":["a"]}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
 			},
-		},
-		requests: []testRequest{
 			{
-				method:              "GET",
-				url:                 "http://example.com/test/101",
-				expectedCode:        200,
-				expectedContentType: "application/json",
-				expectedBody: `{"id":"101","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				body:                `{"views":{"$inc":"1"}}`,
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid patch: invalid operator on 'views': $inc requires a number","instance":"/test/doc1","code":"bad_request","requestId":"req-3"}
 `,
 			},
 			{
 				method:              "GET",
-				url:                 "http://example.com/test/099",
-				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				url:                 "http://example.com/test/doc1",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T07:00:00Z","revision":3,"properties":{"likes":1.5,"sub":{"count":0,"name":"n"},"tags":["b","c"],"updated":"2018-08-24T06:00:00.000000Z","views":5}}
 `,
 			},
 		},
@@ -561,11 +796,316 @@ func TestServeHTTP_Get_RuleOnPath(t *testing.T) {
 
 	c.Run(t)
 }
-func TestServeHTTP_Get_RuleOnUser(t *testing.T) {
+
+func TestServeHTTP_Patch_Formats(t *testing.T) {
 
 	c := testCase{
-		data: map[string]map[string]api.Document{
-			"test": {"abcd": api.Document{
+		rules: allowAll("test/{docId}"),
+		data:  map[string]map[string]api.Document{},
+		requests: []testRequest{
+			{
+				method:              "PUT",
+				url:                 "http://example.com/test/doc1",
+				body:                `{"id":"doc1","properties":{"k":"v","u":"x","tags":["a","b"],"sub":{"a":1,"b":2}}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"Content-Type": "application/merge-patch+json"},
+				body:                `{"u":null,"sub":{"a":null,"c":3},"n":{"$inc":1}}`,
+				expectedCode:        204,
+				expectedHeaders:     map[string]string{"ETag": `"2"`},
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"Content-Type": "application/json-patch+json"},
+				body:                `[{"op":"test","path":"/k","value":"v"},{"op":"add","path":"/tags/1","value":"z"},{"op":"remove","path":"/tags/0"},{"op":"replace","path":"/k","value":"v2"},{"op":"move","from":"/sub/c","path":"/c"},{"op":"copy","from":"/tags","path":"/tags2"}]`,
+				expectedCode:        204,
+				expectedHeaders:     map[string]string{"ETag": `"3"`},
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"Content-Type": "application/json-patch+json"},
+				body:                `[{"op":"test","path":"/k","value":"v"},{"op":"remove","path":"/k"}]`,
+				expectedCode:        409,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Conflict","status":409,"detail":"test failed on '/k'","instance":"/test/doc1","code":"conflict","requestId":"req-3"}
+`,
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"Content-Type": "application/json-patch+json"},
+				body:                `[{"op":"remove","path":"/missing"}]`,
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid patch: invalid operation 0: missing field 'missing'","instance":"/test/doc1","code":"bad_request","requestId":"req-4"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T07:00:00Z","revision":3,"properties":{"c":3,"k":"v2","n":{"$inc":1},"sub":{"b":2},"tags":["z","b"],"tags2":["z","b"]}}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Schema(t *testing.T) {
+
+	taskSchema := `{
+		"type": "object",
+		"required": ["title"],
+		"properties": {
+			"title": {"type": "string", "minLength": 1},
+			"priority": {"type": "integer", "minimum": 1, "maximum": 5},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		},
+		"additionalProperties": false
+	}`
+
+	if err := rules.NewChecker([]rules.Rule{{Path: "projects/{p}/tasks/{t}", Schema: `{"type": "text"}`}}).Err(); err == nil {
+		t.Error("Invalid schemas should be reported")
+	}
+
+	c := testCase{
+		rules: []rules.Rule{
+			{
+				Path:   "projects/{p}/tasks/{t}",
+				Schema: taskSchema,
+			},
+		},
+		data: map[string]map[string]api.Document{},
+		requests: []testRequest{
+			{
+				method:              "POST",
+				url:                 "http://example.com/projects/p1/tasks",
+				body:                `{"priority":7,"tags":["a",1],"x":true}`,
+				expectedCode:        422,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"Invalid content of 'projects/p1/tasks': 4 violation(s) of its schema","instance":"/projects/p1/tasks","code":"invalid_content","path":"projects/p1/tasks","requestId":"req-0","violations":[{"path":"/title","message":"is required"},{"path":"/priority","message":"must be less than or equal to 5"},{"path":"/tags/1","message":"must be of type string"},{"path":"/x","message":"no value is allowed"}]}
+`,
+			},
+			{
+				method:              "PUT",
+				url:                 "http://example.com/projects/p1/tasks/t1",
+				body:                `{"id":"t1","properties":{"title":"T","priority":2}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/projects/p1/tasks/t1",
+				body:                `{"priority":{"$inc":0.5}}`,
+				expectedCode:        422,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"Invalid content of 'projects/p1/tasks/t1': 1 violation(s) of its schema","instance":"/projects/p1/tasks/t1","code":"invalid_content","path":"projects/p1/tasks/t1","requestId":"req-2","violations":[{"path":"/priority","message":"must be of type integer"}]}
+`,
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/projects/p1/tasks/t1",
+				headers:             map[string]string{"Content-Type": "application/merge-patch+json"},
+				body:                `{"title":null}`,
+				expectedCode:        422,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"Invalid content of 'projects/p1/tasks/t1': 1 violation(s) of its schema","instance":"/projects/p1/tasks/t1","code":"invalid_content","path":"projects/p1/tasks/t1","requestId":"req-3","violations":[{"path":"/title","message":"is required"}]}
+`,
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/projects/p1/tasks/t1",
+				body:                `{"priority":{"$inc":1}}`,
+				expectedCode:        204,
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/projects/p1/tasks/t1",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"t1","creationDate":"2018-08-24T06:00:00Z","lastModificationDate":"2018-08-24T09:00:00Z","revision":2,"properties":{"priority":3,"title":"T"}}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Schema_AtomicPatch(t *testing.T) {
+
+	counter := api.ObjectRef{"counters", "c1"}
+
+	mem := memory.New()
+	tx, _ := mem.Begin()
+	tx.Put(counter, api.DocumentProperties{"n": 4.})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{
+		Authenticator: mockedAuthenticator{},
+		DataRepository: &interleavedRepository{Repository: mem, write: func(r api.Repository) error {
+			tx, err := r.Begin()
+			if err != nil {
+				return err
+			}
+			tx.Put(counter, api.DocumentProperties{"n": 5.})
+			return tx.Commit()
+		}},
+		RuleChecker: rules.NewChecker([]rules.Rule{{Path: "counters/{c}", Schema: `{"properties": {"n": {"maximum": 5}}}`}}),
+	}
+
+	// The increment is valid from the document as it was read, but not from the one modified in the meantime
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PATCH", "http://example.com/counters/c1", strings.NewReader(`{"n":{"$inc":1}}`)))
+	if w.Code != 409 {
+		t.Errorf("Unexpected status code, expected 409, got %d", w.Code)
+	}
+
+	tx, _ = mem.Begin()
+	defer tx.Rollback()
+	d, err := tx.Get(counter)
+	if err != nil || d.Properties["n"] != 5. {
+		t.Errorf("The stored document should still match its schema, got %v (%v)", d.Properties, err)
+	}
+}
+
+func TestServeHTTP_Schema_Restore(t *testing.T) {
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: &mockedDataRepository{Data: map[string]map[string]api.Document{}, Now: aDate},
+		RuleChecker:    rules.NewChecker(allowAll("test/{docId}")),
+	}
+
+	do := func(method, url, body string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "http://example.com"+url, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := do("PUT", "/test/doc1", `{"id":"doc1","properties":{"k":1}}`); code != 204 {
+		t.Fatalf("Put failed with %d", code)
+	}
+	if code := do("DELETE", "/test/doc1", ""); code != 204 {
+		t.Fatalf("Delete failed with %d", code)
+	}
+
+	// The schema was introduced after the document was deleted
+	s.RuleChecker = rules.NewChecker([]rules.Rule{{Path: "test/{docId}", Schema: `{"properties": {"k": {"type": "string"}}}`}})
+
+	if code := do("POST", "/test/doc1?restore=true", ""); code != 422 {
+		t.Errorf("Restoring an invalid document: expected 422, got %d", code)
+	}
+	if code := do("GET", "/test/doc1", ""); code != 404 {
+		t.Errorf("The invalid document should not be restored, got %d", code)
+	}
+}
+
+func TestServeHTTP_Get_IncorrectRule(t *testing.T) {
+
+	c := testCase{
+		data: map[string]map[string]api.Document{
+			"test": {"101": api.Document{
+				ID:         "101",
+				Properties: map[string]interface{}{"k": "v"},
+			}, "099": api.Document{
+				ID:         "099",
+				Properties: map[string]interface{}{"k": "v"},
+			}},
+		},
+		rules: []rules.Rule{
+			{
+				Path: "test/{doc}",
+				Read: rules.Allow{
+					IfPath: `path.doc > '100`,
+				},
+			},
+		},
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/099",
+				expectedCode:        500,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Internal Server Error","status":500,"instance":"/test/099","code":"internal_error","requestId":"req-0"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Get_RuleOnPath(t *testing.T) {
+
+	c := testCase{
+		data: map[string]map[string]api.Document{
+			"test": {"101": api.Document{
+				ID:                   "101",
+				CreationDate:         aDate,
+				LastModificationDate: aDate,
+				Properties:           map[string]interface{}{"k": "v"},
+			}, "099": api.Document{
+				ID:                   "099",
+				CreationDate:         aDate,
+				LastModificationDate: aDate,
+				Properties:           map[string]interface{}{"k": "v"},
+			}},
+		},
+		rules: []rules.Rule{
+			{
+				Path: "test/{doc}",
+				Read: rules.Allow{
+					IfPath: `path.doc > '100'`,
+				},
+			},
+		},
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/101",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"101","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/099",
+				expectedCode:        401,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/099'","instance":"/test/099","code":"not_authorized","path":"test/099","rule":"test/{doc}","requestId":"req-1"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+func TestServeHTTP_Get_RuleOnUser(t *testing.T) {
+
+	c := testCase{
+		data: map[string]map[string]api.Document{
+			"test": {"abcd": api.Document{
 				ID:                   "abcd",
 				CreationDate:         aDate,
 				LastModificationDate: aDate,
@@ -593,8 +1133,72 @@ func TestServeHTTP_Get_RuleOnUser(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/abcd",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedHeaders:     map[string]string{"WWW-Authenticate": `Bearer realm="grest"`},
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/abcd'","instance":"/test/abcd","code":"not_authorized","path":"test/abcd","rule":"test/{userId}","requestId":"req-1"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/abcd?auth=efgh||",
+				expectedCode:        403,
+				expectedHeaders:     map[string]string{"WWW-Authenticate": ""},
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"Not allowed to access 'test/abcd'","instance":"/test/abcd","code":"forbidden","path":"test/abcd","rule":"test/{userId}","requestId":"req-2"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_HideForbidden(t *testing.T) {
+
+	c := testCase{
+		data: map[string]map[string]api.Document{
+			"test": {"abcd": api.Document{
+				ID:                   "abcd",
+				CreationDate:         aDate,
+				LastModificationDate: aDate,
+				Properties:           map[string]interface{}{"k": "v"},
+			}},
+		},
+		rules: []rules.Rule{
+			{
+				Path: "test/{userId}",
+				Read: rules.Allow{
+					IfPath: `path.userId == user.id`,
+				},
+				Write: rules.Allow{
+					IfPath: `path.userId == user.id`,
+				},
+			},
+		},
+		hideForbidden: true,
+		requests: []testRequest{
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/abcd?auth=efgh||",
+				expectedCode:        404,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/abcd","code":"not_found","requestId":"req-0"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/efgh?auth=efgh||",
+				expectedCode:        404,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/efgh","code":"not_found","requestId":"req-1"}
+`,
+			},
+			{
+				method:              "DELETE",
+				url:                 "http://example.com/test/abcd?auth=efgh||",
+				expectedCode:        403,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"Not allowed to access 'test/abcd'","instance":"/test/abcd","code":"forbidden","path":"test/abcd","rule":"test/{userId}","requestId":"req-2"}
 `,
 			},
 		},
@@ -625,8 +1229,8 @@ func TestServeHTTP_Delete_Document(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        404,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Data not found
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-1"}
 `,
 			},
 		},
@@ -657,8 +1261,8 @@ func TestServeHTTP_Delete_Collection(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        404,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Data not found
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-1"}
 `,
 			},
 		},
@@ -667,15 +1271,440 @@ func TestServeHTTP_Delete_Collection(t *testing.T) {
 	c.Run(t)
 }
 
-func TestServeHTTP_NotAutorized(t *testing.T) {
+func TestServeHTTP_ConditionalWrites(t *testing.T) {
+
+	doc1 := api.Document{
+		ID:                   "doc1",
+		CreationDate:         aDate,
+		LastModificationDate: aDate,
+		Revision:             7,
+		Properties:           map[string]interface{}{"k": "v"},
+	}
+	etag, err := (&server{}).computeEtag(doc1)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	c := testCase{
-		rules: []rules.Rule{
+		rules: allowAll("test/{docId}"),
+		data: map[string]map[string]api.Document{
+			"test": {"doc1": doc1},
+		},
+		requests: []testRequest{
 			{
-				Path: "test/{docId}",
-				Read: rules.Allow{
-					IfPath: `"doc1" != "doc1"`,
-				},
+				method:              "PUT",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Match": `"other"`},
+				body:                `{"id":"doc1","properties":{"k":"v2"}}`,
+				expectedCode:        412,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Precondition Failed","status":412,"detail":"Precondition failed on 'test/doc1'","instance":"/test/doc1","code":"precondition_failed","path":"test/doc1","requestId":"req-0"}
+`,
+			},
+			{
+				method:              "PUT",
+				url:                 "http://example.com/test/doc2",
+				headers:             map[string]string{"If-Match": "*"},
+				body:                `{"id":"doc2","properties":{"k":"v2"}}`,
+				expectedCode:        412,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Precondition Failed","status":412,"detail":"Precondition failed on 'test/doc2'","instance":"/test/doc2","code":"precondition_failed","path":"test/doc2","requestId":"req-1"}
+`,
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Unmodified-Since": aDate.Add(-time.Hour).Format(http.TimeFormat)},
+				body:                `{"k":"v2"}`,
+				expectedCode:        412,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Precondition Failed","status":412,"detail":"Precondition failed on 'test/doc1'","instance":"/test/doc1","code":"precondition_failed","path":"test/doc1","requestId":"req-2"}
+`,
+			},
+			{
+				method:              "DELETE",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Match": `W/` + etag},
+				expectedCode:        412,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Precondition Failed","status":412,"detail":"Precondition failed on 'test/doc1'","instance":"/test/doc1","code":"precondition_failed","path":"test/doc1","requestId":"req-3"}
+`,
+			},
+			{
+				method:              "PUT",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Match": `"other", ` + etag},
+				body:                `{"id":"doc1","properties":{"k":"v2"}}`,
+				expectedCode:        204,
+				expectedHeaders:     map[string]string{"ETag": `"1"`},
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Match": etag},
+				body:                `{"k":"v3"}`,
+				expectedCode:        412,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Precondition Failed","status":412,"detail":"Precondition failed on 'test/doc1'","instance":"/test/doc1","code":"precondition_failed","path":"test/doc1","requestId":"req-5"}
+`,
+			},
+			{
+				method:              "PATCH",
+				url:                 "http://example.com/test/doc1",
+				headers:             map[string]string{"If-Unmodified-Since": "Fri, 24 Aug 2018 09:00:00 GMT"},
+				body:                `{"k":"v3"}`,
+				expectedCode:        204,
+				expectedHeaders:     map[string]string{"ETag": `"2"`},
+				expectedContentType: "",
+				expectedBody:        "",
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2018-08-24T11:00:00Z","revision":2,"properties":{"k":"v3"}}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestCollectionEtag(t *testing.T) {
+
+	page := api.Collection{
+		ID:       "tasks",
+		Features: []api.Document{{ID: "t1", Revision: 3}, {ID: "t2", Revision: 5}},
+	}
+	next := page
+	next.NextPageToken = "token"
+
+	s := &server{}
+	etag := func(url string, c api.Collection) string {
+		res, err := s.collectionEtag(httptest.NewRequest("GET", url, nil), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	reference := etag("/users/u1/tasks?limit=2", page)
+	if etag("/users/u1/tasks?limit=2", page) != reference {
+		t.Error("Identical pages should have the same ETag")
+	}
+	for _, other := range []string{
+		etag("/users/u2/tasks?limit=2", page),
+		etag("/users/u1/tasks?limit=3", page),
+		etag("/users/u1/tasks?limit=2&pageToken=abc", page),
+		etag("/users/u1/tasks?limit=2", next),
+	} {
+		if other == reference {
+			t.Error("Pages of other collections, sizes or positions should have another ETag")
+		}
+	}
+}
+
+func TestServeHTTP_History(t *testing.T) {
+
+	c := testCase{
+		rules: []rules.Rule{
+			{
+				Path: "test/{docId}",
+				Read: rules.Allow{
+					IfContent: `content.properties.k != "secret"`,
+				},
+			},
+		},
+		data: map[string]map[string]api.Document{},
+		requests: []testRequest{
+			{
+				method:       "PUT",
+				url:          "http://example.com/test/doc1",
+				body:         `{"id":"doc1","properties":{"k":"v"}}`,
+				expectedCode: 204,
+			},
+			{
+				method:       "PATCH",
+				url:          "http://example.com/test/doc1",
+				body:         `{"k":"secret"}`,
+				expectedCode: 204,
+			},
+			{
+				method:       "PATCH",
+				url:          "http://example.com/test/doc1",
+				body:         `{"k":"v3"}`,
+				expectedCode: 204,
+			},
+			{
+				method:       "DELETE",
+				url:          "http://example.com/test/doc1",
+				expectedCode: 204,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?history=true",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","versions":[{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T08:00:00Z","revision":3,"properties":{"k":"v3"},"deleted":true},{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T07:00:00Z","revision":3,"properties":{"k":"v3"}},{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v"}}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?asOf=2018-08-24T05:30:00Z",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v"}}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?asOf=2018-08-24T06:30:00Z",
+				expectedCode:        401,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/doc1'","instance":"/test/doc1","code":"not_authorized","path":"test/doc1","rule":"test/{docId}","requestId":"req-6"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?asOf=2018-08-24T08:30:00Z",
+				expectedCode:        404,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-7"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?asOf=2018-08-24T04:00:00Z",
+				expectedCode:        404,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found","instance":"/test/doc1","code":"not_found","requestId":"req-8"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test/doc1?asOf=yesterday",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid asOf: parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\"","instance":"/test/doc1","code":"bad_request","requestId":"req-9"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Trash(t *testing.T) {
+
+	c := testCase{
+		rules: []rules.Rule{
+			{
+				Path: "test/{docId}",
+				Write: rules.Allow{
+					IfPath: `user.id == "u1"`,
+				},
+			},
+		},
+		data: map[string]map[string]api.Document{},
+		requests: []testRequest{
+			{
+				method:       "PUT",
+				url:          "http://example.com/test/doc1?auth=u1|n|e",
+				body:         `{"id":"doc1","properties":{"k":"v1"}}`,
+				expectedCode: 204,
+			},
+			{
+				method:       "PUT",
+				url:          "http://example.com/test/doc2?auth=u1|n|e",
+				body:         `{"id":"doc2","properties":{"k":"v2"}}`,
+				expectedCode: 204,
+			},
+			{
+				method:       "DELETE",
+				url:          "http://example.com/test/doc1?auth=u1|n|e",
+				expectedCode: 204,
+			},
+			{
+				method:       "DELETE",
+				url:          "http://example.com/test/doc2?auth=u1|n|e",
+				expectedCode: 204,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?trash=true",
+				expectedCode:        401,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test'","instance":"/test","code":"not_authorized","path":"test","rule":"test/{docId}","requestId":"req-4"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?trash=true&auth=u1|n|e",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2018-08-24T06:00:00Z","lastModificationDate":"2018-08-24T06:00:00Z","revision":2,"properties":{"k":"v2"},"deletionDate":"2018-08-24T08:00:00Z"},{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"k":"v1"},"deletionDate":"2018-08-24T07:00:00Z"}]}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/test/doc1?restore=true&auth=u1|n|e",
+				expectedCode:        202,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"doc1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T11:00:00Z","revision":3,"properties":{"k":"v1"}}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/test/doc1?restore=true&auth=u1|n|e",
+				expectedCode:        409,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Conflict","status":409,"detail":"Document 'test/doc1' already exists","instance":"/test/doc1","code":"conflict","requestId":"req-7"}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/test/doc3?restore=true&auth=u1|n|e",
+				expectedCode:        404,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"document not found in trash","instance":"/test/doc3","code":"not_found","requestId":"req-8"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/test?trash=true&auth=u1|n|e",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"test","features":[{"id":"doc2","creationDate":"2018-08-24T06:00:00Z","lastModificationDate":"2018-08-24T06:00:00Z","revision":2,"properties":{"k":"v2"},"deletionDate":"2018-08-24T08:00:00Z"}]}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestServeHTTP_Batch(t *testing.T) {
+
+	c := testCase{
+		rules: []rules.Rule{
+			{Path: "orders/{orderId}"},
+			{Path: "orders/{orderId}/items/{itemId}"},
+		},
+		data: map[string]map[string]api.Document{
+			"orders": {"o0": api.Document{
+				ID:                   "o0",
+				CreationDate:         aDate,
+				LastModificationDate: aDate,
+				Properties:           map[string]interface{}{"total": 1},
+			}},
+		},
+		requests: []testRequest{
+			{
+				method:              "POST",
+				url:                 "http://example.com/_batch",
+				body:                `{"operations":[{"op":"put","path":"orders/o1","data":{"total":3}},{"op":"add","path":"orders/o1/items","data":{"sku":"a"}},{"op":"delete","path":"orders/o0"}]}`,
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"committed":true,"results":[{"status":200,"document":{"id":"o1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"total":3}},"etag":"\"1\""},{"status":202,"document":{"id":"ID_1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":2,"properties":{"sku":"a"}},"etag":"\"2\""},{"status":204}]}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/_batch",
+				body:                `{"operations":[{"op":"patch","path":"orders/o1","data":{"total":4}},{"op":"patch","path":"orders/o2","data":{"total":1}},{"op":"delete","path":"orders/o1"}]}`,
+				expectedCode:        404,
+				expectedContentType: "application/json",
+				expectedBody: `{"committed":false,"results":[{"status":200,"document":{"id":"o1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T06:00:00Z","revision":3,"properties":{"total":4}},"etag":"\"3\""},{"status":404,"error":"Data not found","code":"not_found"}]}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/orders/o1",
+				expectedCode:        200,
+				expectedContentType: "application/json",
+				expectedBody: `{"id":"o1","creationDate":"2018-08-24T05:00:00Z","lastModificationDate":"2018-08-24T05:00:00Z","revision":1,"properties":{"total":3}}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/_batch",
+				body:                `{"operations":[{"op":"put","path":"orders/o1","data":{"total":5},"ifMatch":"\"7\""}]}`,
+				expectedCode:        412,
+				expectedContentType: "application/json",
+				expectedBody: `{"committed":false,"results":[{"status":412,"error":"Precondition failed","code":"precondition_failed"}]}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/_batch",
+				body:                `{"operations":[{"op":"add","path":"orders/o1"}]}`,
+				expectedCode:        400,
+				expectedContentType: "application/json",
+				expectedBody: `{"committed":false,"results":[{"status":400,"error":"add operations require a collection path","code":"bad_request"}]}
+`,
+			},
+			{
+				method:              "POST",
+				url:                 "http://example.com/_batch",
+				body:                `{"operations":[]}`,
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"empty batch","instance":"/_batch","code":"bad_request","requestId":"req-5"}
+`,
+			},
+			{
+				method:              "GET",
+				url:                 "http://example.com/_batch",
+				expectedCode:        400,
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"unsupported method","instance":"/_batch","code":"bad_request","requestId":"req-6"}
+`,
+			},
+		},
+	}
+
+	c.Run(t)
+}
+
+func TestBatch_RollbackFailure(t *testing.T) {
+
+	s := &server{
+		DataRepository: &mockedDataRepository{
+			Data:        map[string]map[string]api.Document{},
+			Now:         aDate,
+			RollbackErr: fmt.Errorf("connection lost"),
+		},
+		RuleChecker: rules.NewChecker(allowAll("orders/{orderId}")),
+	}
+
+	resp, err := s.Batch([]batchOperation{
+		{Op: "put", Path: "orders/o1", Data: api.DocumentProperties{"total": 3}},
+		{Op: "patch", Path: "orders/o2", Data: api.DocumentProperties{"total": 1}},
+	}, api.User{})
+	if err != nil {
+		t.Fatalf("The failure of the rollback should not replace the response, got %v", err)
+	}
+	if resp.Committed {
+		t.Error("The batch should not be committed")
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Status != 200 || resp.Results[1].Status != 404 {
+		t.Errorf("Unexpected results: %+v", resp.Results)
+	}
+}
+
+func TestServeHTTP_NotAutorized(t *testing.T) {
+
+	c := testCase{
+		rules: []rules.Rule{
+			{
+				Path: "test/{docId}",
+				Read: rules.Allow{
+					IfPath: `"doc1" != "doc1"`,
+				},
 				Write: rules.Allow{
 					IfPath: `"doc1" != "doc1"`,
 				},
@@ -692,16 +1721,16 @@ func TestServeHTTP_NotAutorized(t *testing.T) {
 				method:              "GET",
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/doc1'","instance":"/test/doc1","code":"not_authorized","path":"test/doc1","rule":"test/{docId}","requestId":"req-0"}
 `,
 			},
 			{
 				method:              "GET",
 				url:                 "http://example.com/test",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test'","instance":"/test","code":"not_authorized","path":"test","rule":"test/{docId}","requestId":"req-1"}
 `,
 			},
 			{
@@ -709,8 +1738,8 @@ func TestServeHTTP_NotAutorized(t *testing.T) {
 				url:                 "http://example.com/test",
 				body:                `{"k":"v"}`,
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test'","instance":"/test","code":"not_authorized","path":"test","rule":"test/{docId}","requestId":"req-2"}
 `,
 			},
 			{
@@ -718,8 +1747,8 @@ func TestServeHTTP_NotAutorized(t *testing.T) {
 				url:                 "http://example.com/test/doc1",
 				body:                `{"id":"doc1","properties":{"k":"v"}}`,
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/doc1'","instance":"/test/doc1","code":"not_authorized","path":"test/doc1","rule":"test/{docId}","requestId":"req-3"}
 `,
 			},
 			{
@@ -727,24 +1756,24 @@ func TestServeHTTP_NotAutorized(t *testing.T) {
 				url:                 "http://example.com/test/doc1",
 				body:                `{"k":"v"}`,
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/doc1'","instance":"/test/doc1","code":"not_authorized","path":"test/doc1","rule":"test/{docId}","requestId":"req-4"}
 `,
 			},
 			{
 				method:              "DELETE",
 				url:                 "http://example.com/test/doc1",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test/doc1'","instance":"/test/doc1","code":"not_authorized","path":"test/doc1","rule":"test/{docId}","requestId":"req-5"}
 `,
 			},
 			{
 				method:              "DELETE",
 				url:                 "http://example.com/test",
 				expectedCode:        401,
-				expectedContentType: "text/plain; charset=utf-8",
-				expectedBody: `Unauthorized
+				expectedContentType: "application/problem+json",
+				expectedBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Authentication required to access 'test'","instance":"/test","code":"not_authorized","path":"test","rule":"test/{docId}","requestId":"req-6"}
 `,
 			},
 		},
@@ -752,3 +1781,594 @@ func TestServeHTTP_NotAutorized(t *testing.T) {
 
 	c.Run(t)
 }
+
+func TestServeHTTP_Watch(t *testing.T) {
+
+	mock := &mockedDataRepository{Data: map[string]map[string]api.Document{}, Now: aDate}
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: mock,
+		RuleChecker: rules.NewChecker([]rules.Rule{
+			{
+				Path: "test/{docId}",
+				Read: rules.Allow{
+					IfContent: `content.properties.k != "private"`,
+				},
+			},
+		}),
+	}
+
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/test?watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Unexpected status code, expected 200, got %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Unexpected content type, expected text/event-stream, got %s", contentType)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for _, request := range []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{"PUT", "/test/doc1", `{"id":"doc1","properties":{"k":"v"}}`},
+		{"PUT", "/test/doc2", `{"id":"doc2","properties":{"k":"private"}}`},
+		{"PUT", "/other/doc3", `{"id":"doc3","properties":{"k":"v"}}`},
+		{"DELETE", "/test/doc1", ``},
+	} {
+		req, _ := http.NewRequest(request.method, srv.URL+request.url, bytes.NewBufferString(request.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	expected := []string{
+		`event: put`,
+		`data: {"type":"put","path":"test/doc1","document":{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":1,"properties":{"k":"v"}}}`,
+		``,
+		`event: delete`,
+		`data: {"type":"delete","path":"test/doc1","document":{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":1,"properties":{"k":"v"}}}`,
+		``,
+	}
+
+	for i, e := range expected {
+		select {
+		case line := <-lines:
+			if line != e {
+				t.Errorf("Line %d: Unexpected event line, expected '%s', got '%s'", i, e, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Line %d: Timeout waiting for event", i)
+		}
+	}
+}
+
+func TestServeHTTP_WatchAfterLargeCommit(t *testing.T) {
+
+	h, err := Server(Config{
+		DBConnStr: "memory://",
+		Rules: []rules.Rule{
+			{Path: "test/{docId}", Read: rules.Allow{IfPath: "true"}, Write: rules.Allow{IfPath: "true"}},
+			{Path: "other/{docId}", Read: rules.Allow{IfPath: "true"}, Write: rules.Allow{IfPath: "true"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// watch returns the lines of the events of a new stream on other/doc1
+	watch := func() (chan string, io.Closer) {
+		resp, err := http.Get(srv.URL + "/other/doc1?watch=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := make(chan string, 10)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		return lines, resp.Body
+	}
+
+	lines, body := watch()
+	defer func() { body.Close() }()
+
+	// A single commit of more changes than a subscription may buffer
+	var operations []string
+	for i := 0; i < 3*subscriberBufferSize; i++ {
+		operations = append(operations, `{"op":"add","path":"test","data":{"k":"v"}}`)
+	}
+	resp, err := http.Post(srv.URL+"/_batch", "application/json", strings.NewReader(`{"operations":[`+strings.Join(operations, ",")+`]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Unexpected status code, expected 200, got %d", resp.StatusCode)
+	}
+
+	// The watchers may be reset, but the later changes are still watched
+	deadline := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		req, _ := http.NewRequest("PUT", srv.URL+"/other/doc1", strings.NewReader(fmt.Sprintf(`{"id":"doc1","properties":{"n":%d}}`, i)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		select {
+		case line, open := <-lines:
+			switch {
+			case line == "event: put":
+				return
+			case line == "event: reset" || !open:
+				body.Close()
+				lines, body = watch()
+			}
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timeout waiting for the change")
+		}
+	}
+}
+
+func TestIsStreaming(t *testing.T) {
+
+	for _, tc := range []struct {
+		method   string
+		url      string
+		expected bool
+	}{
+		{"GET", "/test?watch=true", true},
+		{"GET", "/test/doc1?watch=true", true},
+		{"GET", "/_ws", true},
+		{"GET", "/test", false},
+		{"GET", "/test?watch=false", false},
+		{"PUT", "/test/doc1?watch=true", false},
+	} {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		if got := IsStreaming(req); got != tc.expected {
+			t.Errorf("%s %s: expected %v, got %v", tc.method, tc.url, tc.expected, got)
+		}
+	}
+}
+
+func TestServeHTTP_WebSocket(t *testing.T) {
+
+	mock := &mockedDataRepository{
+		Data: map[string]map[string]api.Document{
+			"test": {"doc1": api.Document{
+				ID:                   "doc1",
+				CreationDate:         aDate,
+				LastModificationDate: aDate,
+				Properties:           map[string]interface{}{"k": "v"},
+			}},
+		},
+		Now: aDate,
+	}
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: mock,
+		RuleChecker: rules.NewChecker([]rules.Rule{
+			{
+				Path: "test/{docId}",
+				Read: rules.Allow{
+					IfPath: `user.id == "abcd"`,
+				},
+			},
+		}),
+	}
+
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/_ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exchanges := []struct {
+		request  string
+		expected []string
+	}{
+		{
+			request:  `{"type":"subscribe","id":"s1","path":"test/doc1"}`,
+			expected: []string{`{"type":"error","id":"s1","error":"Authentication required to access 'test/doc1'"}`},
+		},
+		{
+			request:  `{"type":"auth","token":""}`,
+			expected: []string{`{"type":"error","error":"missing token"}`},
+		},
+		{
+			request:  `{"type":"auth","token":"abcd"}`,
+			expected: []string{`{"type":"error","error":"Invalid credentials"}`},
+		},
+		{
+			request:  `{"type":"auth","token":"abcd||"}`,
+			expected: []string{`{"type":"authenticated"}`},
+		},
+		{
+			request:  `{"type":"subscribe","id":"s1","path":"test/doc1"}`,
+			expected: []string{`{"type":"snapshot","id":"s1","data":{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}}`},
+		},
+		{
+			request:  `{"type":"subscribe","id":"s2","path":"test"}`,
+			expected: []string{`{"type":"snapshot","id":"s2","data":{"id":"test","features":[{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}]}}`},
+		},
+		{
+			request:  `{"type":"unsubscribe","id":"s1"}`,
+			expected: []string{`{"type":"unsubscribed","id":"s1"}`},
+		},
+	}
+
+	for i, e := range exchanges {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(e.request)); err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range e.expected {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(message)) != expected {
+				t.Errorf("Exchange %d: Unexpected message, expected '%s', got '%s'", i, expected, message)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest("DELETE", srv.URL+"/test/doc1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"change","id":"s2","change":{"type":"delete","path":"test/doc1","document":{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","properties":{"k":"v"}}}}`
+	if strings.TrimSpace(string(message)) != expected {
+		t.Errorf("Unexpected change message, expected '%s', got '%s'", expected, message)
+	}
+}
+
+func TestServeHTTP_WebSocket_LargeCollection(t *testing.T) {
+
+	docs := make(map[string]api.Document)
+	for i := 0; i < defaultLimit+20; i++ {
+		id := fmt.Sprintf("doc%03d", i)
+		docs[id] = api.Document{ID: id, CreationDate: aDate, LastModificationDate: aDate, Revision: int64(i + 1)}
+	}
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: &mockedDataRepository{Data: map[string]map[string]api.Document{"test": docs}, Now: aDate},
+		RuleChecker:    rules.NewChecker(allowAll("test/{docId}")),
+	}
+
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/_ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","id":"s1","path":"test"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot struct {
+		Type string         `json:"type"`
+		Data api.Collection `json:"data"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Type != "snapshot" || len(snapshot.Data.Features) != defaultLimit || len(snapshot.Data.NextPageToken) == 0 {
+		t.Fatalf("The snapshot should be the first page, with a token for the next one: got %d documents, token '%s'", len(snapshot.Data.Features), snapshot.Data.NextPageToken)
+	}
+
+	// The other documents are retrieved with the token
+	resp, err := http.Get(srv.URL + "/test?pageToken=" + url.QueryEscape(snapshot.Data.NextPageToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var next api.Collection
+	if err := json.NewDecoder(resp.Body).Decode(&next); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Features) != 20 || next.Features[0].ID != "doc100" {
+		t.Errorf("Unexpected next page: %v", next.Features)
+	}
+}
+
+func TestChangeBroker_SlowSubscriber(t *testing.T) {
+
+	var b changeBroker
+	sub := b.subscribe(api.ObjectRef{"test"})
+
+	for i := 0; i <= subscriberBufferSize; i++ {
+		b.publish(api.Change{Type: api.Added, Target: api.ObjectRef{"test", "doc1"}})
+	}
+
+	received := 0
+	for range sub.changes {
+		received++
+	}
+	if received != subscriberBufferSize {
+		t.Errorf("Unexpected number of changes, expected %d, got %d", subscriberBufferSize, received)
+	}
+	if !sub.dropped {
+		t.Error("Slow subscriber should be reported as dropped")
+	}
+}
+
+func TestServeHTTP_Transactions(t *testing.T) {
+
+	mock := &mockedDataRepository{
+		Data: map[string]map[string]api.Document{
+			"test": {
+				"doc1": api.Document{ID: "doc1", CreationDate: aDate, LastModificationDate: aDate, Revision: 1, Properties: map[string]interface{}{"k": "v"}},
+				"doc2": api.Document{ID: "doc2", CreationDate: aDate, LastModificationDate: aDate, Revision: 2, Properties: map[string]interface{}{"k": "w"}},
+			},
+		},
+		Now:      aDate,
+		revision: 10,
+	}
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: mock,
+		RuleChecker: rules.NewChecker(append(allowAll("test/{docId}"), rules.Rule{
+			Path:   "checked/{docId}",
+			Schema: `{"properties": {"k": {"type": "string"}}}`,
+		})),
+	}
+
+	do := func(method, url, body string) (int, string) {
+		var b io.Reader
+		if body != "" {
+			b = bytes.NewBufferString(body)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "http://example.com"+url, b))
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(respBody))
+	}
+
+	begin := func(auth string) string {
+		code, body := do("POST", "/_transactions"+auth, "")
+		if code != 201 {
+			t.Fatalf("Unexpected status code when beginning transaction, expected 201, got %d", code)
+		}
+		var tx struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(body), &tx); err != nil || len(tx.ID) == 0 {
+			t.Fatalf("Invalid transaction: %s", body)
+		}
+		return tx.ID
+	}
+
+	type step struct {
+		method       string
+		url          string
+		body         string
+		expectedCode int
+		expectedBody string
+	}
+	run := func(name string, steps []step) {
+		for i, st := range steps {
+			code, body := do(st.method, st.url, st.body)
+			if code != st.expectedCode {
+				t.Errorf("%s, step %d: Unexpected status code, expected %d, got %d (%s)", name, i, st.expectedCode, code, body)
+			}
+			if code >= 400 {
+				// Errors are only compared by code, as their details contain the transaction ID
+				var p problem
+				if err := json.Unmarshal([]byte(body), &p); err == nil {
+					body = p.Code
+				}
+			}
+			if len(st.expectedBody) > 0 && body != st.expectedBody {
+				t.Errorf("%s, step %d: Unexpected body, expected '%s', got '%s'", name, i, st.expectedBody, body)
+			}
+		}
+	}
+
+	id := begin("")
+	run("Read your writes", []step{
+		{"GET", "/test/doc1?transaction=" + id, "", 200, `{"id":"doc1","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":1,"properties":{"k":"v"}}`},
+		{"PUT", "/test/doc2?transaction=" + id, `{"id":"doc2","properties":{"k":"w2"}}`, 204, ""},
+		{"GET", "/test/doc2?transaction=" + id, "", 200, `{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":11,"properties":{"k":"w2"}}`},
+		{"GET", "/test/doc2", "", 200, `{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":2,"properties":{"k":"w"}}`},
+		{"POST", "/_transactions/" + id, "", 204, ""},
+		{"GET", "/test/doc2", "", 200, `{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":11,"properties":{"k":"w2"}}`},
+		{"POST", "/_transactions/" + id, "", 404, "not_found"},
+	})
+
+	id = begin("")
+	run("Conflict on commit", []step{
+		{"GET", "/test/doc1?transaction=" + id, "", 200, ""},
+		{"PUT", "/test/doc1", `{"id":"doc1","properties":{"k":"v2"}}`, 204, ""},
+		{"PATCH", "/test/doc2?transaction=" + id, `{"k":"w3"}`, 204, ""},
+		{"POST", "/_transactions/" + id, "", 409, "conflict"},
+		{"GET", "/test/doc2", "", 200, `{"id":"doc2","creationDate":"2008-08-30T15:25:00Z","lastModificationDate":"2008-08-30T15:25:00Z","revision":11,"properties":{"k":"w2"}}`},
+	})
+
+	id = begin("")
+	run("Conflict on write", []step{
+		{"GET", "/test/doc1?transaction=" + id, "", 200, ""},
+		{"PATCH", "/test/doc1", `{"k":"v3"}`, 204, ""},
+		{"PUT", "/test/doc1?transaction=" + id, `{"id":"doc1","properties":{"k":"v4"}}`, 409, "conflict"},
+		{"POST", "/_transactions/" + id, "", 404, "not_found"},
+	})
+
+	id = begin("?auth=u1|n|e")
+	run("Rollback", []step{
+		{"DELETE", "/test/doc1?transaction=" + id + "&auth=u1|n|e", "", 204, ""},
+		{"POST", "/_transactions/" + id, "", 403, "forbidden"},
+		{"DELETE", "/_transactions/" + id + "?auth=u1|n|e", "", 204, ""},
+		{"GET", "/test/doc1", "", 200, ""},
+	})
+
+	id = begin("")
+	run("Invalid content", []step{
+		{"PUT", "/checked/doc1?transaction=" + id, `{"id":"doc1","properties":{"k":1}}`, 422, "invalid_content"},
+		{"PUT", "/checked/doc1?transaction=" + id, `{"id":"doc1","properties":{"k":"v"}}`, 204, ""},
+		{"POST", "/_transactions/" + id, "", 204, ""},
+		{"GET", "/checked/doc1", "", 200, ""},
+	})
+}
+
+func TestServeHTTP_TransactionLimits(t *testing.T) {
+
+	s := &server{
+		Authenticator:  mockedAuthenticator{},
+		DataRepository: &mockedDataRepository{Now: aDate},
+		RuleChecker:    rules.NewChecker(allowAll("test/{docId}")),
+	}
+
+	do := func(method, url string) (int, string) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "http://example.com"+url, nil))
+		resp := w.Result()
+		var p problem
+		json.NewDecoder(resp.Body).Decode(&p)
+		return resp.StatusCode, p.Code
+	}
+	begin := func(user int) (int, string) {
+		return do("POST", fmt.Sprintf("/_transactions?auth=u%d|n|e", user))
+	}
+
+	for i := 0; i < maxUserTransactions; i++ {
+		if code, _ := begin(0); code != 201 {
+			t.Fatalf("Transaction %d of the user should begin, got %d", i, code)
+		}
+	}
+	if code, errCode := begin(0); code != 429 || errCode != "too_many_requests" {
+		t.Errorf("Beyond the limit of the user, expected 429 too_many_requests, got %d %s", code, errCode)
+	}
+
+	for user := 1; len(s.Transactions.transactions) < maxTransactions; user++ {
+		if code, _ := begin(user); code != 201 {
+			t.Fatalf("Transaction of user %d should begin, got %d", user, code)
+		}
+	}
+	if code, errCode := begin(maxTransactions); code != 503 || errCode != "unavailable" {
+		t.Errorf("Beyond the global limit, expected 503 unavailable, got %d %s", code, errCode)
+	}
+
+	var id string
+	for id = range s.Transactions.transactions {
+		break
+	}
+	user := s.Transactions.transactions[id].userID
+	if code, _ := do("DELETE", "/_transactions/"+id+"?auth="+user+"|n|e"); code != 204 {
+		t.Fatalf("Rollback failed with %d", code)
+	}
+	if code, _ := begin(maxTransactions); code != 201 {
+		t.Errorf("A transaction should begin once another one ended, got %d", code)
+	}
+}
+
+func TestServer_MemoryRepository(t *testing.T) {
+
+	h, err := Server(Config{
+		DBConnStr: "memory://",
+		Rules: []rules.Rule{
+			{
+				Path:  "test/{docId}",
+				Read:  rules.Allow{IfPath: "true"},
+				Write: rules.Allow{IfPath: "true"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("PUT", srv.URL+"/test/doc1", bytes.NewBufferString(`{"id":"doc1","properties":{"k":"v"}}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("Unexpected status code, expected 204, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/test/doc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var d api.Document
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != "doc1" || d.Properties["k"] != "v" {
+		t.Errorf("Unexpected document: %v", d)
+	}
+
+	if _, err := Server(Config{DBConnStr: "memory://", SoftDelete: true}); err == nil {
+		t.Error("Soft delete should not be supported")
+	}
+	if _, err := Server(Config{DBConnStr: "memory://", DBSchema: "grest"}); err == nil {
+		t.Error("Schema should not be supported")
+	}
+}
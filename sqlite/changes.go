@@ -0,0 +1,79 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"log"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// subscriptionBufferSize is the number of changes a subscriber may lag behind before its subscription is closed
+const subscriptionBufferSize = 100
+
+// notify records the change, published when the transaction is committed
+func (tx *transaction) notify(changeType api.ChangeType, target api.ObjectRef, d api.Document) {
+	tx.changes = append(tx.changes, api.Change{
+		Type:     changeType,
+		Target:   target,
+		Document: d,
+	})
+}
+
+type subscription struct {
+	r       *repository
+	changes chan api.Change
+}
+
+func (s *subscription) Changes() <-chan api.Change {
+	return s.changes
+}
+
+func (s *subscription) Close() error {
+
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	if _, found := s.r.subscriptions[s]; found {
+		delete(s.r.subscriptions, s)
+		close(s.changes)
+	}
+
+	return nil
+}
+
+//Subscribe returns a subscription to the changes committed through the repository.
+//The changes committed by other processes sharing the database are not notified.
+func (r *repository) Subscribe() (api.Subscription, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &subscription{
+		r:       r,
+		changes: make(chan api.Change, subscriptionBufferSize),
+	}
+	r.subscriptions[s] = struct{}{}
+
+	return s, nil
+}
+
+// publish sends the committed changes to the subscribers
+func (r *repository) publish(changes []api.Change) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range changes {
+		for s := range r.subscriptions {
+			select {
+			case s.changes <- c:
+			default:
+				log.Println("Subscriber is too slow, closing its subscription")
+				delete(r.subscriptions, s)
+				close(s.changes)
+			}
+		}
+	}
+}
@@ -0,0 +1,836 @@
+//go:build cgo
+// +build cgo
+
+//Package sqlite implements a repository stored in a SQLite database, using its JSON functions.
+//
+//The documents are stored in the same t_document table as the postgresql repository.
+//Concurrent transactions are isolated, but a transaction writing after a concurrent one has committed fails,
+//as SQLite only allows a single writer. A transaction that wrote holds the lock of the database until it ends,
+//the other writers waiting for it during busyTimeout.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// driverName is the name of the SQLite driver providing the functions of the repository
+const driverName = "grest_sqlite3"
+
+// busyTimeout is the delay during which a transaction waits for the concurrent writer to end before failing
+const busyTimeout = 5 * time.Second
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if _, err := conn.Exec(fmt.Sprintf("PRAGMA busy_timeout = %d", busyTimeout/time.Millisecond), nil); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("grest_patch", patchContent, true)
+		},
+	})
+}
+
+// patchContent applies a patch to the content of a document, so that its operators are evaluated atomically (see api.ApplyPatch)
+func patchContent(content, patch, ts string) (string, error) {
+
+	var properties, operations map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &properties); err != nil {
+		return "", errors.Wrap(err, "DB decoding failed")
+	}
+	if err := json.Unmarshal([]byte(patch), &operations); err != nil {
+		return "", errors.Wrap(err, "unable to decode patch")
+	}
+	now, err := time.Parse(api.TimestampFormat, ts)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid timestamp")
+	}
+
+	res, err := api.ApplyPatch(properties, operations, now)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode content")
+	}
+	return string(b), nil
+}
+
+//New returns a repository stored in the database file at the given path, which is created if needed
+func New(path string) (api.Repository, error) {
+
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open "+path)
+	}
+
+	return &repository{
+		db:            db,
+		subscriptions: make(map[*subscription]struct{}),
+	}, nil
+}
+
+type repository struct {
+	db *sql.DB
+
+	mu            sync.Mutex
+	subscriptions map[*subscription]struct{}
+}
+
+type transaction struct {
+	r  *repository
+	tx *sql.Tx
+	// now is the date of the writes of the transaction, as CURRENT_TIMESTAMP in PostgreSQL
+	now string
+	// changes are published when the transaction is committed
+	changes []api.Change
+}
+
+type cursor struct {
+	rows *sql.Rows
+}
+
+type notFound string
+
+func (err notFound) IsNotFound() bool {
+	return true
+}
+func (err notFound) Error() string {
+	return string(err)
+}
+
+type revisionMismatch string
+
+func (err revisionMismatch) IsPreconditionFailed() bool {
+	return true
+}
+func (err revisionMismatch) Error() string {
+	return string(err)
+}
+
+func (r *repository) Init() error {
+
+	// Readers do not block the writer
+	if _, err := r.db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		return errors.Wrap(err, "PRAGMA journal_mode failed")
+	}
+
+	// Dates are stored as text, in a format preserving their order
+	if _, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS t_document (
+		collection TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		created    TEXT NOT NULL,
+		updated    TEXT NOT NULL,
+		content    TEXT NOT NULL,
+		revision   INTEGER NOT NULL,
+		CONSTRAINT t_document_pkey PRIMARY KEY (collection, id)
+	)`); err != nil {
+		return errors.Wrap(err, "CREATE TABLE t_document failed")
+	}
+
+	// Revisions are taken from a sequence, so that they are never reused, even when a document is deleted and created again
+	if _, err := r.db.Exec("CREATE TABLE IF NOT EXISTS s_document_revision (value INTEGER NOT NULL)"); err != nil {
+		return errors.Wrap(err, "CREATE TABLE s_document_revision failed")
+	}
+	if _, err := r.db.Exec("INSERT INTO s_document_revision (value) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM s_document_revision)"); err != nil {
+		return errors.Wrap(err, "INSERT INTO s_document_revision failed")
+	}
+
+	return nil
+}
+
+func (r *repository) Begin() (api.Transaction, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction{
+		r:   r,
+		tx:  tx,
+		now: time.Now().UTC().Format(api.TimestampFormat),
+	}, nil
+}
+
+func (tx *transaction) Commit() error {
+	if err := tx.tx.Commit(); err != nil {
+		return err
+	}
+	tx.r.publish(tx.changes)
+	return nil
+}
+
+func (tx *transaction) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// nextRevision returns the revision of a document being written
+func (tx *transaction) nextRevision() (int64, error) {
+
+	var revision int64
+	if err := tx.tx.QueryRow("UPDATE s_document_revision SET value=value+1 RETURNING value").Scan(&revision); err != nil {
+		return 0, errors.Wrap(err, "unable to get next revision")
+	}
+	return revision, nil
+}
+
+// scanner is implemented by sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDocument reads a document from a row made of the given columns, followed by its content, creation and last modification dates, and revision
+func scanDocument(row scanner, dest ...interface{}) (api.Document, error) {
+
+	var b []byte
+	var created, updated string
+	doc := api.Document{}
+	if err := row.Scan(append(dest, &b, &created, &updated, &doc.Revision)...); err != nil {
+		return api.Document{}, err
+	}
+
+	var err error
+	if doc.CreationDate, err = time.Parse(api.TimestampFormat, created); err != nil {
+		return api.Document{}, errors.Wrap(err, "DB decoding failed")
+	}
+	if doc.LastModificationDate, err = time.Parse(api.TimestampFormat, updated); err != nil {
+		return api.Document{}, errors.Wrap(err, "DB decoding failed")
+	}
+	if err := json.Unmarshal(b, &doc.Properties); err != nil {
+		return api.Document{}, errors.Wrap(err, "DB decoding failed")
+	}
+
+	return doc, nil
+}
+
+func (tx *transaction) Get(d api.ObjectRef) (api.Document, error) {
+
+	doc, err := scanDocument(tx.tx.QueryRow("SELECT content, created, updated, revision FROM t_document WHERE collection=?1 AND id=?2", d.Collection().String(), d.ID()))
+	if err == sql.ErrNoRows {
+		return api.Document{}, notFound("document not found")
+	}
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "DB retrieval failed")
+	}
+
+	doc.ID = d.ID()
+	return doc, nil
+}
+
+var sqlOperators = map[api.Operator]string{
+	api.Equal:          "=",
+	api.NotEqual:       "<>",
+	api.Less:           "<",
+	api.LessOrEqual:    "<=",
+	api.Greater:        ">",
+	api.GreaterOrEqual: ">=",
+}
+
+var columns = map[string]string{
+	"id":                   "id",
+	"creationDate":         "created",
+	"lastModificationDate": "updated",
+}
+
+// Kinds of the JSON values, in the order used to compare values of different kinds (see api.Compare)
+const (
+	kindNull = iota
+	kindString
+	kindNumber
+	kindBoolean
+	kindArray
+	kindObject
+)
+
+// propertyExpressions returns the expressions of the kind and of the SQL value of a document property, missing properties being null.
+// The path is given as a query parameter to avoid any SQL injection.
+func propertyExpressions(f api.FieldPath, args *[]interface{}) (string, string) {
+
+	path := "$"
+	for _, k := range f[1:] {
+		path += `."` + k + `"`
+	}
+	*args = append(*args, path)
+
+	kind := fmt.Sprintf(`CASE json_type(content,?%d) WHEN 'text' THEN %d WHEN 'integer' THEN %d WHEN 'real' THEN %d WHEN 'true' THEN %d WHEN 'false' THEN %d WHEN 'array' THEN %d WHEN 'object' THEN %d ELSE %d END`,
+		len(*args), kindString, kindNumber, kindNumber, kindBoolean, kindBoolean, kindArray, kindObject, kindNull)
+	value := fmt.Sprintf("json_extract(content,?%d)", len(*args))
+
+	return kind, value
+}
+
+// sqlValue returns the kind of a JSON value, and its value as returned by json_extract
+func sqlValue(v interface{}) (int, interface{}, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "unable to encode value")
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to decode value")
+	}
+
+	switch v := v.(type) {
+	case string:
+		return kindString, v, nil
+	case float64:
+		return kindNumber, v, nil
+	case bool:
+		if v {
+			return kindBoolean, 1, nil
+		}
+		return kindBoolean, 0, nil
+	case []interface{}:
+		return kindArray, string(b), nil
+	case map[string]interface{}:
+		return kindObject, string(b), nil
+	}
+	return kindNull, nil, nil
+}
+
+// jsonValue returns the JSON value of a property from its kind and the value returned by json_extract
+func jsonValue(kind int, v interface{}) (interface{}, error) {
+
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+
+	switch kind {
+	case kindString:
+		return v, nil
+	case kindNumber:
+		switch n := v.(type) {
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case kindBoolean:
+		n, _ := v.(int64)
+		return n != 0, nil
+	case kindArray, kindObject:
+		s, _ := v.(string)
+		var res interface{}
+		if err := json.Unmarshal([]byte(s), &res); err != nil {
+			return nil, errors.Wrap(err, "DB decoding failed")
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+func conditionClause(c api.Condition, args *[]interface{}) (string, error) {
+
+	op, found := sqlOperators[c.Operator]
+	if !found {
+		return "", errors.New("Unknown operator in where clause: " + string(c.Operator))
+	}
+
+	if c.Field.IsProperty() {
+
+		valueKind, value, err := sqlValue(c.Value)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid value of where clause")
+		}
+
+		kind, expr := propertyExpressions(c.Field, args)
+		*args = append(*args, valueKind, value)
+
+		// Values of different kinds are never equal, and cannot be compared with range operators
+		switch c.Operator {
+		case api.Equal:
+			return fmt.Sprintf("(%s=?%d AND %s IS ?%d)", kind, len(*args)-1, expr, len(*args)), nil
+		case api.NotEqual:
+			return fmt.Sprintf("NOT (%s=?%d AND %s IS ?%d)", kind, len(*args)-1, expr, len(*args)), nil
+		}
+		return fmt.Sprintf("(%s=?%d AND %s%s?%d)", kind, len(*args)-1, expr, op, len(*args)), nil
+	}
+
+	column, found := columns[c.Field.String()]
+	if !found {
+		return "", errors.New("Unknown field in where clause: " + c.Field.String())
+	}
+
+	var value interface{}
+	switch v := c.Value.(type) {
+	case string:
+		if column == "id" {
+			value = v
+		}
+	case time.Time:
+		if column != "id" {
+			value = v.UTC().Format(api.TimestampFormat)
+		}
+	}
+	if value == nil {
+		if c.Operator == api.NotEqual {
+			return "1", nil
+		}
+		return "0", nil
+	}
+
+	*args = append(*args, value)
+	return fmt.Sprintf("%s%s?%d", column, op, len(*args)), nil
+}
+
+type sortKey struct {
+	field api.FieldPath
+	// kind is set when the key is the kind of a property, which is sorted before its value
+	kind       bool
+	expr       string
+	descending bool
+}
+
+// sortKeys returns the expressions used to sort the documents, ending with the document ID to make the order deterministic
+func sortKeys(orderBy []api.Order, args *[]interface{}) ([]sortKey, error) {
+
+	orderBy = append(append([]api.Order{}, orderBy...), api.Order{Field: api.FieldPath{"id"}})
+
+	var keys []sortKey
+	for _, o := range orderBy {
+
+		if o.Field.IsProperty() {
+			kind, value := propertyExpressions(o.Field, args)
+			keys = append(keys,
+				sortKey{field: o.Field, kind: true, expr: kind, descending: o.Descending},
+				sortKey{field: o.Field, expr: value, descending: o.Descending},
+			)
+			continue
+		}
+
+		column, found := columns[o.Field.String()]
+		if !found {
+			return nil, errors.New("Unknown item in order by clause: " + o.String())
+		}
+		keys = append(keys, sortKey{field: o.Field, expr: column, descending: o.Descending})
+	}
+
+	return keys, nil
+}
+
+func orderByClause(keys []sortKey) string {
+
+	items := make([]string, len(keys))
+	for i, k := range keys {
+		items[i] = k.expr
+		if k.descending {
+			items[i] += " DESC"
+		}
+	}
+
+	return strings.Join(items, ",")
+}
+
+// startAfterClause returns the condition selecting the documents sorted after d:
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+func startAfterClause(keys []sortKey, d api.Document, args *[]interface{}) (string, error) {
+
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		v := k.field.Value(d)
+		if k.field.IsProperty() {
+			kind, value, err := sqlValue(v)
+			if err != nil {
+				return "", errors.Wrap(err, "invalid start after value")
+			}
+			if k.kind {
+				v = kind
+			} else {
+				v = value
+			}
+		} else if t, ok := v.(time.Time); ok {
+			v = t.UTC().Format(api.TimestampFormat)
+		}
+		*args = append(*args, v)
+		values[i] = fmt.Sprintf("?%d", len(*args))
+	}
+
+	alternatives := make([]string, len(keys))
+	for i, k := range keys {
+		var items []string
+		for j := 0; j < i; j++ {
+			// Properties may be null
+			items = append(items, keys[j].expr+" IS "+values[j])
+		}
+		op := ">"
+		if k.descending {
+			op = "<"
+		}
+		items = append(items, k.expr+op+values[i])
+		alternatives[i] = "(" + strings.Join(items, " AND ") + ")"
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", nil
+}
+
+func (tx *transaction) GetAll(c api.ObjectRef, query api.Query) (api.Cursor, error) {
+
+	args := []interface{}{c.String()}
+	whereString := "collection=?1"
+	for _, condition := range query.Filter {
+		clause, err := conditionClause(condition, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	keys, err := sortKeys(query.OrderBy, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.StartAfter != nil {
+		clause, err := startAfterClause(keys, *query.StartAfter, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	rows, err := tx.tx.Query("SELECT id, content, created, updated, revision FROM t_document WHERE "+whereString+" ORDER BY "+orderByClause(keys), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+
+	return &cursor{rows: rows}, nil
+}
+
+func aggregationExpression(a api.Aggregation, args *[]interface{}) (string, error) {
+
+	if len(a.Field) == 0 {
+		if a.Function != api.Count {
+			return "", errors.New("Missing field in aggregation: " + a.String())
+		}
+		return "COUNT(*)", nil
+	}
+
+	if !a.Field.IsProperty() {
+		return "", errors.New("Only properties can be aggregated: " + a.String())
+	}
+
+	kind, expr := propertyExpressions(a.Field, args)
+	if a.Function == api.Count {
+		return fmt.Sprintf("COUNT(NULLIF(%s,%d))", kind, kindNull), nil
+	}
+
+	// Only numeric values are considered
+	number := fmt.Sprintf("CASE WHEN %s=%d THEN %s END", kind, kindNumber, expr)
+	switch a.Function {
+	case api.Sum:
+		return "SUM(" + number + ")", nil
+	case api.Min:
+		return "MIN(" + number + ")", nil
+	case api.Max:
+		return "MAX(" + number + ")", nil
+	case api.Avg:
+		return "AVG(" + number + ")", nil
+	}
+
+	return "", errors.New("Unknown aggregate function: " + string(a.Function))
+}
+
+func (tx *transaction) Aggregate(c api.ObjectRef, filter api.Filter, groupBy api.FieldPath, aggregations []api.Aggregation) ([]api.AggregateResult, error) {
+
+	args := []interface{}{c.String()}
+	whereString := "collection=?1"
+	for _, condition := range filter {
+		clause, err := conditionClause(condition, &args)
+		if err != nil {
+			return nil, err
+		}
+		whereString += " AND " + clause
+	}
+
+	// The group is always given by the first two selected items, its kind and its value, null when not grouping
+	items := []string{fmt.Sprint(kindNull), "NULL"}
+	groupByString := ""
+	if len(groupBy) > 0 {
+		if !groupBy.IsProperty() {
+			return nil, errors.New("Only properties can be used to group documents: " + groupBy.String())
+		}
+		items[0], items[1] = propertyExpressions(groupBy, &args)
+		groupByString = " GROUP BY 1, 2 ORDER BY 1, 2"
+	}
+
+	for _, a := range aggregations {
+		expr, err := aggregationExpression(a, &args)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, expr)
+	}
+
+	rows, err := tx.tx.Query("SELECT "+strings.Join(items, ",")+" FROM t_document WHERE "+whereString+groupByString, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+	defer rows.Close()
+
+	results := []api.AggregateResult{}
+	for rows.Next() {
+
+		var kind int
+		var group interface{}
+		counts := make([]int64, len(aggregations))
+		numbers := make([]sql.NullFloat64, len(aggregations))
+
+		dest := []interface{}{&kind, &group}
+		for i, a := range aggregations {
+			if a.Function == api.Count {
+				dest = append(dest, &counts[i])
+			} else {
+				dest = append(dest, &numbers[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "DB retrieval failed")
+		}
+
+		r := api.AggregateResult{
+			Values: make(map[string]interface{}),
+		}
+		if r.Group, err = jsonValue(kind, group); err != nil {
+			return nil, err
+		}
+		for i, a := range aggregations {
+			if a.Function == api.Count {
+				r.Values[a.String()] = counts[i]
+			} else if numbers[i].Valid {
+				r.Values[a.String()] = numbers[i].Float64
+			} else {
+				r.Values[a.String()] = nil
+			}
+		}
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+func (c *cursor) Close() error {
+	if err := c.rows.Close(); err != nil {
+		return errors.Wrap(err, "DB query failed")
+	}
+	return nil
+}
+
+func (c *cursor) Fetch(count int) ([]api.Document, error) {
+
+	var result []api.Document
+	for len(result) < count && c.rows.Next() {
+		var id string
+		doc, err := scanDocument(c.rows, &id)
+		if err != nil {
+			return nil, errors.Wrap(err, "DB retrieval failed")
+		}
+		doc.ID = id
+		result = append(result, doc)
+	}
+
+	if err := c.rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "DB query failed")
+	}
+	return result, nil
+}
+
+func (tx *transaction) Add(c api.ObjectRef, payload api.DocumentProperties) (api.Document, error) {
+
+	id := api.NextID()
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "unable to encode payload")
+	}
+
+	revision, err := tx.nextRevision()
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	row := tx.tx.QueryRow("INSERT INTO t_document (collection, id, created, updated, content, revision) VALUES (?1,?2,?3,?3,?4,?5) RETURNING content, created, updated, revision", c.String(), id, tx.now, string(b), revision)
+
+	d, err := scanDocument(row)
+	if err != nil {
+		return api.Document{}, errors.Wrap(err, "unable to insert document")
+	}
+	d.ID = id
+
+	tx.notify(api.Added, append(c[:len(c):len(c)], id), d)
+
+	return d, nil
+}
+
+// write executes a query writing a single document and returning its content, dates and revision, and notifies the change.
+// It returns sql.ErrNoRows if no document was written.
+func (tx *transaction) write(changeType api.ChangeType, d api.ObjectRef, query string, args ...interface{}) error {
+
+	doc, err := scanDocument(tx.tx.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to write document")
+	}
+	doc.ID = d.ID()
+
+	tx.notify(changeType, d, doc)
+	return nil
+}
+
+func (tx *transaction) Put(d api.ObjectRef, payload api.DocumentProperties) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
+	}
+
+	next, err := tx.nextRevision()
+	if err != nil {
+		return err
+	}
+
+	return tx.write(api.Put, d, "INSERT INTO t_document (collection, id, created, updated, content, revision) VALUES (?2,?3,?4,?4,?5,?1) ON CONFLICT(collection,id) DO UPDATE SET content=?5,updated=?4,revision=?1 RETURNING content, created, updated, revision", next, d.Collection().String(), d.ID(), tx.now, string(b))
+}
+
+func (tx *transaction) PutIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
+	}
+
+	next, err := tx.nextRevision()
+	if err != nil {
+		return err
+	}
+
+	if revision == 0 {
+		err = tx.write(api.Put, d, "INSERT INTO t_document (collection, id, created, updated, content, revision) VALUES (?2,?3,?4,?4,?5,?1) ON CONFLICT(collection,id) DO NOTHING RETURNING content, created, updated, revision", next, d.Collection().String(), d.ID(), tx.now, string(b))
+	} else {
+		err = tx.write(api.Put, d, "UPDATE t_document SET content=?2,updated=?3,revision=?1 WHERE collection=?4 AND id=?5 AND revision=?6 RETURNING content, created, updated, revision", next, string(b), tx.now, d.Collection().String(), d.ID(), revision)
+	}
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
+}
+
+func (tx *transaction) Patch(d api.ObjectRef, payload api.DocumentProperties) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
+	}
+
+	next, err := tx.nextRevision()
+	if err != nil {
+		return err
+	}
+
+	err = tx.write(api.Patched, d, "UPDATE t_document SET content=grest_patch(content,?2,?3),updated=?3,revision=?1 WHERE collection=?4 AND id=?5 RETURNING content, created, updated, revision", next, string(b), tx.now, d.Collection().String(), d.ID())
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (tx *transaction) PatchIfRevision(d api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode payload")
+	}
+
+	next, err := tx.nextRevision()
+	if err != nil {
+		return err
+	}
+
+	err = tx.write(api.Patched, d, "UPDATE t_document SET content=grest_patch(content,?2,?3),updated=?3,revision=?1 WHERE collection=?4 AND id=?5 AND revision=?6 RETURNING content, created, updated, revision", next, string(b), tx.now, d.Collection().String(), d.ID(), revision)
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
+}
+
+func (tx *transaction) Delete(d api.ObjectRef) error {
+
+	err := tx.write(api.Deleted, d, "DELETE FROM t_document WHERE collection=?1 AND id=?2 RETURNING content, created, updated, revision", d.Collection().String(), d.ID())
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (tx *transaction) DeleteIfRevision(d api.ObjectRef, revision int64) error {
+
+	err := tx.write(api.Deleted, d, "DELETE FROM t_document WHERE collection=?1 AND id=?2 AND revision=?3 RETURNING content, created, updated, revision", d.Collection().String(), d.ID(), revision)
+	if err == sql.ErrNoRows {
+		return revisionMismatch("document revision mismatch")
+	}
+	return err
+}
+
+// CheckRevision takes the write lock of the database, so that the document cannot be modified until the transaction ends.
+// It fails if the database was modified since the transaction first read it, as the transaction cannot write anymore.
+func (tx *transaction) CheckRevision(d api.ObjectRef, revision int64) error {
+
+	if _, err := tx.tx.Exec("UPDATE s_document_revision SET value=value"); err != nil {
+		if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == sqlite3.ErrBusySnapshot {
+			return revisionMismatch("database modified by a concurrent transaction")
+		}
+		return errors.Wrap(err, "unable to lock the database")
+	}
+
+	var current int64
+	err := tx.tx.QueryRow("SELECT revision FROM t_document WHERE collection=?1 AND id=?2", d.Collection().String(), d.ID()).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "DB retrieval failed")
+	}
+	if current != revision {
+		return revisionMismatch("document revision mismatch")
+	}
+	return nil
+}
+
+func (tx *transaction) DeleteCollection(c api.ObjectRef) error {
+
+	rows, err := tx.tx.Query("DELETE FROM t_document WHERE collection=?1 RETURNING id, content, created, updated, revision", c.String())
+	if err != nil {
+		return errors.Wrap(err, "unable to delete collection")
+	}
+
+	var deleted []api.Document
+	for rows.Next() {
+		var id string
+		doc, err := scanDocument(rows, &id)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "DB retrieval failed")
+		}
+		doc.ID = id
+		deleted = append(deleted, doc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "unable to delete collection")
+	}
+
+	for _, doc := range deleted {
+		tx.notify(api.Deleted, append(c[:len(c):len(c)], doc.ID), doc)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+	"github.com/xdbsoft/grest/repotest"
+)
+
+// dir contains the databases created by the tests
+var dir string
+
+func TestMain(m *testing.M) {
+
+	var err error
+	dir, err = ioutil.TempDir("", "grest")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newRepository(t *testing.T) api.Repository {
+
+	r, err := New(filepath.Join(dir, api.NextID()+".db"))
+	if err == nil {
+		err = r.Init()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, newRepository)
+}
+
+func TestGetAllKinds(t *testing.T) {
+
+	r := newRepository(t)
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	c := api.ObjectRef{"test_kinds"}
+	for _, p := range []api.DocumentProperties{
+		{"v": true},
+		{"v": 1},
+		{"v": "1"},
+		{"v": nil},
+		{},
+		{"v": []interface{}{1}},
+		{"v": map[string]interface{}{"a": 1}},
+	} {
+		if _, err := tx.Add(c, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		condition api.Condition
+		expected  int
+	}{
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.Equal, Value: 1}, 1},
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.Equal, Value: true}, 1},
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.Equal, Value: nil}, 2},
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.NotEqual, Value: nil}, 5},
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.GreaterOrEqual, Value: 0}, 1},
+		{api.Condition{Field: api.FieldPath{"properties", "v"}, Operator: api.Equal, Value: map[string]interface{}{"a": 1}}, 1},
+	} {
+		cu, err := tx.GetAll(c, api.Query{Filter: api.Filter{test.condition}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := cu.Fetch(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cu.Close()
+
+		if len(all) != test.expected {
+			t.Errorf("Invalid list length for %v, got %d, expected %d", test.condition, len(all), test.expected)
+		}
+	}
+
+	cu, err := tx.GetAll(c, api.Query{OrderBy: []api.Order{{Field: api.FieldPath{"properties", "v"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := cu.Fetch(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cu.Close()
+
+	for i := 1; i < len(all); i++ {
+		if api.CompareDocuments(all[i-1], all[i], []api.Order{{Field: api.FieldPath{"properties", "v"}}}) > 0 {
+			t.Errorf("Invalid order: %v before %v", all[i-1].Properties, all[i].Properties)
+		}
+	}
+}
+
+func TestIsolation(t *testing.T) {
+
+	d := api.ObjectRef{"test_isolation", "doc1"}
+
+	r := newRepository(t)
+
+	tx1, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx1.Rollback()
+
+	if err := tx1.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx2, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx2.Rollback()
+
+	if _, err := tx2.Get(d); err == nil {
+		t.Error("Uncommitted document should not be visible to other transactions")
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+
+	d := api.ObjectRef{"test_subscribe", "doc1"}
+
+	r := newRepository(t)
+
+	s, err := r.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tx, err := r.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(d, api.DocumentProperties{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Patch(d, api.DocumentProperties{"k": "v2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-s.Changes():
+		t.Fatalf("Change notified before commit: %v", c)
+	default:
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []api.ChangeType{api.Put, api.Patched} {
+		select {
+		case c := <-s.Changes():
+			if c.Type != expected || c.Target.String() != d.String() {
+				t.Errorf("Invalid change: got %s %s, expected %s %s", c.Type, c.Target, expected, d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Change not notified")
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package grest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// transactionsPath is the path of the endpoint where clients begin, commit and roll back transactions
+const transactionsPath = "/_transactions"
+
+// transactionTimeout is the delay after which a transaction that was neither committed nor rolled back is rolled back.
+// On SQLite, a transaction that wrote blocks the other writers until it ends, so they may wait for this long.
+const transactionTimeout = 30 * time.Second
+
+// maxUserTransactions is the maximum number of ongoing transactions of a user
+const maxUserTransactions = 10
+
+// maxTransactions is the maximum number of ongoing transactions of all the users,
+// so that they do not exhaust the connections of the datastore
+const maxTransactions = 100
+
+// clientTransaction is a transaction driven by a client over several requests.
+// It records the revisions of the documents read by the client, so that writing them or committing
+// fails with a conflict if any of them was modified by someone else in the meantime.
+// Reads performed in the transaction see its own writes.
+type clientTransaction struct {
+	api.Transaction `json:"-"`
+
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	userID  string
+	timer   *time.Timer
+	mu      sync.Mutex
+	done    bool
+	reads   map[string]api.Document
+	written map[string]bool
+}
+
+func newTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get reads the document, and records its revision the first time it is read, unless it was written before
+func (t *clientTransaction) Get(document api.ObjectRef) (api.Document, error) {
+
+	d, err := t.Transaction.Get(document)
+
+	key := document.String()
+	if _, found := t.reads[key]; !found && !t.written[key] {
+		if err == nil {
+			t.reads[key] = d
+		} else if IsNotFound(err) {
+			// The document must still not exist when committing
+			t.reads[key] = api.Document{}
+		}
+	}
+
+	return d, err
+}
+
+// expectedRevision returns the revision of the document when it was read, if it was read and not written since
+func (t *clientTransaction) expectedRevision(document api.ObjectRef) (int64, bool) {
+	key := document.String()
+	d, found := t.reads[key]
+	return d.Revision, found && !t.written[key]
+}
+
+// conditionalWrite performs a write that only succeeds if the document is still as the client read it.
+// A revision of -1 means that the caller does not require any revision.
+func (t *clientTransaction) conditionalWrite(document api.ObjectRef, revision int64, write func(revision int64) error, unconditionalWrite func() error) error {
+
+	expected, tracked := t.expectedRevision(document)
+
+	var err error
+	switch {
+	case tracked && revision >= 0 && revision != expected:
+		return conflictError{document}
+	case tracked:
+		err = write(expected)
+		if IsPreconditionFailed(err) {
+			return conflictError{document}
+		}
+	case revision >= 0:
+		err = write(revision)
+	default:
+		err = unconditionalWrite()
+	}
+	if err != nil {
+		return err
+	}
+
+	t.written[document.String()] = true
+	return nil
+}
+
+func (t *clientTransaction) Add(collection api.ObjectRef, payload api.DocumentProperties) (api.Document, error) {
+
+	d, err := t.Transaction.Add(collection, payload)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	t.written[append(collection[:len(collection):len(collection)], d.ID).String()] = true
+	return d, nil
+}
+
+func (t *clientTransaction) Put(document api.ObjectRef, payload api.DocumentProperties) error {
+	return t.PutIfRevision(document, payload, -1)
+}
+
+func (t *clientTransaction) PutIfRevision(document api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	return t.conditionalWrite(document, revision, func(revision int64) error {
+		return t.Transaction.PutIfRevision(document, payload, revision)
+	}, func() error {
+		return t.Transaction.Put(document, payload)
+	})
+}
+
+func (t *clientTransaction) Patch(document api.ObjectRef, payload api.DocumentProperties) error {
+	return t.PatchIfRevision(document, payload, -1)
+}
+
+func (t *clientTransaction) PatchIfRevision(document api.ObjectRef, payload api.DocumentProperties, revision int64) error {
+	return t.conditionalWrite(document, revision, func(revision int64) error {
+		return t.Transaction.PatchIfRevision(document, payload, revision)
+	}, func() error {
+		return t.Transaction.Patch(document, payload)
+	})
+}
+
+func (t *clientTransaction) Delete(document api.ObjectRef) error {
+	return t.DeleteIfRevision(document, -1)
+}
+
+func (t *clientTransaction) DeleteIfRevision(document api.ObjectRef, revision int64) error {
+	return t.conditionalWrite(document, revision, func(revision int64) error {
+		return t.Transaction.DeleteIfRevision(document, revision)
+	}, func() error {
+		return t.Transaction.Delete(document)
+	})
+}
+
+// Commit commits the transaction, unless one of the documents that were only read was modified in the meantime.
+// Documents that were written are already protected by their conditional writes.
+// The revisions of the read documents are checked by the datastore, atomically with the commit.
+func (t *clientTransaction) Commit() error {
+
+	for key, read := range t.reads {
+		if t.written[key] {
+			continue
+		}
+
+		target, err := getTarget(key)
+		if err != nil {
+			t.Transaction.Rollback()
+			return err
+		}
+
+		// A missing document has no revision, as expected by CheckRevision
+		if err := t.Transaction.CheckRevision(target, read.Revision); err != nil {
+			t.Transaction.Rollback()
+			if IsPreconditionFailed(err) {
+				return conflictError{target}
+			}
+			return err
+		}
+	}
+
+	// The datastore does not tell which document was modified
+	err := t.Transaction.Commit()
+	if IsPreconditionFailed(err) {
+		return conflictError{}
+	}
+	return err
+}
+
+// transactionRegistry keeps the ongoing client transactions.
+// Its zero value is ready to use.
+type transactionRegistry struct {
+	mu           sync.Mutex
+	transactions map[string]*clientTransaction
+	users        map[string]int // Number of ongoing transactions of each user
+}
+
+// add registers the transaction, unless its user or all the users already have too many ongoing transactions
+func (reg *transactionRegistry) add(t *clientTransaction) error {
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if len(reg.transactions) >= maxTransactions {
+		return tooManyTransactionsError{Global: true}
+	}
+	if reg.users[t.userID] >= maxUserTransactions {
+		return tooManyTransactionsError{}
+	}
+
+	if reg.transactions == nil {
+		reg.transactions = make(map[string]*clientTransaction)
+		reg.users = make(map[string]int)
+	}
+	reg.transactions[t.ID] = t
+	reg.users[t.userID]++
+	return nil
+}
+
+func (reg *transactionRegistry) get(id string) *clientTransaction {
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return reg.transactions[id]
+}
+
+func (reg *transactionRegistry) remove(id string) *clientTransaction {
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	t := reg.transactions[id]
+	if t == nil {
+		return nil
+	}
+
+	delete(reg.transactions, id)
+	if reg.users[t.userID]--; reg.users[t.userID] == 0 {
+		delete(reg.users, t.userID)
+	}
+	return t
+}
+
+func (s *server) BeginTransaction(user api.User) (*clientTransaction, error) {
+
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &clientTransaction{
+		ID:      id,
+		userID:  user.ID,
+		reads:   make(map[string]api.Document),
+		written: make(map[string]bool),
+	}
+
+	// The transaction is registered before it is begun, so that no datastore transaction is begun beyond the limits.
+	// Its ID is not known by the client yet, so it cannot be used in the meantime.
+	if err := s.Transactions.add(t); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		s.Transactions.remove(id)
+		return nil, err
+	}
+
+	t.Transaction = tx
+	t.ExpiresAt = time.Now().Add(transactionTimeout)
+	t.timer = time.AfterFunc(transactionTimeout, func() {
+		log.Printf("Transaction %s expired, rolling it back", id)
+		s.endTransaction(id, false)
+	})
+
+	return t, nil
+}
+
+// transaction returns the ongoing transaction, locked, if it was begun by the user.
+// The caller must unlock it.
+func (s *server) transaction(id string, user api.User) (*clientTransaction, error) {
+
+	target := api.ObjectRef{strings.TrimPrefix(transactionsPath, "/"), id}
+
+	t := s.Transactions.get(id)
+	if t == nil {
+		return nil, notFoundError{target}
+	}
+	if t.userID != user.ID {
+		return nil, forbiddenError{Target: target}
+	}
+
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return nil, notFoundError{target}
+	}
+
+	return t, nil
+}
+
+// endTransaction commits or rolls back the transaction, and forgets it
+func (s *server) endTransaction(id string, commit bool) error {
+
+	t := s.Transactions.remove(id)
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return nil
+	}
+	t.done = true
+	t.timer.Stop()
+
+	if commit {
+		return t.Commit()
+	}
+	return t.Transaction.Rollback()
+}
+
+func (s *server) CommitTransaction(id string, user api.User) error {
+
+	t, err := s.transaction(id, user)
+	if err != nil {
+		return err
+	}
+	t.mu.Unlock()
+
+	return s.endTransaction(id, true)
+}
+
+func (s *server) RollbackTransaction(id string, user api.User) error {
+
+	t, err := s.transaction(id, user)
+	if err != nil {
+		return err
+	}
+	t.mu.Unlock()
+
+	return s.endTransaction(id, false)
+}
+
+// serveTransactions begins a transaction on POST /_transactions, and commits (POST) or rolls back (DELETE) it on /_transactions/{id}
+func (s *server) serveTransactions(w http.ResponseWriter, r *http.Request, user api.User) {
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, transactionsPath), "/")
+
+	var err error
+	switch {
+	case len(id) == 0 && r.Method == "POST":
+		t, err := s.BeginTransaction(user)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(t); err != nil {
+			log.Println("Error: ", err)
+		}
+		return
+	case len(id) > 0 && r.Method == "POST":
+		err = s.CommitTransaction(id, user)
+	case len(id) > 0 && r.Method == "DELETE":
+		err = s.RollbackTransaction(id, user)
+	default:
+		err = badRequest("unsupported method")
+	}
+
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	s.handleResponse(w, r, nil)
+}
+
+// serveInTransaction reads or writes a document in the transaction of the client
+func (s *server) serveInTransaction(w http.ResponseWriter, r *http.Request, id string, target api.ObjectRef, user api.User) {
+
+	t, err := s.transaction(id, user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer t.mu.Unlock()
+
+	var data interface{}
+	var written *api.Document
+
+	switch {
+	case target.IsDocument() && r.Method == "GET":
+		data, err = s.getDocument(t, target, user)
+	case target.IsDocument() && r.Method == "PUT":
+		var payload api.Document
+		if err := getPayload(r, &payload); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		var doc api.Document
+		doc, err = s.putDocument(t, target, payload, getPreconditions(r), user)
+		written = &doc
+	case target.IsDocument() && (r.Method == "PATCH" || r.Method == "POST"):
+		var payload patch
+		if err := getPatch(r, &payload); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		var doc api.Document
+		doc, err = s.patchDocument(t, target, payload, getPreconditions(r), user)
+		written = &doc
+	case target.IsDocument() && r.Method == "DELETE":
+		err = s.deleteDocument(t, target, getPreconditions(r), user)
+	case !target.IsDocument() && r.Method == "POST":
+		payload := make(api.DocumentProperties)
+		if err := getPayload(r, &payload); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		data, err = s.addDocument(t, target, payload, user)
+	default:
+		err = badRequest("unsupported method in a transaction")
+	}
+
+	if err != nil {
+		// A transaction with a conflict cannot be committed anymore, and a failed query may have aborted it
+		if IsConflict(err) || !(IsBadRequest(err) || IsNotAuthorized(err) || IsForbidden(err) || IsNotFound(err) || IsPreconditionFailed(err) || IsInvalidContent(err)) {
+			t.done = true
+			t.timer.Stop()
+			s.Transactions.remove(id)
+			t.Transaction.Rollback()
+		}
+		handleError(w, r, err)
+		return
+	}
+
+	if written != nil {
+		if etag, err := s.computeEtag(*written); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
+	s.handleResponse(w, r, data)
+}
@@ -0,0 +1,144 @@
+package grest
+
+import (
+	"log"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// purgeInterval is the delay between two purges of the documents deleted for longer than the retention period
+const purgeInterval = time.Hour
+
+// purge periodically removes the documents deleted for longer than the retention period
+func purge(p api.Purger) {
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := p.Purge()
+		if err != nil {
+			log.Println("Error: ", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("%d deleted documents purged", n)
+		}
+	}
+}
+
+// recycleBin returns the deleted documents of the transaction, if the datastore keeps them
+func recycleBin(tx api.Transaction) (api.RecycleBin, error) {
+	b, ok := tx.(api.RecycleBin)
+	if !ok {
+		return nil, badRequest("Restoring deleted documents is not supported by the datastore")
+	}
+	return b, nil
+}
+
+func (s *server) GetTrash(target api.ObjectRef, user api.User) (api.Trash, error) {
+
+	r, err := s.GetRuleAndCheckPath(target, user, true)
+	if err != nil {
+		return api.Trash{}, err
+	}
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return api.Trash{}, err
+	}
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	b, err := recycleBin(tx)
+	if err != nil {
+		return api.Trash{}, err
+	}
+
+	trashed, err := b.GetTrash(target)
+	if err != nil {
+		return api.Trash{}, err
+	}
+
+	t := api.Trash{
+		ID:       target.ID(),
+		Features: []api.TrashedDocument{},
+	}
+
+	// Only the documents that the user would have been allowed to delete are listed
+	checker := r.PrepareCheckContent(true, s.GetDocument)
+	for _, d := range trashed {
+		ok, err := checker.Check(d.Document, api.Document{})
+		if err != nil {
+			return api.Trash{}, err
+		}
+		if ok {
+			t.Features = append(t.Features, d)
+		}
+	}
+
+	return t, nil
+}
+
+func (s *server) RestoreDocument(target api.ObjectRef, user api.User) (api.Document, error) {
+
+	r, err := s.GetRuleAndCheckPath(target, user, true)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	tx, err := s.DataRepository.Begin()
+	if err != nil {
+		return api.Document{}, err
+	}
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	b, err := recycleBin(tx)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	_, err = tx.Get(target)
+	if err == nil {
+		err = alreadyExistsError{target}
+		return api.Document{}, err
+	}
+	if !IsNotFound(err) {
+		return api.Document{}, err
+	}
+
+	restored, err := b.Restore(target)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	// Restoring a document is allowed to the users allowed to create it
+	ok, err := r.PrepareCheckContent(true, s.GetDocument).Check(api.Document{}, restored)
+	if err != nil {
+		return api.Document{}, err
+	}
+	if !ok {
+		err = s.denied(target, r, user, true)
+		return api.Document{}, err
+	}
+
+	// The schema may have changed since the document was deleted
+	err = validateContent(r, target, restored.Properties)
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	return restored, tx.Commit()
+}
@@ -0,0 +1,232 @@
+package grest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// subscriberBufferSize is the number of changes a subscriber may lag behind before being disconnected
+const subscriberBufferSize = 100
+
+// keepAliveInterval is the delay between two comments sent on idle event streams.
+// It is shorter than the timeouts of grest_server and of the usual proxies, so that idle streams are not cut.
+const keepAliveInterval = 5 * time.Second
+
+// resubscribeDelay is the delay between two attempts to subscribe again to the repository changes
+const resubscribeDelay = time.Second
+
+type subscriber struct {
+	target  api.ObjectRef
+	changes chan api.Change
+	// dropped is set before changes is closed, when the subscriber may have missed changes:
+	// it lags too far behind, or the subscription of the server to the repository was closed
+	dropped bool
+}
+
+// watches returns whether the subscriber is interested in changes of the given document
+func (sub *subscriber) watches(document api.ObjectRef) bool {
+	if sub.target.IsDocument() {
+		return sub.target.String() == document.String()
+	}
+	return sub.target.String() == document.Collection().String()
+}
+
+// changeBroker dispatches the committed changes to the subscribers watching them.
+// Its zero value is ready to use.
+type changeBroker struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func (b *changeBroker) subscribe(target api.ObjectRef) *subscriber {
+
+	sub := &subscriber{
+		target:  target,
+		changes: make(chan api.Change, subscriberBufferSize),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[*subscriber]struct{})
+	}
+	b.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+func (b *changeBroker) unsubscribe(sub *subscriber) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, found := b.subscribers[sub]; found {
+		delete(b.subscribers, sub)
+		close(sub.changes)
+	}
+}
+
+// publish sends the change to the interested subscribers, without blocking:
+// subscribers lagging too far behind are disconnected.
+func (b *changeBroker) publish(c api.Change) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if !sub.watches(c.Target) {
+			continue
+		}
+		select {
+		case sub.changes <- c:
+		default:
+			log.Printf("Subscriber to '%s' is too slow, disconnecting it", sub.target)
+			delete(b.subscribers, sub)
+			sub.dropped = true
+			close(sub.changes)
+		}
+	}
+}
+
+// reset disconnects all the subscribers, which may have missed changes
+func (b *changeBroker) reset() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		sub.dropped = true
+		close(sub.changes)
+	}
+}
+
+// listen dispatches the changes committed on the repository, possibly by other instances, to the watchers
+func (s *server) listen() error {
+
+	sub, err := s.DataRepository.Subscribe()
+	if err != nil {
+		return err
+	}
+
+	go s.dispatch(sub)
+
+	return nil
+}
+
+// dispatch forwards the changes of the subscription to the watchers.
+// The repository closes the subscription when the server lags too far behind, such as after a commit of many writes:
+// the server then subscribes again, and resets the watchers so that they read again what they missed.
+func (s *server) dispatch(sub api.Subscription) {
+
+	for {
+		for c := range sub.Changes() {
+			s.Changes.publish(c)
+		}
+		sub.Close()
+		log.Println("Subscription to the repository changes closed, subscribing again")
+
+		for {
+			var err error
+			if sub, err = s.DataRepository.Subscribe(); err == nil {
+				break
+			}
+			log.Println("Error: ", err)
+			time.Sleep(resubscribeDelay)
+		}
+
+		// The watchers are reset once subscribed again, so that no change is missed after they reconnect
+		s.Changes.reset()
+	}
+}
+
+//IsStreaming returns whether the request watches changes, as Server-Sent Events or over the WebSocket endpoint.
+//Such a request lasts as long as the client watches, so it must not be subject to a write timeout.
+func IsStreaming(r *http.Request) bool {
+	return r.URL.Path == webSocketPath || (r.Method == "GET" && r.URL.Query().Get("watch") == "true")
+}
+
+// isReadable returns whether the user is allowed to read the changed document, using the same rules as GetDocument
+func (s *server) isReadable(c api.Change, user api.User) (bool, error) {
+
+	r, err := s.GetRuleAndCheckPath(c.Target, user, false)
+	if IsNotAuthorized(err) || IsForbidden(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return r.PrepareCheckContent(false, s.GetDocument).Check(c.Document, api.Document{})
+}
+
+// watch streams the changes of the target document or collection as Server-Sent Events
+func (s *server) watch(w http.ResponseWriter, r *http.Request, target api.ObjectRef, user api.User) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleError(w, r, errors.New("streaming is not supported"))
+		return
+	}
+
+	if _, err := s.GetRuleAndCheckPath(target, user, false); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	sub := s.Changes.subscribe(target)
+	defer s.Changes.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case c, open := <-sub.changes:
+			if !open {
+				// The client is told to read the target again, rather than missing changes
+				if sub.dropped {
+					fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+
+			ok, err := s.isReadable(c, user)
+			if err != nil {
+				log.Println("Error: ", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			b, err := json.Marshal(c)
+			if err != nil {
+				log.Println("Error: ", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", c.Type, b)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package grest
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// webSocketPath is the path of the WebSocket endpoint, where clients subscribe to documents and collections
+const webSocketPath = "/_ws"
+
+// webSocketPingInterval is the delay between two pings sent to the client, which must answer within the same delay
+const webSocketPingInterval = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// Authentication relies on bearer tokens and not on cookies, so cross-origin connections are allowed
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsMessage is the message exchanged on the WebSocket, in both directions.
+//
+// Client messages:
+//   {"type":"auth","token":"..."}                     authenticates the session
+//   {"type":"subscribe","id":"s1","path":"coll/doc"}  subscribes to a document or a collection
+//   {"type":"unsubscribe","id":"s1"}                  cancels a subscription
+// Server messages:
+//   {"type":"authenticated"}
+//   {"type":"snapshot","id":"s1","data":{...}}        current content of the subscription target
+//   {"type":"change","id":"s1","change":{...}}        change committed on the subscription target
+//   {"type":"unsubscribed","id":"s1"}
+//   {"type":"error","id":"s1","error":"..."}
+type wsMessage struct {
+	Type   string      `json:"type"`
+	ID     string      `json:"id,omitempty"`
+	Token  string      `json:"token,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Change *api.Change `json:"change,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type wsSession struct {
+	s    *server
+	r    *http.Request
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+
+	user          api.User
+	subscriptions map[string]*subscriber
+}
+
+func (s *server) serveWebSocket(w http.ResponseWriter, r *http.Request, user api.User) {
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied to the client
+		log.Println("Error: ", err)
+		return
+	}
+	defer conn.Close()
+
+	session := &wsSession{
+		s:             s,
+		r:             r,
+		conn:          conn,
+		user:          user,
+		subscriptions: make(map[string]*subscriber),
+	}
+	defer session.unsubscribeAll()
+
+	conn.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go session.ping(ctx)
+
+	for {
+		var m wsMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Error: ", err)
+			}
+			return
+		}
+
+		switch m.Type {
+		case "auth":
+			session.authenticate(m)
+		case "subscribe":
+			session.subscribe(m)
+		case "unsubscribe":
+			session.unsubscribe(m)
+		default:
+			session.write(wsMessage{Type: "error", ID: m.ID, Error: "unsupported message type '" + m.Type + "'"})
+		}
+	}
+}
+
+func (session *wsSession) write(m wsMessage) {
+
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	if err := session.conn.WriteJSON(m); err != nil {
+		log.Println("Error: ", err)
+	}
+}
+
+// close sends a close frame to the client, and closes the connection, which ends the session
+func (session *wsSession) close(code int, text string) {
+
+	session.writeMu.Lock()
+	err := session.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(webSocketPingInterval))
+	session.writeMu.Unlock()
+	if err != nil {
+		log.Println("Error: ", err)
+	}
+
+	session.conn.Close()
+}
+
+func (session *wsSession) writeError(id string, err error) {
+	log.Println("Error: ", err)
+	session.write(wsMessage{Type: "error", ID: id, Error: err.Error()})
+}
+
+func (session *wsSession) ping(ctx context.Context) {
+
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			session.writeMu.Lock()
+			err := session.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketPingInterval))
+			session.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// authenticate authenticates the session with the given token, using the server authenticator
+// on a request carrying the token in its Authorization header.
+func (session *wsSession) authenticate(m wsMessage) {
+
+	if len(m.Token) == 0 {
+		session.writeError(m.ID, badRequest("missing token"))
+		return
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		session.writeError(m.ID, err)
+		return
+	}
+	r = r.WithContext(session.r.Context())
+	r.Header.Set("Authorization", "Bearer "+m.Token)
+
+	user, err := session.s.authenticate(r)
+	if err != nil {
+		session.writeError(m.ID, err)
+		return
+	}
+
+	session.user = user
+	session.write(wsMessage{Type: "authenticated", ID: m.ID})
+}
+
+func (session *wsSession) subscribe(m wsMessage) {
+
+	if len(m.ID) == 0 {
+		session.writeError(m.ID, badRequest("missing subscription id"))
+		return
+	}
+	if _, found := session.subscriptions[m.ID]; found {
+		session.writeError(m.ID, badRequest("subscription id already in use"))
+		return
+	}
+
+	target, err := getTarget(m.Path)
+	if err != nil {
+		session.writeError(m.ID, err)
+		return
+	}
+
+	// Subscribe first, so that no change is missed between the snapshot and the first change
+	user := session.user
+	sub := session.s.Changes.subscribe(target)
+
+	var data interface{}
+	if target.IsDocument() {
+		data, err = session.s.GetDocument(target, user)
+	} else {
+		// Only the first page is sent: its nextPageToken, if any, allows the client to get the others
+		data, err = session.s.GetCollection(target, defaultLimit, api.Query{}, user)
+	}
+	if target.IsDocument() && IsNotFound(err) {
+		// The document may be created later on
+		data, err = nil, nil
+	}
+	if err != nil {
+		session.s.Changes.unsubscribe(sub)
+		session.writeError(m.ID, err)
+		return
+	}
+
+	session.subscriptions[m.ID] = sub
+	session.write(wsMessage{Type: "snapshot", ID: m.ID, Data: data})
+
+	go func() {
+		for c := range sub.changes {
+			ok, err := session.s.isReadable(c, user)
+			if err != nil {
+				log.Println("Error: ", err)
+				continue
+			}
+			if ok {
+				c := c
+				session.write(wsMessage{Type: "change", ID: m.ID, Change: &c})
+			}
+		}
+
+		// Rather than leaving the subscription silently without changes, the client is told to connect again
+		if sub.dropped {
+			session.close(websocket.CloseTryAgainLater, "changes may have been missed")
+		}
+	}()
+}
+
+func (session *wsSession) unsubscribe(m wsMessage) {
+
+	sub, found := session.subscriptions[m.ID]
+	if !found {
+		session.writeError(m.ID, badRequest("unknown subscription id"))
+		return
+	}
+
+	delete(session.subscriptions, m.ID)
+	session.s.Changes.unsubscribe(sub)
+	session.write(wsMessage{Type: "unsubscribed", ID: m.ID})
+}
+
+func (session *wsSession) unsubscribeAll() {
+	for id, sub := range session.subscriptions {
+		delete(session.subscriptions, id)
+		session.s.Changes.unsubscribe(sub)
+	}
+}
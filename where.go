@@ -0,0 +1,196 @@
+package grest
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xdbsoft/grest/api"
+)
+
+// whereParser parses the 'where' query parameter of collection requests.
+// The expected syntax is a list of comparisons joined by '&&', e.g.
+//   properties.status=="open" && properties.priority>2
+// Values may be double quoted (JSON) strings, single quoted strings, numbers, true, false or null.
+type whereParser struct {
+	s   string
+	pos int
+}
+
+func getFilter(whereString string) (api.Filter, error) {
+
+	if len(strings.TrimSpace(whereString)) == 0 {
+		return nil, nil
+	}
+
+	p := whereParser{s: whereString}
+
+	var filter api.Filter
+	for {
+		c, err := p.condition()
+		if err != nil {
+			return nil, badRequest("Invalid where clause: " + err.Error())
+		}
+		filter = append(filter, c)
+
+		p.skipSpaces()
+		if p.pos == len(p.s) {
+			break
+		}
+		if !strings.HasPrefix(p.s[p.pos:], "&&") {
+			return nil, badRequest("Invalid where clause: expected '&&' at position " + strconv.Itoa(p.pos))
+		}
+		p.pos += 2
+	}
+
+	return filter, nil
+}
+
+type whereError string
+
+func (err whereError) Error() string {
+	return string(err)
+}
+
+func (p *whereParser) errorf(msg string) error {
+	return whereError(msg + " at position " + strconv.Itoa(p.pos))
+}
+
+func (p *whereParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func isFieldChar(c byte, first bool) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' {
+		return true
+	}
+	if first {
+		return false
+	}
+	return c >= '0' && c <= '9' || c == '.' || c == '-'
+}
+
+func (p *whereParser) condition() (api.Condition, error) {
+
+	field, err := p.field()
+	if err != nil {
+		return api.Condition{}, err
+	}
+
+	op, err := p.operator()
+	if err != nil {
+		return api.Condition{}, err
+	}
+
+	value, err := p.value()
+	if err != nil {
+		return api.Condition{}, err
+	}
+
+	if field.IsDate() && value != nil {
+		s, ok := value.(string)
+		if !ok {
+			return api.Condition{}, whereError("expected a date for field '" + field.String() + "'")
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return api.Condition{}, whereError("invalid date '" + s + "' for field '" + field.String() + "'")
+		}
+		value = t
+	}
+
+	return api.Condition{
+		Field:    field,
+		Operator: op,
+		Value:    value,
+	}, nil
+}
+
+func (p *whereParser) field() (api.FieldPath, error) {
+
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.s) && isFieldChar(p.s[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, p.errorf("expected a field")
+	}
+
+	return api.ParseFieldPath(p.s[start:p.pos])
+}
+
+var whereOperators = []api.Operator{api.Equal, api.NotEqual, api.LessOrEqual, api.GreaterOrEqual, api.Less, api.Greater}
+
+func (p *whereParser) operator() (api.Operator, error) {
+
+	p.skipSpaces()
+	for _, op := range whereOperators {
+		if strings.HasPrefix(p.s[p.pos:], string(op)) {
+			p.pos += len(op)
+			return op, nil
+		}
+	}
+	return "", p.errorf("expected an operator")
+}
+
+func (p *whereParser) value() (interface{}, error) {
+
+	p.skipSpaces()
+	if p.pos == len(p.s) {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch p.s[p.pos] {
+	case '"':
+		end := p.pos + 1
+		for end < len(p.s) && p.s[end] != '"' {
+			if p.s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.s) {
+			return nil, p.errorf("unterminated string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(p.s[p.pos:end+1]), &s); err != nil {
+			return nil, p.errorf("invalid string")
+		}
+		p.pos = end + 1
+		return s, nil
+	case '\'':
+		end := strings.IndexByte(p.s[p.pos+1:], '\'')
+		if end < 0 {
+			return nil, p.errorf("unterminated string")
+		}
+		s := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return s, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(" \t&", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	token := p.s[start:p.pos]
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	n, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid value '" + token + "'")
+	}
+	return n, nil
+}